@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fhir-to-server/pkg/bulk"
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"flag"
+	"github.com/rs/zerolog/log"
+	"os"
+)
+
+// importCommand loads the resources of a Bulk Data export with the configured
+// pipeline: "import [--topic <topic>] <manifest file | status url>"
+func importCommand(appConfig config.AppConfig, args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	topic := flags.String("topic", "bulk", "topic of the resources for topic specific configuration")
+	check(flags.Parse(args))
+	if flags.NArg() != 1 {
+		log.Fatal().Msg("Usage: fhir-to-server import [--topic <topic>] <manifest file | status url>")
+	}
+
+	if err := importExport(appConfig, flags.Arg(0), *topic); err != nil {
+		log.Error().Err(err).Str("state-file", appConfig.Bulk.StateFile).Msg("Import failed")
+		os.Exit(1)
+	}
+}
+
+// importExport sends the resources of the export in batch bundles
+func importExport(appConfig config.AppConfig, location string, topic string) error {
+	// parked batches would not be retried
+	appConfig.Fhir = withoutParking(appConfig.Fhir)
+	processor, closeProcessor := newProcessor(appConfig)
+	defer closeProcessor()
+	if appConfig.Fhir.DryRun.Enabled {
+		defer processor.Report().Log()
+	}
+
+	offset := 0
+	importer := bulk.NewImporter(appConfig.Bulk, func(resources []byte) bool {
+		offset++
+		return processor.ProcessMessage(&source.Message{
+			Origin: source.Origin{Topic: topic, Offset: int64(offset)},
+			Value:  resources,
+		})
+	})
+	return importer.Import(location)
+}
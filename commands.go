@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/dedup"
+	"fhir-to-server/pkg/fhir"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+)
+
+// runCommand runs a subcommand instead of consuming the input topics
+func runCommand(appConfig config.AppConfig, args []string) {
+	switch args[0] {
+	case "dedup":
+		dedupCommand(appConfig, args[1:])
+	case "import":
+		importCommand(appConfig, args[1:])
+	case "load":
+		loadCommand(appConfig, args[1:])
+	case "replay":
+		replayCommand(appConfig, args[1:])
+	case "transform":
+		transformCommand(appConfig, args[1:])
+	default:
+		log.Fatal().Str("command", args[0]).Msg("Unknown command")
+	}
+}
+
+// dedupCommand manages the deduplication store: "dedup clear" removes all
+// stored content hashes
+func dedupCommand(appConfig config.AppConfig, args []string) {
+	if len(args) != 1 || args[0] != "clear" {
+		log.Fatal().Msg("Usage: fhir-to-server dedup clear")
+	}
+
+	store, err := dedup.Open(appConfig.Fhir.Dedup)
+	check(err)
+
+	err = store.Clear()
+	check(err)
+	check(store.Close())
+
+	log.Info().Str("path", appConfig.Fhir.Dedup.Path).Msg("Deduplication store cleared")
+}
+
+// transformCommand applies the configured transformations to a sample file
+// and prints the result: "transform <file> [topic]"
+func transformCommand(appConfig config.AppConfig, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		log.Fatal().Msg("Usage: fhir-to-server transform <file> [topic]")
+	}
+
+	data, err := os.ReadFile(args[0])
+	check(err)
+
+	info := fhir.MessageInfo{Topic: "transform", Headers: map[string]string{}}
+	if len(args) == 2 {
+		info.Topic = args[1]
+	}
+
+	// the sample is never sent, so no deduplication store is needed
+	appConfig.Fhir.Dedup.Enabled = false
+	processor := fhir.NewProcessor(appConfig.Fhir)
+	defer processor.Close()
+
+	result, err := processor.Transform(data, info)
+	if err != nil {
+		log.Fatal().Err(err).Str("file", args[0]).Msg("Transformation failed")
+	}
+	fmt.Println(string(result))
+}
+
+// withoutParking disables topic dependencies and rejects messages with
+// unresolved references instead of holding them, for commands which do not
+// retry parked messages
+func withoutParking(fhirConfig config.Fhir) config.Fhir {
+	fhirConfig.Dependencies.Topics = nil
+	if fhirConfig.References.Policy == "hold" {
+		fhirConfig.References.Policy = "reject"
+	}
+	return fhirConfig
+}
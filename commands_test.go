@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fhir-to-server/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestWithoutParking(t *testing.T) {
+	cases := []struct {
+		name     string
+		policy   string
+		expected string
+	}{
+		{name: "hold", policy: "hold", expected: "reject"},
+		{name: "reorder", policy: "reorder", expected: "reorder"},
+		{name: "reject", policy: "reject", expected: "reject"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fhirConfig := config.Fhir{
+				References:   config.References{Enabled: true, Policy: c.policy},
+				Dependencies: config.Dependencies{Topics: map[string][]string{"observation": {"patient"}}},
+			}
+
+			actual := withoutParking(fhirConfig)
+
+			assert.Equal(t, c.expected, actual.References.Policy)
+			assert.Empty(t, actual.Dependencies.Topics)
+			// the original configuration is unchanged
+			assert.Equal(t, c.policy, fhirConfig.References.Policy)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"github.com/rs/zerolog/log"
+)
+
+// kafkaClient returns the configured Kafka client or the default of the build
+func kafkaClient(config config.AppConfig) string {
+	if config.Kafka.Client == "" {
+		return defaultClient
+	}
+	return config.Kafka.Client
+}
+
+// subscribe creates a consumer of the topic in the consumer group, which
+// starts at the earliest offset and stores offsets of acknowledged messages
+func subscribe(config config.AppConfig, topic string, clientId string) source.Source {
+	switch client := kafkaClient(config); client {
+	case "confluent":
+		return subscribeConfluent(config, topic, clientId)
+	case "franz":
+		src, err := source.NewFranzSource(config.Kafka, groupId(config), topic, clientId)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Unable to connect to Kafka")
+		}
+		return src
+	default:
+		log.Fatal().Str("client", client).Msg("Unknown Kafka client")
+		return nil
+	}
+}
+
+func newProducer(config config.AppConfig) source.Producer {
+	switch client := kafkaClient(config); client {
+	case "confluent":
+		return newConfluentProducer(config)
+	case "franz":
+		producer, err := source.NewFranzProducer(config.Kafka)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Unable to create Kafka producer")
+		}
+		return producer
+	default:
+		log.Fatal().Str("client", client).Msg("Unknown Kafka client")
+		return nil
+	}
+}
+
+// newReplayer creates a consumer, which replays partitions without consumer group
+// offsets
+func newReplayer(config config.AppConfig) replayer {
+	switch client := kafkaClient(config); client {
+	case "confluent":
+		return newConfluentReplayer(config)
+	case "franz":
+		return newFranzReplayer(config)
+	default:
+		log.Fatal().Str("client", client).Msg("Unknown Kafka client")
+		return nil
+	}
+}
@@ -0,0 +1,63 @@
+//go:build !franz
+
+package main
+
+import (
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultClient is librdkafka, unless built with the franz tag
+const defaultClient = "confluent"
+
+// kafkaConfig returns the connection properties shared by consumers and
+// producers
+func kafkaConfig(config config.AppConfig) kafka.ConfigMap {
+	configMap := kafka.ConfigMap{
+		"bootstrap.servers":        config.Kafka.BootstrapServers,
+		"security.protocol":        config.Kafka.SecurityProtocol,
+		"ssl.ca.location":          config.Kafka.Ssl.CaLocation,
+		"ssl.key.location":         config.Kafka.Ssl.KeyLocation,
+		"ssl.certificate.location": config.Kafka.Ssl.CertificateLocation,
+		"ssl.key.password":         config.Kafka.Ssl.KeyPassword,
+		"broker.address.family":    "v4",
+	}
+	if config.Kafka.Sasl.Mechanism != "" {
+		configMap["sasl.mechanisms"] = config.Kafka.Sasl.Mechanism
+		configMap["sasl.username"] = config.Kafka.Sasl.Username
+		configMap["sasl.password"] = config.Kafka.Sasl.Password
+	}
+	return configMap
+}
+
+func subscribeConfluent(config config.AppConfig, topic string, clientId string) source.Source {
+	configMap := kafkaConfig(config)
+	configMap["group.id"] = groupId(config)
+	configMap["enable.auto.commit"] = true
+	configMap["enable.auto.offset.store"] = false
+	configMap["auto.offset.reset"] = "earliest"
+
+	consumer, err := kafka.NewConsumer(&configMap)
+
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to connect to Kafka")
+	}
+
+	err = consumer.Subscribe(topic, nil)
+	check(err)
+
+	return source.NewKafkaSource(consumer, clientId)
+}
+
+func newConfluentProducer(config config.AppConfig) source.Producer {
+	configMap := kafkaConfig(config)
+	configMap["enable.idempotence"] = true
+
+	producer, err := kafka.NewProducer(&configMap)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to create Kafka producer")
+	}
+	return source.NewKafkaProducer(producer)
+}
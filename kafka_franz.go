@@ -0,0 +1,27 @@
+//go:build franz
+
+package main
+
+import (
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultClient is franz-go in builds without librdkafka
+const defaultClient = "franz"
+
+func subscribeConfluent(config.AppConfig, string, string) source.Source {
+	log.Fatal().Msg("Kafka client 'confluent' is not available in this build")
+	return nil
+}
+
+func newConfluentProducer(config.AppConfig) source.Producer {
+	log.Fatal().Msg("Kafka client 'confluent' is not available in this build")
+	return nil
+}
+
+func newConfluentReplayer(config.AppConfig) replayer {
+	log.Fatal().Msg("Kafka client 'confluent' is not available in this build")
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"flag"
+	"github.com/rs/zerolog/log"
+	"os"
+)
+
+// loadCommand sends the records of files, directories or stdin to the FHIR
+// server with the configured pipeline and reports the result per file:
+// "load [--topic <topic>] <path>..."
+func loadCommand(appConfig config.AppConfig, args []string) {
+	flags := flag.NewFlagSet("load", flag.ExitOnError)
+	topic := flags.String("topic", "load", "topic of the records for topic specific configuration")
+	check(flags.Parse(args))
+	if flags.NArg() == 0 {
+		log.Fatal().Msg("Usage: fhir-to-server load [--topic <topic>] <path>...")
+	}
+
+	files, err := source.Files(flags.Args())
+	check(err)
+
+	if !load(appConfig, files, *topic) {
+		log.Error().Msg("Load failed")
+		os.Exit(1)
+	}
+}
+
+// load processes the messages of the files and returns false, if a file could
+// not be read or a message failed
+func load(appConfig config.AppConfig, files []string, topic string) bool {
+	// parked messages would not be retried
+	appConfig.Fhir = withoutParking(appConfig.Fhir)
+	processor, closeProcessor := newProcessor(appConfig)
+	defer closeProcessor()
+	if appConfig.Fhir.DryRun.Enabled {
+		defer processor.Report().Log()
+	}
+
+	src := source.NewFileSource(files, topic)
+	defer src.Close()
+	for {
+		msg, err := src.Receive(0)
+		if err != nil {
+			break
+		}
+		if processor.ProcessMessage(msg) {
+			msg.Ack()
+		}
+	}
+
+	failed := false
+	for _, result := range src.Results() {
+		logEvent := log.Info()
+		if result.Err != nil || result.Failed > 0 {
+			failed = true
+			logEvent = log.Error().Err(result.Err)
+		}
+		logEvent.
+			Str("file", result.File).
+			Int("processed", result.Processed).
+			Int("failed", result.Failed).
+			Msg("File loaded")
+	}
+	return !failed
+}
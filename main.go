@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fhir-to-server/pkg/config"
 	"fhir-to-server/pkg/fhir"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"fhir-to-server/pkg/ingest"
+	"fhir-to-server/pkg/metrics"
+	"fhir-to-server/pkg/source"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
@@ -18,12 +22,49 @@ import (
 func main() {
 	appConfig := loadConfig()
 	configureLogger(appConfig.App)
-	// signal handler to break the loop
+
+	if len(os.Args) > 1 {
+		runCommand(appConfig, os.Args[1:])
+		return
+	}
+	metrics.Serve(appConfig.App.Metrics)
+	// signal handler to break the loop. Consumers cancel the context on
+	// failures to shut down all consumers
 	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	ctx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
 
 	// create processor
-	processor := fhir.NewProcessor(appConfig.Fhir)
+	processor, closeProcessor := newProcessor(appConfig)
+	defer closeProcessor()
+
+	// accept bundles via HTTP
+	if appConfig.Http.Enabled {
+		server, closeSubmit := serveHttp(appConfig, processor)
+		defer closeSubmit()
+		defer server.Close()
+	}
+
+	// dry run: report validation results periodically and at the end
+	dryRun := appConfig.Fhir.DryRun
+	if dryRun.Enabled {
+		defer processor.Report().Log()
+		if dryRun.ReportInterval > 0 {
+			ticker := time.NewTicker(dryRun.ReportInterval)
+			defer ticker.Stop()
+			go func() {
+				for range ticker.C {
+					processor.Report().Log()
+				}
+			}()
+		}
+		log.Warn().Str("group-id", groupId(appConfig)).Msg("Dry run: resources are validated, but not stored")
+	}
+
+	if appConfig.Fhir.Batch.Enabled && (len(appConfig.Fhir.Dependencies.Topics) > 0 || appConfig.Fhir.References.Policy == "hold") {
+		log.Fatal().Msg("Topic dependencies and reference policy 'hold' are not supported with batching")
+	}
 
 	var wg sync.WaitGroup
 
@@ -35,154 +76,189 @@ func main() {
 			defer wg.Done()
 
 			// create consumer and subscribe to input topics
-			consumer := subscribe(appConfig, topic)
+			src := subscribe(appConfig, topic, clientId)
 			log.Info().
 				Str("topic", topic).
-				Str("group-id", appConfig.App.Name).
+				Str("group-id", groupId(appConfig)).
 				Str("client-id", clientId).Msg("Consumer created")
 
+			// aggregate messages into batch bundles, if enabled
+			var batch *fhir.Batch
+			if appConfig.Fhir.Batch.Enabled && !dryRun.Enabled {
+				batch = processor.NewBatch()
+			}
+
 			for {
 				select {
-				case <-sigchan:
+				case <-ctx.Done():
+					if batch != nil {
+						flushBatch(batch)
+					}
 
-					syncConsumerCommits(consumer)
+					check(src.Close())
 					log.Info().
 						Str("client-id", clientId).
 						Str("topic", topic).
 						Msg("Consumer shut down gracefully")
 					return
 				default:
-					msg, err := consumer.ReadMessage(1 * time.Second)
-					if err == nil {
+					msg, err := src.Receive(1 * time.Second)
+					if err == nil && msg != nil {
 
 						log.Debug().
 							Str("client-id", clientId).
 							Str("topic", topic).
 							Str("key", string(msg.Key)).
 							Msg("Message received")
-						success := processor.ProcessMessage(msg)
-						select {
-						case <-sigchan:
-							if success {
-								storeMessage(consumer, msg, clientId)
-							}
-						default:
-							if success {
-								storeMessage(consumer, msg, clientId)
-							} else {
-								sigchan <- syscall.SIGTERM
+
+						var success bool
+						if batch == nil {
+							success = processor.ProcessMessage(msg)
+							// offsets of a dry run are not stored
+							if success && !dryRun.Enabled {
+								processor.Stored(msg).Ack()
 							}
+						} else {
+							success = addToBatch(batch, msg)
 						}
-					} else {
-						var kafkaErr kafka.Error
-						if errors.As(err, &kafkaErr) {
-							// The client will automatically try to recover from all errors.
-							// Timeout is not considered an error because it is raised by
-							// ReadMessage in absence of messages.
-							if kafkaErr.IsTimeout() {
-								continue
-							}
-
-							log.Error().Err(kafkaErr).
-								Str("client-id", clientId).
-								Str("topic", topic).
-								Msg("Consumer error")
+						// retry parked messages after dependency topics progressed
+						success = success && retryParked(processor, topic)
 
-							// Exceeding 'max.poll.interval.ms' makes the client leave the consumer group
-							if kafkaErr.Code() == kafka.ErrMaxPollExceeded {
-								sigchan <- syscall.SIGTERM
-							}
+						if !success {
+							shutdown()
+						}
+					} else if err == nil {
+						// no message within the timeout: send pending batch after its
+						// maximum wait time
+						if (batch != nil && batch.Due() && !flushBatch(batch)) || !retryParked(processor, topic) {
+							shutdown()
+						}
+					} else {
+						// The client will automatically try to recover from all errors.
+						log.Error().Err(err).
+							Str("client-id", clientId).
+							Str("topic", topic).
+							Msg("Consumer error")
 
-						} else {
-							log.Fatal().
-								Err(kafkaErr).
-								Str("client-id", clientId).
-								Str("topic", topic).
-								Msg("Unexpected error type")
-							sigchan <- syscall.SIGTERM
+						if errors.Is(err, source.ErrLeftGroup) {
+							shutdown()
 						}
 					}
 				}
 			}
 		}()
 	}
-	<-sigchan
-	close(sigchan)
+	select {
+	case <-sigchan:
+		shutdown()
+	case <-ctx.Done():
+	}
 	wg.Wait()
 
 	log.Info().Msg("All consumers stopped")
 }
 
-func storeMessage(c *kafka.Consumer, msg *kafka.Message, clientId string) {
-	_, err := c.StoreMessage(msg)
-
-	var logEvent *zerolog.Event
-	var logMsg string
-
-	if err != nil {
-		logEvent = log.Warn()
-		logMsg = "Failed to commit offset for message"
-	} else {
-		logEvent = log.Debug()
-		logMsg = "Offset for message stored"
+// newProcessor creates the processor with the dead letter queue for messages
+// which cannot be loaded, if configured. The returned function releases both
+func newProcessor(appConfig config.AppConfig) (*fhir.Processor, func()) {
+	processor := fhir.NewProcessor(appConfig.Fhir)
+	if appConfig.Kafka.DeadLetterTopic == "" {
+		if appConfig.Fhir.ConceptMap.Enabled && appConfig.Fhir.ConceptMap.Unmapped == "dlq" {
+			log.Fatal().Msg("Dead letter topic required for unmapped codes policy 'dlq'")
+		}
+		return processor, processor.Close
 	}
 
-	logEvent.
-		Str("client-id", clientId).
-		Str("key", string(msg.Key)).
-		Str("topic", *msg.TopicPartition.Topic).
-		Str("offset", msg.TopicPartition.Offset.String()).
-		Msg(logMsg)
+	deadLetters := fhir.NewKafkaDeadLetterQueue(newProducer(appConfig), appConfig.Kafka.DeadLetterTopic)
+	processor.SetDeadLetterQueue(deadLetters)
+	return processor, func() {
+		deadLetters.Close()
+		processor.Close()
+	}
 }
 
-func syncConsumerCommits(c *kafka.Consumer) {
-	err := c.Unsubscribe()
-	if err != nil {
-		log.Error().Msg("Failed to unsubscribe consumer from the current subscription")
+// serveHttp starts the HTTP endpoint, which sends bundles to the FHIR server
+// (sync) or produces them to the input topic (buffered). The returned function
+// releases the producer
+func serveHttp(appConfig config.AppConfig, processor *fhir.Processor) (*http.Server, func()) {
+	httpConfig := appConfig.Http
+	if httpConfig.Topic == "" && len(appConfig.Kafka.InputTopics) > 0 {
+		httpConfig.Topic = appConfig.Kafka.InputTopics[0]
 	}
-	parts, err := c.Commit()
-	if err != nil {
-		if err.(kafka.Error).Code() == kafka.ErrNoOffset {
-			return
-		}
-		log.Error().Err(err).Msg("Failed to commit offsets")
-	} else {
 
-		for _, tp := range parts {
-			log.Info().
-				Str("topic", *tp.Topic).
-				Int32("partition", tp.Partition).
-				Str("offset", tp.Offset.String()).
-				Msg("Stored offsets committed")
+	var submit ingest.Submit
+	closeSubmit := func() {}
+	switch httpConfig.Mode {
+	case "sync":
+		submit = processor.Submit
+	case "buffered":
+		if httpConfig.Topic == "" {
+			log.Fatal().Msg("Buffered HTTP mode requires a topic")
 		}
+		producer := newProducer(appConfig)
+		submit = ingest.Produce(producer, httpConfig.Topic)
+		closeSubmit = producer.Close
+	default:
+		log.Fatal().Str("mode", httpConfig.Mode).Msg("Unknown HTTP mode")
+	}
+
+	headers := append([]string{appConfig.Fhir.Headers.Target, appConfig.Fhir.Headers.Operation}, appConfig.Fhir.Headers.Propagate...)
+	server, err := ingest.Serve(httpConfig, ingest.NewHandler(httpConfig, headers, submit))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to serve HTTP endpoint")
 	}
-	err = c.Close()
-	check(err)
+	return server, closeSubmit
 }
 
-func subscribe(config config.AppConfig, topic string) *kafka.Consumer {
-	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers":        config.Kafka.BootstrapServers,
-		"security.protocol":        config.Kafka.SecurityProtocol,
-		"ssl.ca.location":          config.Kafka.Ssl.CaLocation,
-		"ssl.key.location":         config.Kafka.Ssl.KeyLocation,
-		"ssl.certificate.location": config.Kafka.Ssl.CertificateLocation,
-		"ssl.key.password":         config.Kafka.Ssl.KeyPassword,
-		"broker.address.family":    "v4",
-		"group.id":                 config.App.Name,
-		"enable.auto.commit":       true,
-		"enable.auto.offset.store": false,
-		"auto.offset.reset":        "earliest",
-	})
+// addToBatch adds the message to the batch and sends the batch if it is full or
+// due. Messages from another partition cause the batch to be sent beforehand
+func addToBatch(batch *fhir.Batch, msg *source.Message) bool {
+	if !batch.Accepts(msg) && !flushBatch(batch) {
+		return false
+	}
 
-	if err != nil {
-		log.Fatal().Err(err).Msg("Unable to connect to Kafka")
+	last, success := batch.Add(msg)
+	if last != nil {
+		last.Ack()
+	}
+	if !success {
+		return false
+	}
+	if batch.Full() || batch.Due() {
+		return flushBatch(batch)
+	}
+	return true
+}
+
+// flushBatch sends the batch and acknowledges the last message up to which all
+// messages were processed successfully
+func flushBatch(batch *fhir.Batch) bool {
+	last, success := batch.Flush()
+	if last != nil {
+		last.Ack()
 	}
+	return success
+}
 
-	err = consumer.Subscribe(topic, nil)
-	check(err)
+// retryParked processes due parked messages of the topic and acknowledges the
+// messages up to which all messages were processed
+func retryParked(processor *fhir.Processor, topic string) bool {
+	stored, success := processor.RetryParked(topic)
+	for _, msg := range stored {
+		msg.Ack()
+	}
+	return success
+}
 
-	return consumer
+// groupId returns the consumer group, which differs in dry run mode
+func groupId(config config.AppConfig) string {
+	if !config.Fhir.DryRun.Enabled {
+		return config.App.Name
+	}
+	if config.Fhir.DryRun.GroupId != "" {
+		return config.Fhir.DryRun.GroupId
+	}
+	return config.App.Name + "-dry-run"
 }
 
 func check(err error) {
@@ -0,0 +1,174 @@
+package bulk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fhir-to-server/pkg/config"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// State is the progress of an import, which is resumed if the manifest is
+// imported again
+type State struct {
+	Request         string `json:"request"`
+	TransactionTime string `json:"transactionTime"`
+	// Files holds the number of loaded lines by output url
+	Files map[string]int `json:"files"`
+}
+
+// Importer loads the output files of a manifest in batches of resources
+type Importer struct {
+	config config.Bulk
+	source *Source
+	// send loads the NDJSON resources of a batch and reports success
+	send func(resources []byte) bool
+}
+
+func NewImporter(config config.Bulk, send func(resources []byte) bool) *Importer {
+	return &Importer{config: config, source: NewSource(config), send: send}
+}
+
+// Import loads the resources of the manifest at the location, a file or a
+// $export status url. Progress is saved after each batch
+func (i *Importer) Import(location string) error {
+	manifest, err := i.source.Manifest(location)
+	if err != nil {
+		return err
+	}
+	for _, e := range manifest.Error {
+		log.Warn().Str("type", e.Type).Str("url", e.Url).Int("count", e.Count).Msg("Export reported errors")
+	}
+
+	state, err := i.loadState(manifest)
+	if err != nil {
+		return err
+	}
+
+	for _, output := range manifest.Output {
+		if err := i.importOutput(location, manifest, output, state); err != nil {
+			return err
+		}
+	}
+	log.Info().Int("files", len(manifest.Output)).Msg("Import finished")
+	return nil
+}
+
+// importOutput loads the lines of an output file, which were not loaded before
+func (i *Importer) importOutput(location string, manifest *Manifest, output Output, state *State) error {
+	done := state.Files[output.Url]
+	if output.Count > 0 && done >= output.Count {
+		log.Info().Str("type", output.Type).Str("url", output.Url).Msg("Output file already imported")
+		return nil
+	}
+
+	r, err := i.source.Open(location, output, manifest.RequiresAccessToken)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	reader := bufio.NewReader(r)
+	var batch [][]byte
+	line := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if !i.send(bytes.Join(batch, []byte("\n"))) {
+			return fmt.Errorf("failed to load lines %d to %d of %s", line-len(batch)+1, line, output.Url)
+		}
+		batch = batch[:0]
+		state.Files[output.Url] = line
+		log.Debug().Str("type", output.Type).Int("loaded", line).Int("count", output.Count).Msg("Import progress")
+		return i.saveState(state)
+	}
+
+	for {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if resource := bytes.TrimSpace(data); len(resource) > 0 {
+			line++
+			if line > done {
+				batch = append(batch, resource)
+			}
+		}
+		if len(batch) >= max(i.config.BatchSize, 1) || (errors.Is(err, io.EOF) && len(batch) > 0) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+
+	log.Info().Str("type", output.Type).Str("url", output.Url).Int("resources", line).Msg("Output file imported")
+	if state.Files[output.Url] != line {
+		state.Files[output.Url] = line
+		return i.saveState(state)
+	}
+	return nil
+}
+
+// loadState reads the progress of the manifest's import. The progress of
+// another export is discarded
+func (i *Importer) loadState(manifest *Manifest) (*State, error) {
+	state := &State{Request: manifest.Request, TransactionTime: manifest.TransactionTime, Files: make(map[string]int)}
+	if i.config.StateFile == "" {
+		return state, nil
+	}
+
+	data, err := os.ReadFile(i.config.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved State
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", i.config.StateFile, err)
+	}
+	if saved.Request != manifest.Request || saved.TransactionTime != manifest.TransactionTime || saved.Files == nil {
+		log.Warn().Str("state-file", i.config.StateFile).Msg("State of another export discarded")
+		return state, nil
+	}
+	log.Info().Str("state-file", i.config.StateFile).Msg("Resuming import")
+	return &saved, nil
+}
+
+// saveState replaces the state file, so it is complete after a crash
+func (i *Importer) saveState(state *State) error {
+	if i.config.StateFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(i.config.StateFile), filepath.Base(i.config.StateFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), i.config.StateFile)
+}
@@ -0,0 +1,189 @@
+package bulk
+
+import (
+	"fhir-to-server/pkg/config"
+	"fmt"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const manifest = `{
+	"transactionTime": "2024-05-01T00:00:00Z",
+	"request": "https://source/fhir/$export",
+	"output": [
+		{"type": "Patient", "url": "https://source/files/patient.ndjson", "count": 3},
+		{"type": "Observation", "url": "https://source/files/observation.ndjson", "count": 2}
+	]
+}`
+
+func newTestImporter(t *testing.T, batchSize int, send func(resources []byte) bool) *Importer {
+	i := NewImporter(config.Bulk{
+		BatchSize:    batchSize,
+		StateFile:    filepath.Join(t.TempDir(), "state.json"),
+		PollInterval: time.Second,
+	}, send)
+	i.source.sleep = func(d time.Duration) {}
+
+	httpmock.ActivateNonDefault(i.source.rest.GetClient())
+	t.Cleanup(httpmock.DeactivateAndReset)
+
+	httpmock.RegisterResponder("GET", "https://source/files/patient.ndjson",
+		httpmock.NewStringResponder(200, "{\"id\":\"1\"}\n{\"id\":\"2\"}\n\n{\"id\":\"3\"}\n"))
+	httpmock.RegisterResponder("GET", "https://source/files/observation.ndjson",
+		httpmock.NewStringResponder(200, "{\"id\":\"4\"}\n{\"id\":\"5\"}"))
+	return i
+}
+
+func TestImportPollsStatus(t *testing.T) {
+	var batches []string
+	i := newTestImporter(t, 2, func(resources []byte) bool {
+		batches = append(batches, string(resources))
+		return true
+	})
+
+	polls := 0
+	httpmock.RegisterResponder("GET", "https://source/fhir/status", func(req *http.Request) (*http.Response, error) {
+		polls++
+		if polls < 3 {
+			resp := httpmock.NewStringResponse(202, "")
+			resp.Header.Set("Retry-After", "1")
+			return resp, nil
+		}
+		return httpmock.NewStringResponse(200, manifest), nil
+	})
+
+	err := i.Import("https://source/fhir/status")
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, polls)
+	assert.Equal(t, []string{
+		"{\"id\":\"1\"}\n{\"id\":\"2\"}",
+		"{\"id\":\"3\"}",
+		"{\"id\":\"4\"}\n{\"id\":\"5\"}",
+	}, batches)
+}
+
+func TestPollInterval(t *testing.T) {
+	cases := []struct {
+		name         string
+		pollInterval time.Duration
+		retryAfter   string
+		expected     time.Duration
+	}{
+		{name: "configured", pollInterval: 5 * time.Second, expected: 5 * time.Second},
+		{name: "retry after", pollInterval: 5 * time.Second, retryAfter: "2", expected: 2 * time.Second},
+		{name: "not configured", expected: minPollInterval},
+		{name: "zero retry after", retryAfter: "0", expected: minPollInterval},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := NewSource(config.Bulk{PollInterval: c.pollInterval})
+			var waits []time.Duration
+			s.sleep = func(d time.Duration) { waits = append(waits, d) }
+
+			httpmock.ActivateNonDefault(s.rest.GetClient())
+			t.Cleanup(httpmock.DeactivateAndReset)
+			polls := 0
+			httpmock.RegisterResponder("GET", "https://source/fhir/status", func(req *http.Request) (*http.Response, error) {
+				polls++
+				if polls < 2 {
+					resp := httpmock.NewStringResponse(202, "")
+					if c.retryAfter != "" {
+						resp.Header.Set("Retry-After", c.retryAfter)
+					}
+					return resp, nil
+				}
+				return httpmock.NewStringResponse(200, manifest), nil
+			})
+
+			_, err := s.Manifest("https://source/fhir/status")
+
+			assert.NoError(t, err)
+			assert.Equal(t, []time.Duration{c.expected}, waits)
+		})
+	}
+}
+
+func TestImportResumes(t *testing.T) {
+	var batches []string
+	fail := true
+	i := newTestImporter(t, 1, func(resources []byte) bool {
+		if fail && strings.Contains(string(resources), "\"3\"") {
+			return false
+		}
+		batches = append(batches, string(resources))
+		return true
+	})
+	location := filepath.Join(t.TempDir(), "manifest.json")
+	assert.NoError(t, os.WriteFile(location, []byte(manifest), 0o644))
+
+	err := i.Import(location)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"{\"id\":\"1\"}", "{\"id\":\"2\"}"}, batches)
+
+	// resumes at the failed line
+	fail = false
+	batches = nil
+	err = i.Import(location)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"{\"id\":\"3\"}", "{\"id\":\"4\"}", "{\"id\":\"5\"}"}, batches)
+
+	// nothing left to import
+	batches = nil
+	err = i.Import(location)
+	assert.NoError(t, err)
+	assert.Empty(t, batches)
+}
+
+func TestImportFailedExport(t *testing.T) {
+	i := newTestImporter(t, 1, func(resources []byte) bool { return true })
+	httpmock.RegisterResponder("GET", "https://source/fhir/status",
+		httpmock.NewStringResponder(500, `{"resourceType":"OperationOutcome"}`))
+
+	err := i.Import("https://source/fhir/status")
+
+	assert.ErrorContains(t, err, "export failed")
+}
+
+func TestImportAccessToken(t *testing.T) {
+	cases := []struct {
+		name                string
+		requiresAccessToken bool
+		expected            string
+	}{
+		{"required", true, "Bearer secret"},
+		{"notRequired", false, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			i := newTestImporter(t, 10, func(resources []byte) bool { return true })
+			i.source.config.Token = "secret"
+
+			var statusAuth string
+			httpmock.RegisterResponder("GET", "https://source/fhir/status", func(req *http.Request) (*http.Response, error) {
+				statusAuth = req.Header.Get("Authorization")
+				return httpmock.NewStringResponse(200, strings.Replace(manifest, `"output"`,
+					fmt.Sprintf(`"requiresAccessToken": %t, "output"`, c.requiresAccessToken), 1)), nil
+			})
+			var outputAuth []string
+			httpmock.RegisterResponder("GET", "https://source/files/patient.ndjson", func(req *http.Request) (*http.Response, error) {
+				outputAuth = append(outputAuth, req.Header.Get("Authorization"))
+				return httpmock.NewStringResponse(200, `{"id":"1"}`), nil
+			})
+
+			err := i.Import("https://source/fhir/status")
+
+			assert.NoError(t, err)
+			assert.Equal(t, "Bearer secret", statusAuth)
+			assert.Equal(t, []string{c.expected}, outputAuth)
+		})
+	}
+}
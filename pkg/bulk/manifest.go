@@ -0,0 +1,152 @@
+package bulk
+
+import (
+	"encoding/json"
+	"fhir-to-server/pkg/config"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Manifest is the result of a Bulk Data export
+type Manifest struct {
+	TransactionTime     string   `json:"transactionTime"`
+	Request             string   `json:"request"`
+	RequiresAccessToken bool     `json:"requiresAccessToken"`
+	Output              []Output `json:"output"`
+	Error               []Output `json:"error"`
+}
+
+// Output is an NDJSON file of the export with resources of a type
+type Output struct {
+	Type  string `json:"type"`
+	Url   string `json:"url"`
+	Count int    `json:"count"`
+}
+
+// minPollInterval limits the requests to the status url, if neither an interval
+// is configured nor the server sends a Retry-After header
+const minPollInterval = time.Second
+
+// Source reads manifests and their output files from the exporting server or
+// the file system
+type Source struct {
+	config config.Bulk
+	rest   *resty.Client
+	sleep  func(d time.Duration)
+}
+
+func NewSource(bulk config.Bulk) *Source {
+	client := resty.New().
+		SetLogger(config.DefaultLogger()).
+		SetHeader("Accept", "application/json")
+
+	return &Source{config: bulk, rest: client, sleep: time.Sleep}
+}
+
+// authorized returns a request with the credentials of the exporting server.
+// They are set per request, so they are not sent to other servers
+func (s *Source) authorized() *resty.Request {
+	r := s.rest.R()
+	if s.config.Auth != nil && s.config.Auth.User != "" {
+		r.SetBasicAuth(s.config.Auth.User, s.config.Auth.Password)
+	}
+	if s.config.Token != "" {
+		r.SetAuthToken(s.config.Token)
+	}
+	return r
+}
+
+// Manifest reads the manifest from a file or polls the $export status url
+// until the export is complete
+func (s *Source) Manifest(location string) (*Manifest, error) {
+	var data []byte
+	if isUrl(location) {
+		var err error
+		if data, err = s.poll(location); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(location); err != nil {
+			return nil, err
+		}
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", location, err)
+	}
+	return &m, nil
+}
+
+// poll requests the status url while the export is in progress (202 Accepted)
+// and returns the manifest of the completed export
+func (s *Source) poll(statusUrl string) ([]byte, error) {
+	for {
+		resp, err := s.authorized().Get(statusUrl)
+		if err != nil {
+			return nil, err
+		}
+
+		switch resp.StatusCode() {
+		case http.StatusOK:
+			return resp.Body(), nil
+		case http.StatusAccepted:
+			wait := s.config.PollInterval
+			if seconds, err := strconv.Atoi(resp.Header().Get("Retry-After")); err == nil {
+				wait = time.Duration(seconds) * time.Second
+			}
+			wait = max(wait, minPollInterval)
+			log.Info().
+				Str("url", statusUrl).
+				Str("progress", resp.Header().Get("X-Progress")).
+				Msg("Export in progress")
+			s.sleep(wait)
+		default:
+			return nil, fmt.Errorf("export failed: %s %s", resp.Status(), string(resp.Body()))
+		}
+	}
+}
+
+// Open opens an output file of the manifest. Urls are requested with the
+// credentials of the exporting server, if the manifest requires an access
+// token. Other paths are relative to the manifest file
+func (s *Source) Open(location string, output Output, requiresAccessToken bool) (io.ReadCloser, error) {
+	if !isUrl(output.Url) {
+		path := output.Url
+		if !filepath.IsAbs(path) && !isUrl(location) {
+			path = filepath.Join(filepath.Dir(location), path)
+		}
+		return os.Open(path)
+	}
+
+	r := s.rest.R()
+	if requiresAccessToken {
+		r = s.authorized()
+	}
+	resp, err := r.
+		SetHeader("Accept", "application/fhir+ndjson").
+		SetDoNotParseResponse(true).
+		Get(output.Url)
+	if err != nil {
+		return nil, err
+	}
+	body := resp.RawBody()
+	if !resp.IsSuccess() {
+		_ = body.Close()
+		return nil, fmt.Errorf("failed to download %s: %s", output.Url, resp.Status())
+	}
+	return body, nil
+}
+
+func isUrl(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
@@ -0,0 +1,110 @@
+package codec
+
+import (
+	"fmt"
+	"github.com/hamba/avro/v2"
+	"strings"
+	"sync"
+)
+
+// AvroDeserializer decodes Avro records in the Confluent wire format and
+// returns the payload field
+type AvroDeserializer struct {
+	registry *Registry
+	field    string
+	mu       sync.Mutex
+	schemas  map[int]avro.Schema
+}
+
+func NewAvroDeserializer(registry *Registry, field string) *AvroDeserializer {
+	return &AvroDeserializer{registry: registry, field: payloadField(field), schemas: make(map[int]avro.Schema)}
+}
+
+func (d *AvroDeserializer) Deserialize(_ string, data []byte) ([]byte, error) {
+	id, record, err := wireFormat(data)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := d.schema(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var value any
+	if err = avro.Unmarshal(schema, record, &value); err != nil {
+		return nil, fmt.Errorf("failed to decode Avro record with schema %d: %w", id, err)
+	}
+	var current avro.Schema = schema
+	for _, name := range strings.Split(d.field, ".") {
+		value, current = resolveUnion(value, current)
+		record, ok := current.(*avro.RecordSchema)
+		fields, isMap := value.(map[string]any)
+		if !ok || !isMap {
+			return nil, fmt.Errorf("payload field %s is missing or null", d.field)
+		}
+		current = nil
+		for _, f := range record.Fields() {
+			if f.Name() == name {
+				current = f.Type()
+			}
+		}
+		if current == nil {
+			return nil, fmt.Errorf("payload field %s is missing or null", d.field)
+		}
+		value = fields[name]
+	}
+	value, _ = resolveUnion(value, current)
+	return payloadBytes(value, d.field)
+}
+
+func (d *AvroDeserializer) schema(id int) (avro.Schema, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if schema, ok := d.schemas[id]; ok {
+		return schema, nil
+	}
+	s, err := d.registry.Schema(id)
+	if err != nil {
+		return nil, err
+	}
+	if s.Type != "AVRO" {
+		return nil, fmt.Errorf("schema %d is not an Avro schema: %s", id, s.Type)
+	}
+	// referenced named types are parsed first
+	cache := &avro.SchemaCache{}
+	err = d.registry.resolve(s, func(ref Reference, referenced *Schema) error {
+		if _, err := avro.ParseWithCache(referenced.Schema, "", cache); err != nil {
+			return fmt.Errorf("invalid Avro schema %s version %d: %w", ref.Subject, ref.Version, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	schema, err := avro.ParseWithCache(s.Schema, "", cache)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Avro schema %d: %w", id, err)
+	}
+	d.schemas[id] = schema
+	return schema, nil
+}
+
+// resolveUnion returns the value of a union and its schema. Named types of
+// unions are decoded as a map of their full name to the value
+func resolveUnion(value any, schema avro.Schema) (any, avro.Schema) {
+	union, ok := schema.(*avro.UnionSchema)
+	if !ok {
+		return value, schema
+	}
+	if m, ok := value.(map[string]any); ok && len(m) == 1 {
+		for _, t := range union.Types() {
+			if named, ok := t.(avro.NamedSchema); ok {
+				if v, ok := m[named.FullName()]; ok {
+					return v, t
+				}
+			}
+		}
+	}
+	return value, schema
+}
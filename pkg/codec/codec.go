@@ -0,0 +1,116 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fhir-to-server/pkg/config"
+	"fmt"
+	"strings"
+)
+
+// magicByte starts values in the Confluent wire format, followed by the schema
+// id (4 bytes, big endian)
+const magicByte = 0
+
+var ErrWireFormat = errors.New("value is not in Confluent wire format")
+
+// Deserializer extracts the FHIR payload of a message value
+type Deserializer interface {
+	Deserialize(topic string, data []byte) ([]byte, error)
+}
+
+// topicDeserializer selects the deserializer of the format configured for the
+// topic
+type topicDeserializer struct {
+	deserializers map[string]Deserializer
+	format        string
+	topics        map[string]string
+}
+
+// NewDeserializer creates a deserializer of the configured formats. It
+// returns nil, if values are raw FHIR for all topics
+func NewDeserializer(deserializer config.Deserializer) (Deserializer, error) {
+	d := &topicDeserializer{
+		deserializers: make(map[string]Deserializer),
+		format:        strings.ToLower(deserializer.Format),
+		topics:        make(map[string]string),
+	}
+	if d.format == "" {
+		d.format = "raw"
+	}
+	formats := []string{d.format}
+	for topic, format := range deserializer.Topics {
+		d.topics[topic] = strings.ToLower(format)
+		formats = append(formats, d.topics[topic])
+	}
+
+	var registry *Registry
+	for _, format := range formats {
+		if _, ok := d.deserializers[format]; ok {
+			continue
+		}
+		if format != "raw" && registry == nil {
+			if deserializer.Registry.Url == "" {
+				return nil, fmt.Errorf("format %s requires a schema registry url", format)
+			}
+			registry = NewRegistry(deserializer.Registry)
+		}
+		switch format {
+		case "raw":
+			d.deserializers[format] = nil
+		case "avro":
+			d.deserializers[format] = NewAvroDeserializer(registry, deserializer.Field)
+		case "protobuf":
+			d.deserializers[format] = NewProtobufDeserializer(registry, deserializer.Field)
+		default:
+			return nil, fmt.Errorf("unsupported value format: %s", format)
+		}
+	}
+
+	if registry == nil {
+		return nil, nil
+	}
+	return d, nil
+}
+
+func (d *topicDeserializer) Deserialize(topic string, data []byte) ([]byte, error) {
+	format, ok := d.topics[topic]
+	if !ok {
+		format = d.format
+	}
+	if deserializer := d.deserializers[format]; deserializer != nil {
+		return deserializer.Deserialize(topic, data)
+	}
+	return data, nil
+}
+
+// wireFormat returns the schema id and the encoded record of the value
+func wireFormat(data []byte) (int, []byte, error) {
+	if len(data) < 5 || data[0] != magicByte {
+		return 0, nil, ErrWireFormat
+	}
+	return int(binary.BigEndian.Uint32(data[1:5])), data[5:], nil
+}
+
+// payloadField returns the name of the field containing the payload, which
+// may be nested (e.g. data.bundle)
+func payloadField(field string) string {
+	if field == "" {
+		return "payload"
+	}
+	return field
+}
+
+// payloadBytes converts the payload field's value
+func payloadBytes(value any, field string) ([]byte, error) {
+	switch v := value.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case nil:
+		return nil, fmt.Errorf("payload field %s is missing or null", field)
+	default:
+		return nil, fmt.Errorf("payload field %s is not a string or bytes", field)
+	}
+}
@@ -0,0 +1,276 @@
+package codec
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fhir-to-server/pkg/config"
+	"github.com/bufbuild/protocompile"
+	"github.com/hamba/avro/v2"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const bundle = `{"resourceType":"Bundle","type":"batch"}`
+
+const avroSchema = `{"type":"record","name":"Envelope","namespace":"lab","fields":[
+	{"name":"source","type":"string"},
+	{"name":"payload","type":["null","string"],"default":null},
+	{"name":"data","type":["null",{"type":"record","name":"Data","fields":[{"name":"bundle","type":"bytes"}]}],"default":null}
+]}`
+
+const protoSchema = `syntax = "proto3";
+package lab;
+message Other { string name = 1; }
+message Envelope {
+  string source = 1;
+  string payload = 2;
+  message Data { bytes bundle = 1; }
+  Data data = 3;
+}`
+
+// mockRegistry serves the schemas by id and by [subject]/[version] and counts
+// requests
+func mockRegistry(t *testing.T, schemas map[int]Schema, subjects map[string]Schema) (string, *atomic.Int32) {
+	requests := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if subject, ok := strings.CutPrefix(r.URL.Path, "/subjects/"); ok {
+			schema, ok := subjects[strings.Replace(subject, "/versions/", "/", 1)]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"error_code":40401,"message":"Subject not found"}`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(schema)
+			return
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/schemas/ids/"))
+		schema, ok := schemas[id]
+		if err != nil || !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error_code":40403,"message":"Schema not found"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(schema)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, requests
+}
+
+func wire(id int, record []byte) []byte {
+	data := []byte{magicByte, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(data[1:], uint32(id))
+	return append(data, record...)
+}
+
+func TestAvroDeserializer(t *testing.T) {
+	url, requests := mockRegistry(t, map[int]Schema{1: {Schema: avroSchema}, 2: {Type: "PROTOBUF", Schema: protoSchema}}, nil)
+	schema := avro.MustParse(avroSchema)
+	record, err := avro.Marshal(schema, map[string]any{
+		"source":  "lab",
+		"payload": bundle,
+		"data":    map[string]any{"lab.Data": map[string]any{"bundle": []byte(bundle)}},
+	})
+	assert.NoError(t, err)
+	empty, err := avro.Marshal(schema, map[string]any{"source": "lab"})
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name          string
+		field         string
+		data          []byte
+		expectedError string
+	}{
+		{name: "stringField", field: "payload", data: wire(1, record)},
+		{name: "defaultField", data: wire(1, record)},
+		{name: "nestedBytesField", field: "data.bundle", data: wire(1, record)},
+		{name: "nullField", field: "payload", data: wire(1, empty), expectedError: "payload field payload is missing or null"},
+		{name: "unknownField", field: "bundle", data: wire(1, record), expectedError: "payload field bundle is missing or null"},
+		{name: "noStringField", field: "data", data: wire(1, record), expectedError: "payload field data is not a string or bytes"},
+		{name: "rawJson", data: []byte(bundle), expectedError: ErrWireFormat.Error()},
+		{name: "unknownSchema", data: wire(3, record), expectedError: "failed to get schema 3: 404 Not Found"},
+		{name: "protobufSchema", data: wire(2, record), expectedError: "schema 2 is not an Avro schema: PROTOBUF"},
+	}
+
+	registry := NewRegistry(config.Registry{Url: url})
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := NewAvroDeserializer(registry, c.field)
+
+			payload, err := d.Deserialize("lab", c.data)
+
+			if c.expectedError != "" {
+				assert.EqualError(t, err, c.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, bundle, string(payload))
+			}
+		})
+	}
+	// schemas are cached, unknown ones are requested again
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestAvroDeserializerReferences(t *testing.T) {
+	dataSchema := `{"type":"record","name":"Data","namespace":"ref","fields":[{"name":"bundle","type":"bytes"}]}`
+	envelopeSchema := `{"type":"record","name":"Envelope","namespace":"ref","fields":[{"name":"data","type":"ref.Data"}]}`
+	url, _ := mockRegistry(t,
+		map[int]Schema{1: {Schema: envelopeSchema, References: []Reference{{Name: "ref.Data", Subject: "data-value", Version: 1}}}},
+		map[string]Schema{"data-value/1": {Schema: dataSchema}})
+
+	cache := &avro.SchemaCache{}
+	_, err := avro.ParseWithCache(dataSchema, "", cache)
+	assert.NoError(t, err)
+	schema, err := avro.ParseWithCache(envelopeSchema, "", cache)
+	assert.NoError(t, err)
+	record, err := avro.Marshal(schema, map[string]any{"data": map[string]any{"bundle": []byte(bundle)}})
+	assert.NoError(t, err)
+
+	d := NewAvroDeserializer(NewRegistry(config.Registry{Url: url}), "data.bundle")
+	payload, err := d.Deserialize("lab", wire(1, record))
+
+	assert.NoError(t, err)
+	assert.Equal(t, bundle, string(payload))
+}
+
+func TestAvroDeserializerUnknownReference(t *testing.T) {
+	url, _ := mockRegistry(t, map[int]Schema{1: {Schema: `{"type":"record","name":"Envelope","fields":[{"name":"data","type":"ref.Data"}]}`,
+		References: []Reference{{Name: "ref.Data", Subject: "data-value", Version: 2}}}}, nil)
+
+	d := NewAvroDeserializer(NewRegistry(config.Registry{Url: url}), "data")
+	_, err := d.Deserialize("lab", wire(1, []byte{0}))
+
+	assert.EqualError(t, err, "failed to get schema data-value version 2: 404 Not Found")
+}
+
+func TestProtobufDeserializer(t *testing.T) {
+	url, _ := mockRegistry(t, map[int]Schema{1: {Type: "PROTOBUF", Schema: protoSchema}}, nil)
+
+	compiler := protocompile.Compiler{
+		Resolver: &protocompile.SourceResolver{
+			Accessor: protocompile.SourceAccessorFromMap(map[string]string{"schema.proto": protoSchema}),
+		},
+	}
+	files, err := compiler.Compile(context.Background(), "schema.proto")
+	assert.NoError(t, err)
+	envelope := files[0].Messages().ByName("Envelope")
+	data := envelope.Messages().ByName("Data")
+
+	msg := dynamicpb.NewMessage(envelope)
+	msg.Set(envelope.Fields().ByName("source"), protoreflect.ValueOf("lab"))
+	msg.Set(envelope.Fields().ByName("payload"), protoreflect.ValueOf(bundle))
+	nested := dynamicpb.NewMessage(data)
+	nested.Set(data.Fields().ByName("bundle"), protoreflect.ValueOf([]byte(bundle)))
+	msg.Set(envelope.Fields().ByName("data"), protoreflect.ValueOf(nested))
+	record, err := proto.Marshal(msg)
+	assert.NoError(t, err)
+
+	nestedRecord, err := proto.Marshal(nested)
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name          string
+		field         string
+		data          []byte
+		expectedError string
+	}{
+		// message indexes [1] (zigzag encoded 1, 1 -> 2, 2)
+		{name: "stringField", field: "payload", data: wire(1, append([]byte{2, 2}, record...))},
+		{name: "nestedBytesField", field: "data.bundle", data: wire(1, append([]byte{2, 2}, record...))},
+		// message indexes [1, 0]
+		{name: "nestedMessageType", field: "bundle", data: wire(1, append([]byte{4, 2, 0}, nestedRecord...))},
+		// no message indexes select Other
+		{name: "firstMessageType", field: "payload", data: wire(1, append([]byte{0}, record...)), expectedError: "payload field payload is missing or null"},
+		{name: "noStringField", field: "data", data: wire(1, append([]byte{2, 2}, record...)), expectedError: "payload field data is not a string or bytes"},
+		{name: "invalidIndex", field: "payload", data: wire(1, append([]byte{2, 10}, record...)), expectedError: "invalid message indexes of schema 1: message index 5 out of range"},
+	}
+
+	registry := NewRegistry(config.Registry{Url: url})
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := NewProtobufDeserializer(registry, c.field)
+
+			payload, err := d.Deserialize("lab", c.data)
+
+			if c.expectedError != "" {
+				assert.EqualError(t, err, c.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, bundle, string(payload))
+			}
+		})
+	}
+}
+
+func TestProtobufDeserializerReferences(t *testing.T) {
+	dataSchema := `syntax = "proto3";
+package ref;
+message Data { bytes bundle = 1; }`
+	envelopeSchema := `syntax = "proto3";
+package ref;
+import "ref/data.proto";
+message Envelope { Data data = 1; }`
+	url, _ := mockRegistry(t,
+		map[int]Schema{1: {Type: "PROTOBUF", Schema: envelopeSchema,
+			References: []Reference{{Name: "ref/data.proto", Subject: "ref/data.proto", Version: 1}}}},
+		map[string]Schema{"ref/data.proto/1": {Type: "PROTOBUF", Schema: dataSchema}})
+
+	compiler := protocompile.Compiler{
+		Resolver: &protocompile.SourceResolver{
+			Accessor: protocompile.SourceAccessorFromMap(map[string]string{"schema.proto": envelopeSchema, "ref/data.proto": dataSchema}),
+		},
+	}
+	files, err := compiler.Compile(context.Background(), "schema.proto")
+	assert.NoError(t, err)
+	envelope := files[0].Messages().ByName("Envelope")
+	data := envelope.Fields().ByName("data").Message()
+
+	msg := dynamicpb.NewMessage(envelope)
+	nested := dynamicpb.NewMessage(data)
+	nested.Set(data.Fields().ByName("bundle"), protoreflect.ValueOf([]byte(bundle)))
+	msg.Set(envelope.Fields().ByName("data"), protoreflect.ValueOf(nested))
+	record, err := proto.Marshal(msg)
+	assert.NoError(t, err)
+
+	d := NewProtobufDeserializer(NewRegistry(config.Registry{Url: url}), "data.bundle")
+	payload, err := d.Deserialize("lab", wire(1, append([]byte{0}, record...)))
+
+	assert.NoError(t, err)
+	assert.Equal(t, bundle, string(payload))
+}
+
+func TestNewDeserializer(t *testing.T) {
+	url, _ := mockRegistry(t, map[int]Schema{1: {Schema: avroSchema}}, nil)
+	record, err := avro.Marshal(avro.MustParse(avroSchema), map[string]any{"source": "lab", "payload": bundle})
+	assert.NoError(t, err)
+
+	d, err := NewDeserializer(config.Deserializer{Format: "raw"})
+	assert.NoError(t, err)
+	assert.Nil(t, d)
+
+	_, err = NewDeserializer(config.Deserializer{Topics: map[string]string{"lab": "avro"}})
+	assert.EqualError(t, err, "format avro requires a schema registry url")
+
+	_, err = NewDeserializer(config.Deserializer{Format: "json", Registry: config.Registry{Url: url}})
+	assert.EqualError(t, err, "unsupported value format: json")
+
+	d, err = NewDeserializer(config.Deserializer{Topics: map[string]string{"lab": "Avro"}, Registry: config.Registry{Url: url}})
+	assert.NoError(t, err)
+
+	payload, err := d.Deserialize("lab", wire(1, record))
+	assert.NoError(t, err)
+	assert.Equal(t, bundle, string(payload))
+
+	payload, err = d.Deserialize("other", []byte(bundle))
+	assert.NoError(t, err)
+	assert.Equal(t, bundle, string(payload))
+}
@@ -0,0 +1,159 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fhir-to-server/pkg/config"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// nonceSize is the size of the AES-GCM nonce, which prefixes encrypted values
+const nonceSize = 12
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Decoder decompresses and decrypts message values. Encodings are listed in
+// the order they were applied (e.g. "gzip, aes-gcm") and decoded in reverse
+type Decoder struct {
+	detect   bool
+	maxBytes int64
+	keys     []cipher.AEAD
+	zstd     *zstd.Decoder
+}
+
+func NewDecoder(decoding config.Decoding) (*Decoder, error) {
+	maxBytes := decoding.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = 100 << 20
+	}
+	zstdDecoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(uint64(maxBytes)))
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Decoder{detect: decoding.Detect, maxBytes: maxBytes, zstd: zstdDecoder}
+	for _, file := range decoding.KeyFiles {
+		key, err := loadKey(file)
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		d.keys = append(d.keys, aead)
+	}
+	return d, nil
+}
+
+// Decode decodes the value with the encodings of its header. Compressed values
+// without header are detected by their magic bytes, if enabled
+func (d *Decoder) Decode(data []byte, encodings string) ([]byte, error) {
+	var stages []string
+	for _, e := range strings.Split(encodings, ",") {
+		if e = strings.ToLower(strings.TrimSpace(e)); e != "" && e != "identity" {
+			stages = append(stages, e)
+		}
+	}
+	if len(stages) == 0 && d.detect {
+		switch {
+		case bytes.HasPrefix(data, gzipMagic):
+			stages = []string{"gzip"}
+		case bytes.HasPrefix(data, zstdMagic):
+			stages = []string{"zstd"}
+		}
+	}
+
+	var err error
+	for _, stage := range slices.Backward(stages) {
+		switch stage {
+		case "gzip":
+			data, err = d.gunzip(data)
+		case "zstd":
+			data, err = d.zstd.DecodeAll(data, nil)
+		case "aes-gcm":
+			data, err = d.decrypt(data)
+		default:
+			err = fmt.Errorf("unsupported encoding: %s", stage)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s value: %w", stage, err)
+		}
+	}
+	return data, nil
+}
+
+func (d *Decoder) gunzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	decoded, err := io.ReadAll(io.LimitReader(r, d.maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > d.maxBytes {
+		return nil, fmt.Errorf("decompressed value exceeds %d bytes", d.maxBytes)
+	}
+	return decoded, nil
+}
+
+// decrypt opens the value, a nonce followed by the sealed data, with the
+// first matching key
+func (d *Decoder) decrypt(data []byte) ([]byte, error) {
+	if len(d.keys) == 0 {
+		return nil, errors.New("no decryption keys configured")
+	}
+	if len(data) < nonceSize {
+		return nil, errors.New("value too short")
+	}
+	for _, key := range d.keys {
+		if plain, err := key.Open(nil, data[:nonceSize], data[nonceSize:], nil); err == nil {
+			return plain, nil
+		}
+	}
+	return nil, errors.New("message authentication failed")
+}
+
+// loadKey reads an AES key (16, 24 or 32 bytes), which is hex or base64
+// encoded or raw
+func loadKey(file string) ([]byte, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimSpace(string(content))
+
+	candidates := [][]byte{content}
+	if key, err := hex.DecodeString(text); err == nil {
+		candidates = append([][]byte{key}, candidates...)
+	} else if key, err := base64.StdEncoding.DecodeString(text); err == nil {
+		candidates = append([][]byte{key}, candidates...)
+	}
+	for _, key := range candidates {
+		switch len(key) {
+		case 16, 24, 32:
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid AES key in %s: expected 16, 24 or 32 bytes", file)
+}
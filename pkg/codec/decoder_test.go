@@ -0,0 +1,104 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"fhir-to-server/pkg/config"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func zstdCompressed(t *testing.T, data []byte) []byte {
+	w, err := zstd.NewWriter(nil)
+	assert.NoError(t, err)
+	return w.EncodeAll(data, nil)
+}
+
+func encrypted(t *testing.T, key, data []byte) []byte {
+	block, err := aes.NewCipher(key)
+	assert.NoError(t, err)
+	aead, err := cipher.NewGCM(block)
+	assert.NoError(t, err)
+	nonce := bytes.Repeat([]byte{7}, nonceSize)
+	return aead.Seal(nonce, nonce, data, nil)
+}
+
+func TestDecoder(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{1}, 32)
+	otherKey := bytes.Repeat([]byte{2}, 16)
+	keyFile := filepath.Join(dir, "key.hex")
+	otherKeyFile := filepath.Join(dir, "other.b64")
+	assert.NoError(t, os.WriteFile(keyFile, []byte(hex.EncodeToString(key)+"\n"), 0600))
+	assert.NoError(t, os.WriteFile(otherKeyFile, []byte(base64.StdEncoding.EncodeToString(otherKey)), 0600))
+
+	data := []byte(bundle)
+	cases := []struct {
+		name          string
+		value         []byte
+		encodings     string
+		detect        bool
+		expectedError string
+	}{
+		{name: "identity", value: data, encodings: "identity"},
+		{name: "gzipHeader", value: gzipped(t, data), encodings: "gzip"},
+		{name: "zstdHeader", value: zstdCompressed(t, data), encodings: "ZSTD"},
+		{name: "gzipDetected", value: gzipped(t, data), detect: true},
+		{name: "zstdDetected", value: zstdCompressed(t, data), detect: true},
+		{name: "notDetected", value: data, detect: true},
+		{name: "aesGcm", value: encrypted(t, key, data), encodings: "aes-gcm"},
+		{name: "aesGcmSecondKey", value: encrypted(t, otherKey, data), encodings: "aes-gcm"},
+		{name: "compressedAndEncrypted", value: encrypted(t, key, gzipped(t, data)), encodings: "gzip, aes-gcm"},
+		{name: "unknownKey", value: encrypted(t, bytes.Repeat([]byte{3}, 32), data), encodings: "aes-gcm", expectedError: "failed to decode aes-gcm value: message authentication failed"},
+		{name: "invalidGzip", value: data, encodings: "gzip", expectedError: "failed to decode gzip value: gzip: invalid header"},
+		{name: "tooLarge", value: gzipped(t, bytes.Repeat(data, 100)), encodings: "gzip", expectedError: "failed to decode gzip value: decompressed value exceeds 1024 bytes"},
+		{name: "unknownEncoding", value: data, encodings: "br", expectedError: "failed to decode br value: unsupported encoding: br"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d, err := NewDecoder(config.Decoding{Detect: c.detect, KeyFiles: []string{keyFile, otherKeyFile}, MaxBytes: 1024})
+			assert.NoError(t, err)
+
+			decoded, err := d.Decode(c.value, c.encodings)
+
+			if c.expectedError != "" {
+				assert.EqualError(t, err, c.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, bundle, string(decoded))
+			}
+		})
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "raw")
+	invalid := filepath.Join(dir, "invalid")
+	assert.NoError(t, os.WriteFile(raw, bytes.Repeat([]byte{' '}, 24), 0600))
+	assert.NoError(t, os.WriteFile(invalid, []byte("secret"), 0600))
+
+	key, err := loadKey(raw)
+	assert.NoError(t, err)
+	assert.Len(t, key, 24)
+
+	_, err = loadKey(invalid)
+	assert.EqualError(t, err, "invalid AES key in "+invalid+": expected 16, 24 or 32 bytes")
+}
@@ -0,0 +1,142 @@
+package codec
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"strings"
+	"sync"
+)
+
+// ProtobufDeserializer decodes Protobuf messages in the Confluent wire format
+// and returns the payload field. Schemas are compiled from their .proto source
+type ProtobufDeserializer struct {
+	registry *Registry
+	field    string
+	mu       sync.Mutex
+	files    map[int]protoreflect.FileDescriptor
+}
+
+func NewProtobufDeserializer(registry *Registry, field string) *ProtobufDeserializer {
+	return &ProtobufDeserializer{registry: registry, field: payloadField(field), files: make(map[int]protoreflect.FileDescriptor)}
+}
+
+func (d *ProtobufDeserializer) Deserialize(_ string, data []byte) ([]byte, error) {
+	id, record, err := wireFormat(data)
+	if err != nil {
+		return nil, err
+	}
+	file, err := d.file(id)
+	if err != nil {
+		return nil, err
+	}
+	descriptor, record, err := messageDescriptor(file, record)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message indexes of schema %d: %w", id, err)
+	}
+
+	msg := dynamicpb.NewMessage(descriptor)
+	if err = proto.Unmarshal(record, msg); err != nil {
+		return nil, fmt.Errorf("failed to decode Protobuf message with schema %d: %w", id, err)
+	}
+
+	var current protoreflect.Message = msg
+	path := strings.Split(d.field, ".")
+	for i, name := range path {
+		field := current.Descriptor().Fields().ByName(protoreflect.Name(name))
+		if field == nil || field.IsList() || field.IsMap() || !current.Has(field) {
+			return nil, fmt.Errorf("payload field %s is missing or null", d.field)
+		}
+		value := current.Get(field)
+		if i < len(path)-1 {
+			if field.Kind() != protoreflect.MessageKind {
+				return nil, fmt.Errorf("payload field %s is missing or null", d.field)
+			}
+			current = value.Message()
+			continue
+		}
+
+		switch field.Kind() {
+		case protoreflect.StringKind:
+			return []byte(value.String()), nil
+		case protoreflect.BytesKind:
+			return value.Bytes(), nil
+		}
+	}
+	return nil, fmt.Errorf("payload field %s is not a string or bytes", d.field)
+}
+
+func (d *ProtobufDeserializer) file(id int) (protoreflect.FileDescriptor, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if file, ok := d.files[id]; ok {
+		return file, nil
+	}
+	s, err := d.registry.Schema(id)
+	if err != nil {
+		return nil, err
+	}
+	if s.Type != "PROTOBUF" {
+		return nil, fmt.Errorf("schema %d is not a Protobuf schema: %s", id, s.Type)
+	}
+
+	// referenced schemas are imported by their name
+	sources := map[string]string{"schema.proto": s.Schema}
+	err = d.registry.resolve(s, func(ref Reference, referenced *Schema) error {
+		sources[ref.Name] = referenced.Schema
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			Accessor: protocompile.SourceAccessorFromMap(sources),
+		}),
+	}
+	files, err := compiler.Compile(context.Background(), "schema.proto")
+	if err != nil {
+		return nil, fmt.Errorf("invalid Protobuf schema %d: %w", id, err)
+	}
+	d.files[id] = files[0]
+	return files[0], nil
+}
+
+// messageDescriptor reads the message indexes, which select the (nested)
+// message type of the schema, and returns the type and the encoded message.
+// No indexes select the first message type
+func messageDescriptor(file protoreflect.FileDescriptor, data []byte) (protoreflect.MessageDescriptor, []byte, error) {
+	count, n := binary.Varint(data)
+	if n <= 0 || count < 0 {
+		return nil, nil, fmt.Errorf("invalid message index count")
+	}
+	data = data[n:]
+
+	indexes := []int64{0}
+	if count > 0 {
+		indexes = make([]int64, count)
+		for i := range indexes {
+			if indexes[i], n = binary.Varint(data); n <= 0 {
+				return nil, nil, fmt.Errorf("invalid message index")
+			}
+			data = data[n:]
+		}
+	}
+
+	messages := file.Messages()
+	var descriptor protoreflect.MessageDescriptor
+	for _, index := range indexes {
+		if index < 0 || int(index) >= messages.Len() {
+			return nil, nil, fmt.Errorf("message index %d out of range", index)
+		}
+		descriptor = messages.Get(int(index))
+		messages = descriptor.Messages()
+	}
+	return descriptor, data, nil
+}
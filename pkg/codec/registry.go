@@ -0,0 +1,137 @@
+package codec
+
+import (
+	"encoding/json"
+	"fhir-to-server/pkg/config"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Schema is a schema of the registry
+type Schema struct {
+	Id int `json:"-"`
+	// Type is AVRO (default), PROTOBUF or JSON
+	Type       string      `json:"schemaType"`
+	Schema     string      `json:"schema"`
+	References []Reference `json:"references"`
+}
+
+// Reference is a schema registered under a subject, which is referenced by its
+// name, i.e. the full name of an Avro type or the path of a Protobuf import
+type Reference struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+}
+
+// Registry looks up schemas by id in a Confluent Schema Registry. Schemas are
+// immutable and cached
+type Registry struct {
+	rest    *resty.Client
+	url     string
+	mu      sync.Mutex
+	schemas map[int]*Schema
+	// referenced schemas by subject and version
+	referenced map[Reference]*Schema
+}
+
+func NewRegistry(registry config.Registry) *Registry {
+	client := resty.New().
+		SetLogger(config.DefaultLogger()).
+		SetHeader("Accept", "application/vnd.schemaregistry.v1+json, application/json")
+
+	if registry.Auth != nil && registry.Auth.User != "" {
+		client = client.SetBasicAuth(registry.Auth.User, registry.Auth.Password)
+	}
+
+	return &Registry{rest: client, url: strings.TrimSuffix(registry.Url, "/"), schemas: make(map[int]*Schema),
+		referenced: make(map[Reference]*Schema)}
+}
+
+// Schema returns the schema with the given id
+func (r *Registry) Schema(id int) (*Schema, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if schema, ok := r.schemas[id]; ok {
+		return schema, nil
+	}
+
+	resp, err := r.rest.R().Get(fmt.Sprintf("%s/schemas/ids/%d", r.url, id))
+	if err != nil {
+		return nil, err
+	}
+	if !resp.IsSuccess() {
+		return nil, fmt.Errorf("failed to get schema %d: %s", id, resp.Status())
+	}
+
+	schema := &Schema{Id: id}
+	if err = json.Unmarshal(resp.Body(), schema); err != nil {
+		return nil, err
+	}
+	if schema.Type == "" {
+		schema.Type = "AVRO"
+	}
+	r.schemas[id] = schema
+	return schema, nil
+}
+
+// Referenced returns the schema of the reference's subject version
+func (r *Registry) Referenced(ref Reference) (*Schema, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if schema, ok := r.referenced[ref]; ok {
+		return schema, nil
+	}
+
+	resp, err := r.rest.R().Get(fmt.Sprintf("%s/subjects/%s/versions/%d", r.url, url.PathEscape(ref.Subject), ref.Version))
+	if err != nil {
+		return nil, err
+	}
+	if !resp.IsSuccess() {
+		return nil, fmt.Errorf("failed to get schema %s version %d: %s", ref.Subject, ref.Version, resp.Status())
+	}
+
+	schema := &Schema{}
+	if err = json.Unmarshal(resp.Body(), schema); err != nil {
+		return nil, err
+	}
+	if schema.Type == "" {
+		schema.Type = "AVRO"
+	}
+	r.referenced[ref] = schema
+	return schema, nil
+}
+
+// resolve calls visit for the schemas referenced by the schema, including
+// their references. Referenced schemas are visited once and before the schemas
+// referencing them
+func (r *Registry) resolve(s *Schema, visit func(ref Reference, referenced *Schema) error) error {
+	visited := make(map[Reference]bool)
+	var walk func(s *Schema) error
+	walk = func(s *Schema) error {
+		for _, ref := range s.References {
+			if visited[ref] {
+				continue
+			}
+			visited[ref] = true
+
+			referenced, err := r.Referenced(ref)
+			if err != nil {
+				return err
+			}
+			if err = walk(referenced); err != nil {
+				return err
+			}
+			if err = visit(ref, referenced); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(s)
+}
@@ -12,12 +12,20 @@ type AppConfig struct {
 	App   App   `mapstructure:"app"`
 	Kafka Kafka `mapstructure:"kafka"`
 	Fhir  Fhir  `mapstructure:"fhir"`
+	Bulk  Bulk  `mapstructure:"bulk"`
+	Http  Http  `mapstructure:"http"`
 }
 
 type App struct {
-	Name     string `mapstructure:"name"`
-	LogLevel string `mapstructure:"log-level"`
-	Env      string `mapstructure:"env"`
+	Name     string  `mapstructure:"name"`
+	LogLevel string  `mapstructure:"log-level"`
+	Env      string  `mapstructure:"env"`
+	Metrics  Metrics `mapstructure:"metrics"`
+}
+
+type Metrics struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Address string `mapstructure:"address"`
 }
 
 type Kafka struct {
@@ -25,6 +33,18 @@ type Kafka struct {
 	InputTopics      []string `mapstructure:"input-topics"`
 	SecurityProtocol string   `mapstructure:"security-protocol"`
 	Ssl              Ssl      `mapstructure:"ssl"`
+	Sasl             Sasl     `mapstructure:"sasl"`
+	// DeadLetterTopic receives messages which cannot be loaded
+	DeadLetterTopic string `mapstructure:"dead-letter-topic"`
+	// Client selects the Kafka client: "confluent" (librdkafka) or "franz" (pure Go)
+	Client string `mapstructure:"client"`
+}
+
+type Sasl struct {
+	// Mechanism is one of PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512
+	Mechanism string `mapstructure:"mechanism"`
+	Username  string `mapstructure:"username"`
+	Password  string `mapstructure:"password"`
 }
 
 type Ssl struct {
@@ -50,10 +70,246 @@ type Filter struct {
 	Date DateConfig `mapstructure:"date"`
 }
 
+type Batch struct {
+	Enabled    bool          `mapstructure:"enabled"`
+	MaxEntries int           `mapstructure:"max-entries"`
+	MaxBytes   int           `mapstructure:"max-bytes"`
+	MaxWait    time.Duration `mapstructure:"max-wait"`
+}
+
+// Headers configures the names of Kafka message headers and their effects
+type Headers struct {
+	// ContentType selects the payload format (FHIR JSON or XML)
+	ContentType string `mapstructure:"content-type"`
+	// Target selects one of the configured target servers
+	Target string `mapstructure:"target"`
+	// Operation selects the operation on the payload's resources (e.g. delete)
+	Operation string `mapstructure:"operation"`
+	// ContentEncoding lists the encodings of the value (e.g. gzip, zstd or aes-gcm)
+	ContentEncoding string `mapstructure:"content-encoding"`
+	// Propagate lists headers which are propagated to the FHIR server (e.g. trace context)
+	Propagate []string `mapstructure:"propagate"`
+}
+
+type Tombstone struct {
+	// Mode is one of "ignore" or "delete"
+	Mode       string `mapstructure:"mode"`
+	KeyPattern string `mapstructure:"key-pattern"`
+	// ResourceType is used, if the key pattern has no "type" group
+	ResourceType string `mapstructure:"resource-type"`
+	// OnError is one of "fail" or "skip"
+	OnError string `mapstructure:"on-error"`
+}
+
+type Dedup struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Path    string `mapstructure:"path"`
+	// Scope is one of "key" (message key) or "entry" (entry fullUrl)
+	Scope           string        `mapstructure:"scope"`
+	Ttl             time.Duration `mapstructure:"ttl"`
+	CompactInterval time.Duration `mapstructure:"compact-interval"`
+}
+
+type Pseudonymization struct {
+	Enabled bool `mapstructure:"enabled"`
+	// KeyFile or KeyEnv (name of an environment variable) provide the HMAC key
+	KeyFile           string   `mapstructure:"key-file"`
+	KeyEnv            string   `mapstructure:"key-env"`
+	IdentifierSystems []string `mapstructure:"identifier-systems"`
+	// IdTypes are resource types whose ids are pseudonymized
+	IdTypes []string `mapstructure:"id-types"`
+	// Name, Address and Telecom are one of "keep", "remove" or "generalize"
+	Name    string `mapstructure:"name"`
+	Address string `mapstructure:"address"`
+	Telecom string `mapstructure:"telecom"`
+	// DateShift is the maximum number of days dates are shifted
+	DateShift int `mapstructure:"date-shift"`
+}
+
+type Meta struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Source sets meta.source to the Kafka origin (kafka://topic/partition/offset)
+	Source    bool   `mapstructure:"source"`
+	TagSystem string `mapstructure:"tag-system"`
+	// Tags are one or more of "loader", "topic" and "load-date"
+	Tags     []string `mapstructure:"tags"`
+	Profiles []string `mapstructure:"profiles"`
+}
+
+type Provenance struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Mode is one of "append" (entry in the outgoing bundle) or "separate" (after success)
+	Mode         string `mapstructure:"mode"`
+	EntitySystem string `mapstructure:"entity-system"`
+}
+
+type ConceptMap struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Path is a directory of ConceptMap JSON files
+	Path string `mapstructure:"path"`
+	// Elements are the CodeableConcept elements to map, e.g. Observation.code
+	Elements []string `mapstructure:"elements"`
+	// Mode is one of "replace" or "add" (keeps the source coding)
+	Mode string `mapstructure:"mode"`
+	// Unmapped is one of "keep", "drop" (entry) or "dlq"
+	Unmapped string `mapstructure:"unmapped"`
+}
+
+type Validation struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Policy is one of "fail", "warn" or "drop-entry"
+	Policy string `mapstructure:"policy"`
+	// Topics overrides the policy by topic
+	Topics map[string]string `mapstructure:"topics"`
+	// Profiles is a directory of StructureDefinitions, e.g. an extracted FHIR package
+	Profiles string `mapstructure:"profiles"`
+}
+
+type DryRun struct {
+	Enabled bool `mapstructure:"enabled"`
+	// GroupId is the consumer group of the dry run, defaults to [app.name]-dry-run
+	GroupId        string        `mapstructure:"group-id"`
+	ReportInterval time.Duration `mapstructure:"report-interval"`
+}
+
+type References struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Policy is one of "reorder", "hold" or "reject"
+	Policy string `mapstructure:"policy"`
+	// Lookup checks references, which are not resolved in the bundle, on the server
+	Lookup    bool          `mapstructure:"lookup"`
+	CacheTtl  time.Duration `mapstructure:"cache-ttl"`
+	CacheSize int           `mapstructure:"cache-size"`
+	// HoldWait and HoldRetries define how long messages with dangling references are held back
+	HoldWait    time.Duration `mapstructure:"hold-wait"`
+	HoldRetries int           `mapstructure:"hold-retries"`
+}
+
+type Dependencies struct {
+	// Topics maps topics to the topics they depend on
+	Topics map[string][]string `mapstructure:"topics"`
+	// MaxWait is the maximum time a message is parked, before the reference policy applies
+	MaxWait time.Duration `mapstructure:"max-wait"`
+	// MaxParked is the maximum number of parked messages per topic
+	MaxParked int `mapstructure:"max-parked"`
+}
+
+// Compression configures gzip compression of request bodies to the FHIR server
+type Compression struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MinBytes is the minimum size of compressed bodies
+	MinBytes int `mapstructure:"min-bytes"`
+}
+
+// Decoding configures stages which decompress and decrypt message values
+type Decoding struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Detect decompresses gzip and zstd values without encoding header by their magic bytes
+	Detect bool `mapstructure:"detect"`
+	// KeyFiles contain AES keys (hex, base64 or raw) for aes-gcm values, which are tried in order
+	KeyFiles []string `mapstructure:"key-files"`
+	// MaxBytes limits the size of decompressed values
+	MaxBytes int64 `mapstructure:"max-bytes"`
+}
+
+// Deserializer configures how message values are decoded before they are parsed
+type Deserializer struct {
+	// Format is one of "raw" (FHIR), "avro" or "protobuf" (Confluent wire format)
+	Format string `mapstructure:"format"`
+	// Topics overrides the format by topic
+	Topics map[string]string `mapstructure:"topics"`
+	// Field is the record field containing the FHIR payload, nested fields are separated by dots
+	Field    string   `mapstructure:"field"`
+	Registry Registry `mapstructure:"registry"`
+}
+
+// Registry is a Confluent Schema Registry
+type Registry struct {
+	Url  string `mapstructure:"url"`
+	Auth *Auth  `mapstructure:"auth"`
+}
+
+type PatchRule struct {
+	ResourceType string `mapstructure:"resource-type"`
+	// Where is a FHIRPath predicate (subset) selecting resources
+	Where      string           `mapstructure:"where"`
+	Operations []PatchOperation `mapstructure:"operations"`
+}
+
+type PatchOperation struct {
+	// Op is one of "set", "remove", "rename" or "replace-coding"
+	Op   string `mapstructure:"op"`
+	Path string `mapstructure:"path"`
+	// Value is JSON (e.g. {"text": "lab"}, 1 or true) or a plain string. It is read as string, because
+	// keys of nested configuration maps are lower cased
+	Value string `mapstructure:"value"`
+	// To is the new name of a renamed element
+	To string `mapstructure:"to"`
+	// System and Code match codings to replace by NewSystem and NewCode
+	System    string `mapstructure:"system"`
+	Code      string `mapstructure:"code"`
+	NewSystem string `mapstructure:"new-system"`
+	NewCode   string `mapstructure:"new-code"`
+}
+
 type Fhir struct {
-	Server Server `mapstructure:"server"`
-	Retry  Retry  `mapstructure:"retry"`
-	Filter Filter `mapstructure:"filter"`
+	Server           Server            `mapstructure:"server"`
+	Targets          map[string]Server `mapstructure:"targets"`
+	Headers          Headers           `mapstructure:"headers"`
+	Retry            Retry             `mapstructure:"retry"`
+	Compression      Compression       `mapstructure:"compression"`
+	Filter           Filter            `mapstructure:"filter"`
+	Batch            Batch             `mapstructure:"batch"`
+	Tombstone        Tombstone         `mapstructure:"tombstone"`
+	Dedup            Dedup             `mapstructure:"dedup"`
+	Pseudonymization Pseudonymization  `mapstructure:"pseudonymization"`
+	Meta             Meta              `mapstructure:"meta"`
+	Provenance       Provenance        `mapstructure:"provenance"`
+	Transformations  []PatchRule       `mapstructure:"transformations"`
+	ConceptMap       ConceptMap        `mapstructure:"concept-map"`
+	Validation       Validation        `mapstructure:"validation"`
+	DryRun           DryRun            `mapstructure:"dry-run"`
+	References       References        `mapstructure:"references"`
+	Dependencies     Dependencies      `mapstructure:"dependencies"`
+	Deserializer     Deserializer      `mapstructure:"deserializer"`
+	Decoding         Decoding          `mapstructure:"decoding"`
+	// AppName is set from app.name
+	AppName string `mapstructure:"-"`
+	// ResourceMode defines how single resources are sent: "batch" or "rest"
+	ResourceMode string `mapstructure:"resource-mode"`
+	// Prefer sets the return preference of requests: "minimal", "representation" or "OperationOutcome"
+	Prefer string `mapstructure:"prefer"`
+}
+
+// Bulk configures the import of Bulk Data exports
+type Bulk struct {
+	// BatchSize is the number of resources per batch bundle
+	BatchSize int `mapstructure:"batch-size"`
+	// StateFile records the progress to resume an import
+	StateFile    string        `mapstructure:"state-file"`
+	PollInterval time.Duration `mapstructure:"poll-interval"`
+	// Auth and Token authenticate requests to the exporting server
+	Auth  *Auth  `mapstructure:"auth"`
+	Token string `mapstructure:"token"`
+}
+
+// Http configures the HTTP endpoint to submit bundles
+type Http struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Address string `mapstructure:"address"`
+	// Mode "sync" sends bundles to the FHIR server, "buffered" produces them to Topic
+	Mode     string `mapstructure:"mode"`
+	Topic    string `mapstructure:"topic"`
+	MaxBytes int64  `mapstructure:"max-bytes"`
+	Auth     *Auth  `mapstructure:"auth"`
+	Tls      Tls    `mapstructure:"tls"`
+}
+
+// Tls enables HTTPS and, with a client CA, client certificate authentication
+type Tls struct {
+	CertificateLocation string `mapstructure:"certificate-location"`
+	KeyLocation         string `mapstructure:"key-location"`
+	ClientCaLocation    string `mapstructure:"client-ca-location"`
 }
 
 type Server struct {
@@ -88,6 +344,7 @@ func LoadConfig(path string) (config AppConfig, err error) {
 	}
 
 	err = viper.Unmarshal(&config, decoderOpts)
+	config.Fhir.AppName = config.App.Name
 	return
 }
 
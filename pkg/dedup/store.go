@@ -0,0 +1,190 @@
+package dedup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fhir-to-server/pkg/config"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var bucket = []byte("hashes")
+
+// Store records content hashes by key in an embedded key/value file. Records
+// expire after the configured time to live
+type Store struct {
+	db   *bolt.DB
+	ttl  time.Duration
+	done chan struct{}
+}
+
+// Record is a content hash by key, which is stored after successful processing
+type Record struct {
+	Key  string
+	Hash []byte
+}
+
+func Open(config config.Dedup) (*Store, error) {
+	db, err := bolt.Open(config.Path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	s := &Store{db: db, ttl: config.Ttl, done: make(chan struct{})}
+	s.compact()
+	if config.CompactInterval > 0 {
+		go s.compactEvery(config.CompactInterval)
+	}
+
+	return s, nil
+}
+
+func (s *Store) compactEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.compact()
+		}
+	}
+}
+
+func (s *Store) compact() {
+	removed, err := s.Compact()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to compact deduplication store")
+		return
+	}
+	log.Debug().Int("removed", removed).Msg("Deduplication store compacted")
+}
+
+// Hash computes the content hash of the given parts
+func Hash(parts ...[]byte) []byte {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+		h.Write([]byte{0})
+	}
+	return h.Sum(nil)
+}
+
+// Unchanged checks if the hash stored for the key equals the given hash and
+// is not expired
+func (s *Store) Unchanged(key string, hash []byte) bool {
+	unchanged := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(bucket).Get([]byte(key))
+		stored, ok := s.decode(value)
+		unchanged = ok && bytes.Equal(stored, hash)
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read from deduplication store")
+	}
+	return unchanged
+}
+
+// Put stores the records with the current time
+func (s *Store) Put(records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	now := make([]byte, 8)
+	binary.BigEndian.PutUint64(now, uint64(time.Now().Unix()))
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		for _, r := range records {
+			if err := b.Put([]byte(r.Key), append(bytes.Clone(now), r.Hash...)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete removes the record with the given key
+func (s *Store) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+}
+
+// Compact removes expired records and returns their number
+func (s *Store) Compact() (int, error) {
+	if s.ttl <= 0 {
+		return 0, nil
+	}
+
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+
+		// collect expired keys first, deleting while iterating skips keys
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			if _, ok := s.decode(v); !ok {
+				expired = append(expired, bytes.Clone(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err = b.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(expired)
+		return nil
+	})
+	return removed, err
+}
+
+// Clear removes all records
+func (s *Store) Clear() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(bucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(bucket)
+		return err
+	})
+}
+
+func (s *Store) Close() error {
+	close(s.done)
+	return s.db.Close()
+}
+
+// decode returns the hash of a stored value and false, if the value is missing
+// or expired
+func (s *Store) decode(value []byte) ([]byte, bool) {
+	if len(value) < 8 {
+		return nil, false
+	}
+
+	stored := time.Unix(int64(binary.BigEndian.Uint64(value[:8])), 0)
+	if s.ttl > 0 && time.Since(stored) > s.ttl {
+		return nil, false
+	}
+	return value[8:], true
+}
@@ -0,0 +1,59 @@
+package dedup
+
+import (
+	"fhir-to-server/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, ttl time.Duration) *Store {
+	s, err := Open(config.Dedup{Path: filepath.Join(t.TempDir(), "dedup.db"), Ttl: ttl})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func TestUnchanged(t *testing.T) {
+	s := openTestStore(t, time.Hour)
+	hash := Hash([]byte("content"))
+
+	assert.False(t, s.Unchanged("key", hash))
+
+	err := s.Put([]Record{{Key: "key", Hash: hash}})
+	assert.NoError(t, err)
+
+	assert.True(t, s.Unchanged("key", hash))
+	assert.False(t, s.Unchanged("key", Hash([]byte("changed"))))
+	assert.False(t, s.Unchanged("other", hash))
+
+	assert.NoError(t, s.Delete("key"))
+	assert.False(t, s.Unchanged("key", hash))
+}
+
+func TestCompact(t *testing.T) {
+	s := openTestStore(t, time.Nanosecond)
+	hash := Hash([]byte("content"))
+
+	_ = s.Put([]Record{{Key: "a", Hash: hash}, {Key: "b", Hash: hash}, {Key: "c", Hash: hash}})
+	time.Sleep(time.Second)
+
+	// expired
+	assert.False(t, s.Unchanged("a", hash))
+
+	removed, err := s.Compact()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, removed)
+}
+
+func TestClear(t *testing.T) {
+	s := openTestStore(t, 0)
+	hash := Hash([]byte("content"))
+	_ = s.Put([]Record{{Key: "key", Hash: hash}})
+
+	err := s.Clear()
+
+	assert.NoError(t, err)
+	assert.False(t, s.Unchanged("key", hash))
+}
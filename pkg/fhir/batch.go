@@ -0,0 +1,266 @@
+package fhir
+
+import (
+	"errors"
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"github.com/rs/zerolog/log"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"strings"
+	"time"
+)
+
+// Batch aggregates the bundle entries of consecutive messages from the same
+// topic partition and sends them as a single batch bundle
+type Batch struct {
+	processor *Processor
+	config    config.Batch
+	messages  []*source.Message
+	infos     []MessageInfo
+	payloads  []*Payload
+	// number of entries per message
+	counts  []int
+	entries []models.BundleEntry
+	// request urls and full urls of the entries
+	targets map[string]bool
+	size    int
+	started time.Time
+}
+
+func (p *Processor) NewBatch() *Batch {
+	return &Batch{processor: p, config: p.batch}
+}
+
+// Accepts checks if the message can be added to the batch, i.e. the batch is
+// empty or the message is from the same topic partition and has the same
+// target server
+func (b *Batch) Accepts(msg *source.Message) bool {
+	if len(b.messages) == 0 {
+		return true
+	}
+	current := b.infos[0]
+	info := NewMessageInfo(msg)
+
+	return current.Topic == info.Topic && current.Partition == info.Partition &&
+		strings.EqualFold(current.Header(b.processor.headers.Target), info.Header(b.processor.headers.Target))
+}
+
+// Add appends the entries of the message's bundle to the batch. XML payloads,
+// transaction bundles (atomic, with references between their entries),
+// tombstones and dead letters cannot be merged: the batch is flushed and the
+// message is processed on its own right away. The batch is flushed as well
+// before an entry targets a resource of the batch again. It returns the last
+// message up to which all messages were processed (or nil) and whether the
+// processing was successful
+func (b *Batch) Add(msg *source.Message) (*source.Message, bool) {
+	info := NewMessageInfo(msg)
+
+	if len(msg.Value) == 0 && b.processor.tombstone != nil {
+		return b.single(msg, info, nil, func() error { return b.processor.handleTombstone(info) })
+	}
+
+	payload, err := b.processor.prepare(msg, info)
+	var dlErr *DeadLetterError
+	if errors.As(err, &dlErr) && b.processor.deadLetters != nil {
+		return b.single(msg, info, nil, func() error { return b.processor.deadLetter(msg, info, err) })
+	}
+	if err != nil {
+		return b.single(msg, info, nil, func() error { return err })
+	}
+	if payload != nil && (payload.IsXml() || payload.Bundle.Type != models.BundleTypeBatch) {
+		return b.single(msg, info, payload, func() error { return b.processor.send(payload, info) })
+	}
+
+	var last *source.Message
+	if payload != nil && b.targetsAny(payload.Bundle.Entry) {
+		var success bool
+		if last, success = b.Flush(); !success {
+			return last, false
+		}
+	}
+
+	if len(b.messages) == 0 {
+		b.started = time.Now()
+		b.targets = make(map[string]bool)
+	}
+	b.messages = append(b.messages, msg)
+	b.infos = append(b.infos, info)
+	b.payloads = append(b.payloads, payload)
+	if payload == nil {
+		// skipped, no entries to send
+		b.counts = append(b.counts, 0)
+		return last, true
+	}
+
+	b.counts = append(b.counts, len(payload.Bundle.Entry))
+	b.entries = append(b.entries, payload.Bundle.Entry...)
+	for _, e := range payload.Bundle.Entry {
+		for _, t := range entryTargets(e) {
+			b.targets[t] = true
+		}
+	}
+	b.size += len(msg.Value)
+	return last, true
+}
+
+// single flushes the batch and processes a message which cannot be merged
+func (b *Batch) single(msg *source.Message, info MessageInfo, payload *Payload, process func() error) (*source.Message, bool) {
+	last, success := b.Flush()
+	if !success {
+		return last, false
+	}
+
+	if err := process(); err != nil {
+		b.failed(msg, info, err)
+		return last, false
+	}
+	if payload != nil {
+		b.processor.commit(payload, info)
+	}
+	succeeded(info)
+	return msg, true
+}
+
+// targetsAny checks if one of the entries targets a resource of the batch
+func (b *Batch) targetsAny(entries []models.BundleEntry) bool {
+	for _, e := range entries {
+		for _, t := range entryTargets(e) {
+			if b.targets[t] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// entryTargets returns the request url and the full url of the entry
+func entryTargets(e models.BundleEntry) []string {
+	var targets []string
+	if e.Request != nil && e.Request.Url != "" {
+		targets = append(targets, e.Request.Url)
+	}
+	if e.FullUrl != nil && *e.FullUrl != "" {
+		targets = append(targets, *e.FullUrl)
+	}
+	return targets
+}
+
+// Full checks if the batch reached one of its configured size limits
+func (b *Batch) Full() bool {
+	return (b.config.MaxEntries > 0 && len(b.entries) >= b.config.MaxEntries) ||
+		(b.config.MaxBytes > 0 && b.size >= b.config.MaxBytes)
+}
+
+// Due checks if the batch is not empty and its maximum wait time has passed
+func (b *Batch) Due() bool {
+	return len(b.messages) > 0 && time.Since(b.started) >= b.config.MaxWait
+}
+
+// Flush sends the batch bundle and resets the batch. It returns the last
+// message up to which all messages were processed successfully (or nil) and
+// whether all messages of the batch were successful
+func (b *Batch) Flush() (*source.Message, bool) {
+	if len(b.messages) == 0 {
+		return nil, true
+	}
+	defer b.reset()
+
+	results := make([]bool, len(b.entries))
+	locations := make([]string, len(b.entries))
+	if len(b.entries) > 0 {
+		results, locations = b.send()
+	}
+
+	// map entry results back to their messages
+	var last *source.Message
+	offset := 0
+	for i, msg := range b.messages {
+		info := b.infos[i]
+		count := b.counts[i]
+		var err error
+		for j := 0; j < count && err == nil; j++ {
+			if !results[offset+j] {
+				err = errors.New("failed to process message in batch")
+			}
+		}
+		if err == nil && count > 0 {
+			err = b.processor.sendProvenance(b.client(), locations[offset:offset+count], info)
+		}
+		offset += count
+
+		if err != nil {
+			b.failed(msg, info, err)
+			return last, false
+		}
+		if payload := b.payloads[i]; payload != nil {
+			b.processor.commit(payload, info)
+		}
+		succeeded(info)
+		last = msg
+	}
+
+	return last, true
+}
+
+func (b *Batch) failed(msg *source.Message, info MessageInfo, err error) {
+	log.Error().Err(err).
+		Str("topic", info.Topic).
+		Str("key", info.Key).
+		Int64("offset", info.Offset).
+		Msg("Failed to process message")
+	msg.Nack(err)
+}
+
+func succeeded(info MessageInfo) {
+	log.Debug().
+		Str("topic", info.Topic).
+		Str("key", info.Key).
+		Int64("offset", info.Offset).
+		Msg("Successfully processed message")
+}
+
+// client returns the client of the target server of the batch's messages
+func (b *Batch) client() *Client {
+	client, err := b.processor.target(b.infos[0])
+	if err != nil {
+		log.Error().Err(err).
+			Str("topic", b.infos[0].Topic).
+			Str("key", b.infos[0].Key).
+			Int64("offset", b.infos[0].Offset).
+			Msg("Failed to determine target server of batch")
+	}
+	return client
+}
+
+// send sends the batch bundle to the target server of the batch's messages
+func (b *Batch) send() ([]bool, []string) {
+	results := make([]bool, len(b.entries))
+	locations := make([]string, len(b.entries))
+
+	client := b.client()
+	if client == nil {
+		return results, locations
+	}
+
+	bundle, err := models.Bundle{Type: models.BundleTypeBatch, Entry: b.entries}.MarshalJSON()
+	if err != nil {
+		log.Error().Err(err).
+			Str("topic", b.infos[0].Topic).
+			Int64("offset", b.infos[0].Offset).
+			Msg("Failed to serialize batch bundle")
+		return results, locations
+	}
+
+	// headers of the first message are propagated
+	return client.SendEntries(bundle, len(b.entries), b.infos[0].propagated(b.processor.headers.Propagate))
+}
+
+func (b *Batch) reset() {
+	b.messages = nil
+	b.infos = nil
+	b.payloads = nil
+	b.counts = nil
+	b.entries = nil
+	b.targets = nil
+	b.size = 0
+}
@@ -0,0 +1,238 @@
+package fhir
+
+import (
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBatchFlush(t *testing.T) {
+	cases := []struct {
+		name         string
+		payloads     []string
+		resp         string
+		lastOffset   int64
+		expectedOk   bool
+		expectedSent bool
+	}{
+		{
+			name: "success",
+			payloads: []string{
+				`{"resourceType": "Bundle","type": "batch","entry": [{"resource": {"resourceType": "Patient"}}]}`,
+				`{"resourceType": "Bundle","type": "batch","entry": [{"resource": {"resourceType": "Observation"}},{"resource": {"resourceType": "Observation"}}]}`,
+			},
+			resp:         `{"type": "batch-response", "entry": [{"response": {"status": "201"}},{"response": {"status": "200"}},{"response": {"status": "201"}}], "resourceType": "Bundle"}`,
+			lastOffset:   1,
+			expectedOk:   true,
+			expectedSent: true,
+		},
+		{
+			name: "partial",
+			payloads: []string{
+				`{"resourceType": "Bundle","type": "batch","entry": [{"resource": {"resourceType": "Patient"}}]}`,
+				`{"resourceType": "Bundle","type": "batch","entry": [{"resource": {"resourceType": "Observation"}},{"resource": {"resourceType": "Observation"}}]}`,
+				`{"resourceType": "Bundle","type": "batch","entry": [{"resource": {"resourceType": "Patient"}}]}`,
+			},
+			resp:         `{"type": "batch-response", "entry": [{"response": {"status": "201"}},{"response": {"status": "200"}},{"response": {"status": "422"}},{"response": {"status": "201"}}], "resourceType": "Bundle"}`,
+			lastOffset:   0,
+			expectedOk:   false,
+			expectedSent: true,
+		},
+		{
+			name: "invalid",
+			payloads: []string{
+				`{"resourceType": "Bundle","type": "batch","entry": [{"resource": {"resourceType": "Patient"}}]}`,
+				`invalid`,
+			},
+			resp:         `{"type": "batch-response", "entry": [{"response": {"status": "201"}}], "resourceType": "Bundle"}`,
+			lastOffset:   0,
+			expectedOk:   false,
+			expectedSent: true,
+		},
+		{
+			name:         "tombstones",
+			payloads:     []string{``, ``},
+			lastOffset:   1,
+			expectedOk:   true,
+			expectedSent: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			baseUrl := "https://dummy-url/fhir"
+			p := NewProcessor(config.Fhir{Server: config.Server{BaseUrl: baseUrl}})
+			batch := p.NewBatch()
+
+			// set up mock
+			httpmock.Reset()
+			httpmock.ActivateNonDefault(p.client.rest.GetClient())
+			httpmock.RegisterResponder("POST", baseUrl, httpmock.NewStringResponder(200, c.resp))
+
+			testTopic := "test"
+			var messages []*source.Message
+			for i, payload := range c.payloads {
+				messages = append(messages, &source.Message{
+					Origin: source.Origin{Topic: testTopic, Offset: int64(i)},
+					Value:  []byte(payload),
+					Key:    []byte("test"),
+				})
+			}
+
+			last, ok := addAll(batch, messages)
+
+			assert.Equal(t, c.expectedOk, ok)
+			assert.NotNil(t, last)
+			assert.Equal(t, c.lastOffset, last.Origin.Offset)
+			assert.Equal(t, c.expectedSent, httpmock.GetTotalCallCount() == 1)
+		})
+	}
+}
+
+func TestBatchTransaction(t *testing.T) {
+	baseUrl := "https://dummy-url/fhir"
+	p := NewProcessor(config.Fhir{Server: config.Server{BaseUrl: baseUrl}})
+	batch := p.NewBatch()
+
+	httpmock.Reset()
+	httpmock.ActivateNonDefault(p.client.rest.GetClient())
+	var bodies []string
+	httpmock.RegisterResponder("POST", baseUrl, func(req *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+		return httpmock.NewStringResponse(200, `{"type": "batch-response", "entry": [{"response": {"status": "201"}}], "resourceType": "Bundle"}`), nil
+	})
+
+	transaction := `{"resourceType": "Bundle","type": "transaction","entry": [{"fullUrl": "urn:uuid:1","resource": {"resourceType": "Patient"},"request": {"method": "POST","url": "Patient"}}]}`
+	payloads := []string{
+		`{"resourceType": "Bundle","type": "batch","entry": [{"resource": {"resourceType": "Patient"}}]}`,
+		transaction,
+		`{"resourceType": "Observation","id": "1"}`,
+	}
+	var messages []*source.Message
+	for i, payload := range payloads {
+		messages = append(messages, &source.Message{Origin: source.Origin{Topic: "test", Offset: int64(i)}, Value: []byte(payload)})
+	}
+
+	last, ok := addAll(batch, messages)
+
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), last.Origin.Offset)
+	// the unchanged transaction is sent between the batches of the other messages
+	assert.Len(t, bodies, 3)
+	assert.Equal(t, transaction, bodies[1])
+}
+
+func TestBatchOrder(t *testing.T) {
+	baseUrl := "https://dummy-url/fhir"
+	p := NewProcessor(config.Fhir{
+		Server: config.Server{BaseUrl: baseUrl},
+		Tombstone: config.Tombstone{
+			Mode:       "delete",
+			KeyPattern: `^(?P<type>[A-Za-z]+)/(?P<id>[A-Za-z0-9\-.]{1,64})$`,
+			OnError:    "fail",
+		},
+	})
+	batch := p.NewBatch()
+
+	httpmock.Reset()
+	httpmock.ActivateNonDefault(p.client.rest.GetClient())
+	var requests []string
+	httpmock.RegisterResponder("POST", baseUrl, func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req.Method)
+		return httpmock.NewStringResponse(200, `{"type": "batch-response", "entry": [{"response": {"status": "201"}}], "resourceType": "Bundle"}`), nil
+	})
+	httpmock.RegisterResponder("DELETE", baseUrl+"/Patient/1", func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req.Method)
+		return httpmock.NewStringResponse(204, ""), nil
+	})
+
+	patient := `{"resourceType": "Patient","id": "1"}`
+	cases := []struct {
+		name     string
+		payloads []string
+		expected []string
+	}{
+		{
+			name:     "tombstone and re-create",
+			payloads: []string{patient, ``, patient},
+			expected: []string{"POST", "DELETE", "POST"},
+		},
+		{
+			name:     "same resource",
+			payloads: []string{patient, patient},
+			expected: []string{"POST", "POST"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			requests = nil
+			var messages []*source.Message
+			for i, payload := range c.payloads {
+				messages = append(messages, &source.Message{
+					Origin: source.Origin{Topic: "test", Offset: int64(i)},
+					Key:    []byte("Patient/1"),
+					Value:  []byte(payload),
+				})
+			}
+
+			last, ok := addAll(batch, messages)
+
+			assert.True(t, ok)
+			assert.Equal(t, int64(len(c.payloads)-1), last.Origin.Offset)
+			assert.Equal(t, c.expected, requests)
+		})
+	}
+}
+
+func TestBatchLimits(t *testing.T) {
+	p := NewProcessor(config.Fhir{Batch: config.Batch{MaxEntries: 2, MaxWait: time.Hour}})
+	batch := p.NewBatch()
+
+	topic := "test"
+	other := "other"
+	msg := &source.Message{
+		Origin: source.Origin{Topic: topic, Partition: 0},
+		Value:  []byte(`{"resourceType": "Bundle","type": "batch","entry": [{"resource": {"resourceType": "Patient"}}]}`),
+	}
+
+	assert.True(t, batch.Accepts(msg))
+	assert.False(t, batch.Due())
+
+	batch.Add(msg)
+	assert.False(t, batch.Full())
+	assert.False(t, batch.Due())
+
+	// other partition or topic
+	assert.False(t, batch.Accepts(&source.Message{Origin: source.Origin{Topic: topic, Partition: 1}}))
+	assert.False(t, batch.Accepts(&source.Message{Origin: source.Origin{Topic: other, Partition: 0}}))
+
+	batch.Add(msg)
+	assert.True(t, batch.Full())
+}
+
+// addAll adds the messages to the batch and flushes it, as the consumer does.
+// It returns the last successfully processed message
+func addAll(batch *Batch, messages []*source.Message) (*source.Message, bool) {
+	var last *source.Message
+	for _, msg := range messages {
+		l, ok := batch.Add(msg)
+		if l != nil {
+			last = l
+		}
+		if !ok {
+			return last, false
+		}
+	}
+	l, ok := batch.Flush()
+	if l != nil {
+		last = l
+	}
+	return last, ok
+}
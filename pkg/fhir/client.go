@@ -1,18 +1,27 @@
 package fhir
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fhir-to-server/pkg/config"
+	"fmt"
 	"github.com/go-resty/resty/v2"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"net/http"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type Client struct {
 	rest   *resty.Client
 	config config.Fhir
+	// compress is reset, if the server doesn't support compressed requests
+	compress atomic.Bool
 }
 
 func NewClient(fhir config.Fhir) *Client {
@@ -27,24 +36,243 @@ func NewClient(fhir config.Fhir) *Client {
 		client = client.SetBasicAuth(fhir.Server.Auth.User, fhir.Server.Auth.Password)
 	}
 
-	return &Client{rest: client, config: fhir}
+	c := &Client{rest: client, config: fhir}
+	c.compress.Store(fhir.Compression.Enabled)
+	return c
 }
 
 func (c *Client) Send(fhir []byte) bool {
-	resp, err := c.rest.R().
-		SetBody(fhir).
-		SetHeader("Content-Type", "application/fhir+json").
-		Post(c.config.Server.BaseUrl)
+	return c.SendContent(fhir, JsonContentType, nil)
+}
+
+// SendContent sends the bundle with the given content type (FHIR JSON or XML)
+// and additional request headers
+func (c *Client) SendContent(fhir []byte, contentType string, headers map[string]string) bool {
+	_, success := c.SendBundle(fhir, contentType, headers)
+	return success
+}
+
+// SendBundle sends the bundle like SendContent and returns the locations of
+// the response entries relative to the server's base url
+func (c *Client) SendBundle(fhir []byte, contentType string, headers map[string]string) ([]string, bool) {
+	resp, err := c.post(fhir, contentType, headers)
 	check(err)
 
 	// http response status
 	success := resp.IsSuccess()
 
+	var locations []string
 	if resp.RawResponse != nil {
 		// http response status and FHIR response status
-		success = success && responseSuccess(resp.Body())
+		var ok bool
+		locations, ok = parseResponse(resp.Body())
+		success = success && ok
+	}
+
+	logResponse(resp, success)
+
+	return c.relative(locations), success
+}
+
+// Exchange posts the bundle and returns the status and body of the response.
+// The response is logged, but not evaluated
+func (c *Client) Exchange(fhir []byte, contentType string, headers map[string]string) (int, []byte, error) {
+	resp, err := c.post(fhir, contentType, headers)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	logResponse(resp, resp.IsSuccess())
+	return resp.StatusCode(), resp.Body(), nil
+}
+
+// SendEntries sends a batch bundle with the given number of entries and
+// returns the success and location of each entry, in order
+func (c *Client) SendEntries(fhir []byte, count int, headers map[string]string) ([]bool, []string) {
+	results := make([]bool, count)
+	locations := make([]string, count)
+
+	resp, err := c.post(fhir, JsonContentType, headers)
+	check(err)
+
+	if !resp.IsSuccess() || resp.RawResponse == nil {
+		logResponse(resp, false)
+		return results, locations
+	}
+
+	entries, err := responseEntries(resp.Body())
+	if err != nil {
+		check(err)
+		logResponse(resp, false)
+		return results, locations
+	}
+
+	success := true
+	for i := range results {
+		results[i] = i < len(entries) && entries[i].success()
+		if results[i] {
+			locations[i] = entries[i].location
+		}
+		success = success && results[i]
+	}
+	logResponse(resp, success)
+
+	return results, c.relative(locations)
+}
+
+// SendResource sends a single resource request relative to the server's base
+// url, e.g. PUT [base]/[type]/[id] or POST [base]/[type]. It returns the
+// location of the resource
+func (c *Client) SendResource(method, url string, resource []byte, contentType string, headers map[string]string) (string, bool) {
+	resp, err := c.execute(method, c.config.Server.BaseUrl+"/"+url, resource, contentType, c.prefer(headers))
+	check(err)
+
+	success := resp.IsSuccess()
+	logResponse(resp, success)
+
+	location := resp.Header().Get("Location")
+	if location == "" {
+		location = resp.Header().Get("Content-Location")
+	}
+	return strings.TrimPrefix(location, c.config.Server.BaseUrl+"/"), success
+}
+
+// Validate sends the resource to the $validate operation of its type and
+// returns the resulting OperationOutcome. Nothing is stored on the server
+func (c *Client) Validate(resourceType string, resource []byte, contentType string, headers map[string]string) (models.OperationOutcome, error) {
+	resp, err := c.execute(resty.MethodPost, c.config.Server.BaseUrl+"/"+resourceType+"/$validate", resource, contentType, headers)
+	if err != nil {
+		return models.OperationOutcome{}, err
+	}
+
+	outcome, err := models.UnmarshalOperationOutcome(resp.Body())
+	logResponse(resp, err == nil)
+	if err != nil {
+		return outcome, fmt.Errorf("unexpected response of %s/$validate: %s", resourceType, resp.Status())
+	}
+	return outcome, nil
+}
+
+// Exists checks if the search relative to the server's base url, e.g.
+// [type]?_id=[id], has at least one match
+func (c *Client) Exists(search string) (bool, error) {
+	separator := "?"
+	if strings.Contains(search, "?") {
+		separator = "&"
+	}
+	resp, err := c.request(JsonContentType, nil).
+		Get(c.config.Server.BaseUrl + "/" + search + separator + "_summary=count")
+	if err != nil {
+		return false, err
 	}
 
+	logResponse(resp, resp.IsSuccess())
+	if !resp.IsSuccess() {
+		return false, fmt.Errorf("failed to search %s: %s", search, resp.Status())
+	}
+	b, err := models.UnmarshalBundle(resp.Body())
+	if err != nil {
+		return false, err
+	}
+	return b.Total != nil && *b.Total > 0, nil
+}
+
+// relative removes the server's base url from the locations
+func (c *Client) relative(locations []string) []string {
+	for i, l := range locations {
+		locations[i] = strings.TrimPrefix(l, c.config.Server.BaseUrl+"/")
+	}
+	return locations
+}
+
+// Delete deletes the resource(s) at the url relative to the server's base url
+// and returns the response status code
+func (c *Client) Delete(url string, headers map[string]string) (int, error) {
+	resp, err := c.request(JsonContentType, headers).
+		Delete(c.config.Server.BaseUrl + "/" + url)
+	if err != nil {
+		return 0, err
+	}
+
+	logResponse(resp, deleteSuccess(resp.StatusCode()))
+	return resp.StatusCode(), nil
+}
+
+func (c *Client) post(fhir []byte, contentType string, headers map[string]string) (*resty.Response, error) {
+	return c.execute(resty.MethodPost, c.config.Server.BaseUrl, fhir, contentType, c.prefer(headers))
+}
+
+// prefer adds the configured Prefer header (return=minimal, representation or
+// OperationOutcome), unless the message already provides one
+func (c *Client) prefer(headers map[string]string) map[string]string {
+	if c.config.Prefer == "" {
+		return headers
+	}
+	for name := range headers {
+		if strings.EqualFold(name, "Prefer") {
+			return headers
+		}
+	}
+
+	preferred := make(map[string]string, len(headers)+1)
+	for name, value := range headers {
+		preferred[name] = value
+	}
+	preferred["Prefer"] = "return=" + c.config.Prefer
+	return preferred
+}
+
+// execute sends the body, which is gzip compressed if enabled and large
+// enough. If the server rejects a compressed body with 415 Unsupported Media
+// Type, the request is repeated uncompressed. Compression is disabled, if the
+// uncompressed request isn't rejected as well, i.e. the content encoding was
+// not supported
+func (c *Client) execute(method, url string, body []byte, contentType string, headers map[string]string) (*resty.Response, error) {
+	if !c.compress.Load() || len(body) < c.config.Compression.MinBytes {
+		return c.request(contentType, headers).SetBody(body).Execute(method, url)
+	}
+
+	compressed, err := gzipBody(body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.request(contentType, headers).
+		SetHeader("Content-Encoding", "gzip").
+		SetBody(compressed).
+		Execute(method, url)
+	if err != nil || resp.StatusCode() != http.StatusUnsupportedMediaType {
+		return resp, err
+	}
+
+	resp, err = c.request(contentType, headers).SetBody(body).Execute(method, url)
+	if err == nil && resp.StatusCode() != http.StatusUnsupportedMediaType && c.compress.CompareAndSwap(true, false) {
+		log.Warn().Str("url", url).Msg("FHIR server doesn't accept compressed requests. Compression disabled")
+	}
+	return resp, err
+}
+
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// request creates a request with the given content type and additional headers.
+// Responses are always requested as JSON
+func (c *Client) request(contentType string, headers map[string]string) *resty.Request {
+	return c.rest.R().
+		SetHeaders(headers).
+		SetHeader("Content-Type", contentType).
+		SetHeader("Accept", JsonContentType)
+}
+
+func logResponse(resp *resty.Response, success bool) {
 	var logEvent *zerolog.Event
 	if success {
 		logEvent = log.Debug()
@@ -55,27 +283,156 @@ func (c *Client) Send(fhir []byte) bool {
 	logEvent.
 		Str("status", resp.Status()).
 		Str("body", string(resp.Body())).Msg("FHIR server response")
+}
 
+func responseSuccess(body []byte) bool {
+	_, success := parseResponse(body)
 	return success
 }
 
-func responseSuccess(body []byte) bool {
-	// check BundleEntryResponse status
-	b, err := models.UnmarshalBundle(body)
+// entryResponse is the response of a batch or transaction entry
+type entryResponse struct {
+	status   string
+	location string
+}
+
+func (r entryResponse) success() bool {
+	if len(r.status) < 3 {
+		return false
+	}
+	status, err := strconv.Atoi(r.status[0:3])
+	return err == nil && statusSuccess(status)
+}
+
+// parseResponse checks the BundleEntryResponse status of all entries and
+// returns their locations
+func parseResponse(body []byte) ([]string, bool) {
+	entries, err := responseEntries(body)
 	if err != nil {
 		check(err)
-		return false
+		return nil, false
 	}
 
-	for _, e := range b.Entry {
-		status, err := strconv.Atoi(e.Response.Status[0:3])
+	var locations []string
+	for _, e := range entries {
+		if !e.success() {
+			return nil, false
+		}
+		if e.location != "" {
+			locations = append(locations, e.location)
+		}
+	}
+
+	return locations, true
+}
+
+// responseEntries reads entry.response of the response bundle as a stream,
+// skipping resources and outcomes, which are returned depending on the Prefer
+// header. Entries without response have an empty status
+func responseEntries(body []byte) ([]entryResponse, error) {
+	d := json.NewDecoder(bytes.NewReader(body))
+	if err := expectDelim(d, '{'); err != nil {
+		return nil, err
+	}
+
+	var entries []entryResponse
+	for d.More() {
+		key, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		if key != "entry" {
+			if err = skipValue(d); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if err = expectDelim(d, '['); err != nil {
+			return nil, err
+		}
+		for d.More() {
+			entry, err := decodeEntry(d)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+		if err = expectDelim(d, ']'); err != nil {
+			return nil, err
+		}
+	}
+	return entries, expectDelim(d, '}')
+}
 
-		if err != nil || !statusSuccess(status) {
-			return false
+// decodeEntry reads the status and location of an entry's response
+func decodeEntry(d *json.Decoder) (entryResponse, error) {
+	var entry entryResponse
+	err := decodeObject(d, func(key string) error {
+		if key != "response" {
+			return skipValue(d)
+		}
+		return decodeObject(d, func(key string) error {
+			switch key {
+			case "status":
+				return d.Decode(&entry.status)
+			case "location":
+				return d.Decode(&entry.location)
+			default:
+				return skipValue(d)
+			}
+		})
+	})
+	return entry, err
+}
+
+// decodeObject calls fn with the key of each member of the next object, which
+// must decode or skip the member's value
+func decodeObject(d *json.Decoder, fn func(key string) error) error {
+	if err := expectDelim(d, '{'); err != nil {
+		return err
+	}
+	for d.More() {
+		key, err := d.Token()
+		if err != nil {
+			return err
+		}
+		if err = fn(key.(string)); err != nil {
+			return err
 		}
 	}
+	return expectDelim(d, '}')
+}
 
-	return true
+func expectDelim(d *json.Decoder, delim json.Delim) error {
+	t, err := d.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return fmt.Errorf("invalid response: expected %s, got %v", delim, t)
+	}
+	return nil
+}
+
+// skipValue skips the next value without decoding it
+func skipValue(d *json.Decoder) error {
+	depth := 0
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
 }
 
 func statusSuccess(status int) bool {
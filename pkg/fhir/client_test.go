@@ -1,10 +1,13 @@
 package fhir
 
 import (
+	"compress/gzip"
 	"fhir-to-server/pkg/config"
 	"github.com/jarcoal/httpmock"
 	"github.com/samply/golang-fhir-models/fhir-models/fhir"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
 	"testing"
 	"time"
 )
@@ -100,6 +103,83 @@ func TestSend(t *testing.T) {
 	}
 }
 
+func TestSendCompressed(t *testing.T) {
+	baseUrl := "https://dummy-url/fhir"
+	body := []byte(`{"resourceType": "Bundle", "type": "transaction"}`)
+
+	cases := []struct {
+		name               string
+		minBytes           int
+		unsupported        bool
+		unsupportedType    bool
+		expectedEncodings  []string
+		expectedCompressed bool
+	}{
+		{
+			name:               "compressed",
+			expectedEncodings:  []string{"gzip"},
+			expectedCompressed: true,
+		},
+		{
+			name:               "belowThreshold",
+			minBytes:           1024,
+			expectedEncodings:  []string{""},
+			expectedCompressed: true,
+		},
+		{
+			name:               "unsupported",
+			unsupported:        true,
+			expectedEncodings:  []string{"gzip", ""},
+			expectedCompressed: false,
+		},
+		{
+			// the content type is rejected, not the encoding
+			name:               "unsupportedType",
+			unsupportedType:    true,
+			expectedEncodings:  []string{"gzip", ""},
+			expectedCompressed: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := NewClient(config.Fhir{
+				Server:      config.Server{BaseUrl: baseUrl},
+				Compression: config.Compression{Enabled: true, MinBytes: c.minBytes},
+			})
+
+			httpmock.ActivateNonDefault(client.rest.GetClient())
+			t.Cleanup(httpmock.DeactivateAndReset)
+			var encodings []string
+			httpmock.RegisterResponder("POST", baseUrl, func(req *http.Request) (*http.Response, error) {
+				encoding := req.Header.Get("Content-Encoding")
+				encodings = append(encodings, encoding)
+				if c.unsupportedType {
+					return httpmock.NewStringResponse(415, ""), nil
+				}
+
+				var r io.Reader = req.Body
+				if encoding == "gzip" {
+					if c.unsupported {
+						return httpmock.NewStringResponse(415, ""), nil
+					}
+					var err error
+					if r, err = gzip.NewReader(req.Body); err != nil {
+						return nil, err
+					}
+				}
+				received, _ := io.ReadAll(r)
+				assert.Equal(t, body, received)
+				return httpmock.NewStringResponse(200, `{"type": "transaction-response", "resourceType": "Bundle"}`), nil
+			})
+
+			assert.Equal(t, !c.unsupportedType, client.Send(body))
+			assert.Equal(t, c.expectedEncodings, encodings)
+			assert.Equal(t, c.expectedCompressed, client.compress.Load())
+		})
+	}
+}
+
 func TestResponseSuccess(t *testing.T) {
 
 	cases := []struct {
@@ -122,6 +202,35 @@ func TestResponseSuccess(t *testing.T) {
 			response: `{"type": "batch-response", "entry": [{"response": {"status": "200"}}], "resourceType": "Bundle"}`,
 			expected: true,
 		},
+		{
+			name: "representation",
+			response: `{"resourceType": "Bundle", "type": "transaction-response", "entry": [
+				{"resource": {"resourceType": "Patient", "id": "1", "name": [{"family": "Doe"}], "active": true},
+				 "response": {"status": "201 Created", "location": "Patient/1/_history/1"}}]}`,
+			expected: true,
+		},
+		{
+			name: "operationOutcome",
+			response: `{"resourceType": "Bundle", "type": "transaction-response", "entry": [
+				{"response": {"outcome": {"resourceType": "OperationOutcome", "issue": [{"severity": "information", "code": "informational"}]},
+				 "status": "200 OK"}}]}`,
+			expected: true,
+		},
+		{
+			name:     "missingResponse",
+			response: `{"resourceType": "Bundle", "type": "batch-response", "entry": [{"fullUrl": "urn:uuid:1"}]}`,
+			expected: false,
+		},
+		{
+			name:     "invalid",
+			response: `{"resourceType": "Bundle", "entry": [`,
+			expected: false,
+		},
+		{
+			name:     "noObject",
+			response: `[]`,
+			expected: false,
+		},
 	}
 
 	for _, c := range cases {
@@ -132,3 +241,49 @@ func TestResponseSuccess(t *testing.T) {
 		})
 	}
 }
+
+func TestParseResponse(t *testing.T) {
+	response := `{"resourceType": "Bundle", "type": "transaction-response", "entry": [
+		{"response": {"status": "201 Created", "location": "Patient/1/_history/1", "etag": "W/\"1\""}},
+		{"resource": {"resourceType": "Observation", "id": "2"}, "response": {"status": "200 OK", "location": "Observation/2/_history/3"}},
+		{"response": {"status": "204 No Content"}}]}`
+
+	locations, ok := parseResponse([]byte(response))
+
+	assert.True(t, ok)
+	assert.Equal(t, []string{"Patient/1/_history/1", "Observation/2/_history/3"}, locations)
+}
+
+func TestSendPrefer(t *testing.T) {
+	baseUrl := "https://dummy-url/fhir"
+
+	cases := []struct {
+		name     string
+		prefer   string
+		headers  map[string]string
+		expected string
+	}{
+		{name: "none", expected: ""},
+		{name: "minimal", prefer: "minimal", expected: "return=minimal"},
+		{name: "operationOutcome", prefer: "OperationOutcome", expected: "return=OperationOutcome"},
+		{name: "propagated", prefer: "minimal", headers: map[string]string{"prefer": "return=representation"}, expected: "return=representation"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := NewClient(config.Fhir{Server: config.Server{BaseUrl: baseUrl}, Prefer: c.prefer})
+
+			httpmock.ActivateNonDefault(client.rest.GetClient())
+			t.Cleanup(httpmock.DeactivateAndReset)
+			var prefer string
+			httpmock.RegisterResponder("POST", baseUrl, func(req *http.Request) (*http.Response, error) {
+				prefer = req.Header.Get("Prefer")
+				return httpmock.NewStringResponse(200, `{"resourceType": "Bundle", "entry": [{"response": {"status": "201"}}]}`), nil
+			})
+
+			assert.True(t, client.SendContent([]byte(`{"resourceType": "Bundle"}`), JsonContentType, c.headers))
+			assert.Equal(t, c.expected, prefer)
+			assert.NotContains(t, c.headers, "Prefer")
+		})
+	}
+}
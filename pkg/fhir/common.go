@@ -9,5 +9,5 @@ func check(err error) {
 		return
 	}
 
-	log.Error().Err(err)
+	log.Error().Err(err).Msg("Unexpected error")
 }
@@ -0,0 +1,166 @@
+package fhir
+
+import (
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/metrics"
+	"fmt"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ConceptMapper translates codings of configured elements using the
+// ConceptMap resources of a directory
+type ConceptMapper struct {
+	config config.ConceptMap
+	// target codings by source system and code
+	mappings map[string][]map[string]interface{}
+	// systems with at least one mapping
+	sources  map[string]bool
+	elements map[string][][]string
+}
+
+func NewConceptMapper(config config.ConceptMap) (*ConceptMapper, error) {
+	m := &ConceptMapper{
+		config:   config,
+		mappings: make(map[string][]map[string]interface{}),
+		sources:  make(map[string]bool),
+		elements: make(map[string][][]string),
+	}
+
+	for _, element := range config.Elements {
+		resourceType, path, found := strings.Cut(element, ".")
+		if !found || path == "" {
+			return nil, fmt.Errorf("invalid element: %s", element)
+		}
+		m.elements[resourceType] = append(m.elements[resourceType], strings.Split(path, "."))
+	}
+
+	files, err := filepath.Glob(filepath.Join(config.Path, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		conceptMap, err := models.UnmarshalConceptMap(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ConceptMap %s: %w", f, err)
+		}
+		m.add(conceptMap)
+	}
+	if len(m.mappings) == 0 {
+		return nil, fmt.Errorf("no ConceptMap found in %s", config.Path)
+	}
+
+	return m, nil
+}
+
+// add registers the mappings of a ConceptMap. Targets marked as unmatched or
+// disjoint are ignored
+func (m *ConceptMapper) add(conceptMap models.ConceptMap) {
+	for _, group := range conceptMap.Group {
+		if group.Source == nil || group.Target == nil {
+			continue
+		}
+		for _, element := range group.Element {
+			if element.Code == nil {
+				continue
+			}
+			for _, target := range element.Target {
+				if target.Code == nil || target.Equivalence == models.ConceptMapEquivalenceUnmatched ||
+					target.Equivalence == models.ConceptMapEquivalenceDisjoint {
+					continue
+				}
+				coding := map[string]interface{}{"system": *group.Target, "code": *target.Code}
+				if target.Display != nil {
+					coding["display"] = *target.Display
+				}
+				key := *group.Source + "|" + *element.Code
+				m.mappings[key] = append(m.mappings[key], coding)
+				m.sources[*group.Source] = true
+			}
+		}
+	}
+}
+
+func (m *ConceptMapper) Transform(payload *Payload, msg MessageInfo) error {
+	return transformEntries(payload, func(_ *models.BundleEntry, resource Resource) (bool, error) {
+		if resource == nil {
+			return true, nil
+		}
+
+		var unmapped []string
+		for _, path := range m.elements[resource.Type()] {
+			for _, concept := range parents(map[string]interface{}(resource), path, false) {
+				unmapped = append(unmapped, m.translate(concept, msg)...)
+			}
+		}
+		if len(unmapped) == 0 {
+			return true, nil
+		}
+
+		switch m.config.Unmapped {
+		case "drop":
+			return false, nil
+		case "dlq":
+			return false, &DeadLetterError{Reason: fmt.Sprintf("unmapped codes in %s/%s: %s",
+				resource.Type(), resource.Id(), strings.Join(unmapped, ", "))}
+		default:
+			return true, nil
+		}
+	})
+}
+
+// translate replaces (or adds) the mapped codings of a CodeableConcept and
+// returns the codes which have no mapping
+func (m *ConceptMapper) translate(concept map[string]interface{}, msg MessageInfo) []string {
+	codings, _ := concept["coding"].([]interface{})
+
+	var result []interface{}
+	var unmapped []string
+	for _, c := range codings {
+		coding, ok := c.(map[string]interface{})
+		if !ok {
+			result = append(result, c)
+			continue
+		}
+		system, _ := coding["system"].(string)
+		code, _ := coding["code"].(string)
+
+		targets, mapped := m.mappings[system+"|"+code]
+		switch {
+		case mapped:
+			metrics.ConceptMapMapped.WithLabelValues(msg.Topic).Inc()
+		case m.sources[system]:
+			metrics.ConceptMapUnmapped.WithLabelValues(msg.Topic).Inc()
+			unmapped = append(unmapped, system+"|"+code)
+		}
+
+		if !mapped || m.config.Mode == "add" {
+			result = append(result, coding)
+		}
+		for _, t := range targets {
+			if !containsCoding(result, t) && !containsCoding(codings, t) {
+				result = append(result, t)
+			}
+		}
+	}
+
+	if len(codings) > 0 {
+		concept["coding"] = result
+	}
+	return unmapped
+}
+
+func containsCoding(codings []interface{}, coding map[string]interface{}) bool {
+	for _, c := range codings {
+		if c, ok := c.(map[string]interface{}); ok && c["system"] == coding["system"] && c["code"] == coding["code"] {
+			return true
+		}
+	}
+	return false
+}
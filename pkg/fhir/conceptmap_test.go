@@ -0,0 +1,118 @@
+package fhir
+
+import (
+	"encoding/json"
+	"errors"
+	"fhir-to-server/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const labConceptMap = `{"resourceType": "ConceptMap","status": "active","group": [{
+	"source": "http://lab.local/codes","target": "http://loinc.org",
+	"element": [
+		{"code": "hb","target": [{"code": "718-7","display": "Hemoglobin","equivalence": "equivalent"}]},
+		{"code": "pos","target": [{"code": "LA6576-8","equivalence": "equivalent"}]},
+		{"code": "x","target": [{"equivalence": "unmatched"}]}
+	]}]}`
+
+func newTestConceptMapper(t *testing.T, mode, unmapped string) *ConceptMapper {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "lab.json"), []byte(labConceptMap), 0600))
+
+	m, err := NewConceptMapper(config.ConceptMap{
+		Path:     dir,
+		Elements: []string{"Observation.code", "Observation.valueCodeableConcept"},
+		Mode:     mode,
+		Unmapped: unmapped,
+	})
+	assert.NoError(t, err)
+	return m
+}
+
+func TestConceptMapperTransform(t *testing.T) {
+	cases := []struct {
+		name     string
+		mode     string
+		expected []interface{}
+	}{
+		{
+			name: "replace",
+			mode: "replace",
+			expected: []interface{}{
+				map[string]interface{}{"system": "http://loinc.org", "code": "718-7", "display": "Hemoglobin"},
+				map[string]interface{}{"system": "http://snomed.info/sct", "code": "271026005"},
+			},
+		},
+		{
+			name: "add",
+			mode: "add",
+			expected: []interface{}{
+				map[string]interface{}{"system": "http://lab.local/codes", "code": "hb"},
+				map[string]interface{}{"system": "http://loinc.org", "code": "718-7", "display": "Hemoglobin"},
+				map[string]interface{}{"system": "http://snomed.info/sct", "code": "271026005"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := newTestConceptMapper(t, c.mode, "keep")
+			payload, _ := ParsePayload([]byte(`{"resourceType": "Observation","id": "1",
+				"code": {"coding": [{"system": "http://lab.local/codes","code": "hb"},{"system": "http://snomed.info/sct","code": "271026005"}]},
+				"valueCodeableConcept": {"coding": [{"system": "http://lab.local/codes","code": "pos"}]}}`), "")
+
+			err := m.Transform(payload, MessageInfo{Topic: "lab-fhir"})
+			assert.NoError(t, err)
+
+			var observation map[string]interface{}
+			_ = json.Unmarshal(payload.Bundle.Entry[0].Resource, &observation)
+			assert.Equal(t, c.expected, observation["code"].(map[string]interface{})["coding"])
+			assert.Contains(t, observation["valueCodeableConcept"].(map[string]interface{})["coding"],
+				map[string]interface{}{"system": "http://loinc.org", "code": "LA6576-8"})
+		})
+	}
+}
+
+func TestConceptMapperUnmapped(t *testing.T) {
+	bundle := []byte(`{"resourceType": "Bundle","type": "batch","entry": [
+		{"resource": {"resourceType": "Observation","id": "1","code": {"coding": [{"system": "http://lab.local/codes","code": "x"}]}}},
+		{"resource": {"resourceType": "Observation","id": "2","code": {"coding": [{"system": "http://other","code": "x"}]}}}
+	]}`)
+
+	cases := []struct {
+		unmapped   string
+		entries    int
+		deadLetter bool
+	}{
+		{"keep", 2, false},
+		{"drop", 1, false},
+		{"dlq", 2, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.unmapped, func(t *testing.T) {
+			m := newTestConceptMapper(t, "replace", c.unmapped)
+			payload, _ := ParsePayload(bundle, "")
+
+			err := m.Transform(payload, MessageInfo{Topic: "lab-fhir"})
+
+			var dlErr *DeadLetterError
+			assert.Equal(t, c.deadLetter, errors.As(err, &dlErr))
+			if !c.deadLetter {
+				assert.NoError(t, err)
+				assert.Len(t, payload.Bundle.Entry, c.entries)
+			}
+		})
+	}
+}
+
+func TestNewConceptMapperInvalid(t *testing.T) {
+	_, err := NewConceptMapper(config.ConceptMap{Path: t.TempDir(), Elements: []string{"Observation.code"}})
+	assert.Error(t, err)
+
+	_, err = NewConceptMapper(config.ConceptMap{Path: t.TempDir(), Elements: []string{"code"}})
+	assert.Error(t, err)
+}
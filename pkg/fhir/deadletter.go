@@ -0,0 +1,89 @@
+package fhir
+
+import (
+	"errors"
+	"fhir-to-server/pkg/source"
+	"github.com/rs/zerolog/log"
+	"strconv"
+)
+
+// DeadLetterError marks a message which cannot be loaded and is sent to the
+// dead letter queue instead
+type DeadLetterError struct {
+	Reason string
+}
+
+func (e *DeadLetterError) Error() string {
+	return "dead letter: " + e.Reason
+}
+
+// DeadLetterQueue receives messages which cannot be loaded
+type DeadLetterQueue interface {
+	Send(msg *source.Message, reason string) error
+}
+
+// KafkaDeadLetterQueue produces messages to a dead letter topic. The original
+// headers are kept, the origin and the reason are added as headers
+type KafkaDeadLetterQueue struct {
+	producer source.Producer
+	topic    string
+}
+
+func NewKafkaDeadLetterQueue(producer source.Producer, topic string) *KafkaDeadLetterQueue {
+	return &KafkaDeadLetterQueue{producer: producer, topic: topic}
+}
+
+// Send produces the message to the dead letter topic and waits for its delivery
+func (q *KafkaDeadLetterQueue) Send(msg *source.Message, reason string) error {
+	info := NewMessageInfo(msg)
+	deadLetter := *msg
+	deadLetter.Headers = append(msg.Headers[:len(msg.Headers):len(msg.Headers)],
+		source.Header{Key: "dead-letter-reason", Value: []byte(reason)},
+		source.Header{Key: "dead-letter-topic", Value: []byte(info.Topic)},
+		source.Header{Key: "dead-letter-partition", Value: []byte(strconv.Itoa(int(info.Partition)))},
+		source.Header{Key: "dead-letter-offset", Value: []byte(strconv.FormatInt(info.Offset, 10))},
+	)
+	return q.producer.Produce(&deadLetter, q.topic)
+}
+
+// Close waits for outstanding messages and closes the producer
+func (q *KafkaDeadLetterQueue) Close() {
+	q.producer.Close()
+}
+
+// SetDeadLetterQueue sets the queue for messages which cannot be loaded.
+// Without a queue, these messages fail to process
+func (p *Processor) SetDeadLetterQueue(queue DeadLetterQueue) {
+	p.deadLetters = queue
+}
+
+// deadLetter sends the message to the dead letter queue, if err is a
+// DeadLetterError and a queue is set. It returns the error to handle otherwise
+func (p *Processor) deadLetter(msg *source.Message, info MessageInfo, err error) error {
+	var dlErr *DeadLetterError
+	if !errors.As(err, &dlErr) || p.deadLetters == nil {
+		return err
+	}
+
+	// a dry run must not produce to the dead letter topic
+	if p.report != nil {
+		p.report.deadLetter(dlErr.Reason)
+		log.Info().
+			Str("topic", info.Topic).
+			Str("key", info.Key).
+			Int64("offset", info.Offset).
+			Str("reason", dlErr.Reason).
+			Msg("Dry run: message would be sent to dead letter queue")
+		return nil
+	}
+	if err = p.deadLetters.Send(msg, dlErr.Reason); err != nil {
+		return err
+	}
+	log.Warn().
+		Str("topic", info.Topic).
+		Str("key", info.Key).
+		Int64("offset", info.Offset).
+		Str("reason", dlErr.Reason).
+		Msg("Message sent to dead letter queue")
+	return nil
+}
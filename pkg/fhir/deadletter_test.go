@@ -0,0 +1,88 @@
+package fhir
+
+import (
+	"errors"
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type testDeadLetterQueue struct {
+	reasons []string
+	err     error
+}
+
+func (q *testDeadLetterQueue) Send(_ *source.Message, reason string) error {
+	q.reasons = append(q.reasons, reason)
+	return q.err
+}
+
+type deadLetterTransformer struct{}
+
+func (deadLetterTransformer) Transform(*Payload, MessageInfo) error {
+	return &DeadLetterError{Reason: "unmapped"}
+}
+
+func TestProcessMessageDeadLetter(t *testing.T) {
+	cases := []struct {
+		name     string
+		queue    *testDeadLetterQueue
+		resultOk bool
+	}{
+		{"queue", &testDeadLetterQueue{}, true},
+		{"queueFailed", &testDeadLetterQueue{err: errors.New("not delivered")}, false},
+		{"noQueue", nil, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			baseUrl := "https://dummy-url/fhir"
+			p := NewProcessor(config.Fhir{Server: config.Server{BaseUrl: baseUrl}})
+			p.transformers = []Transformer{deadLetterTransformer{}}
+			if c.queue != nil {
+				p.SetDeadLetterQueue(c.queue)
+			}
+
+			httpmock.Reset()
+			httpmock.ActivateNonDefault(p.client.rest.GetClient())
+
+			testTopic := "test"
+			ok := p.ProcessMessage(&source.Message{
+				Origin: source.Origin{Topic: testTopic, Offset: 42},
+				Value:  []byte(`{"resourceType": "Observation","id": "1"}`),
+				Key:    []byte("test"),
+			})
+
+			assert.Equal(t, c.resultOk, ok)
+			assert.Equal(t, 0, httpmock.GetTotalCallCount())
+			if c.queue != nil {
+				assert.Equal(t, []string{"unmapped"}, c.queue.reasons)
+			}
+		})
+	}
+}
+
+func TestBatchDeadLetter(t *testing.T) {
+	baseUrl := "https://dummy-url/fhir"
+	p := NewProcessor(config.Fhir{Server: config.Server{BaseUrl: baseUrl}})
+	p.transformers = []Transformer{deadLetterTransformer{}}
+	queue := &testDeadLetterQueue{}
+	p.SetDeadLetterQueue(queue)
+
+	httpmock.Reset()
+	httpmock.ActivateNonDefault(p.client.rest.GetClient())
+
+	testTopic := "test"
+	msg := &source.Message{
+		Origin: source.Origin{Topic: testTopic, Offset: 42},
+		Value:  []byte(`{"resourceType": "Observation","id": "1"}`),
+	}
+	last, ok := addAll(p.NewBatch(), []*source.Message{msg})
+
+	assert.True(t, ok)
+	assert.Equal(t, msg, last)
+	assert.Equal(t, []string{"unmapped"}, queue.reasons)
+	assert.Equal(t, 0, httpmock.GetTotalCallCount())
+}
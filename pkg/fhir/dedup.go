@@ -0,0 +1,119 @@
+package fhir
+
+import (
+	"fhir-to-server/pkg/dedup"
+	"fhir-to-server/pkg/metrics"
+	"github.com/rs/zerolog/log"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"strings"
+)
+
+// deduplicate removes unchanged content from the payload and returns false, if
+// nothing is left to send. Depending on the scope, the content hash is
+// compared per message key or per entry (fullUrl or request url). XML payloads
+// and transactions, whose entries may reference each other, are compared per
+// message key in both scopes. Hashes of sent content are recorded by commit
+// after successful processing
+func (p *Processor) deduplicate(payload *Payload, info MessageInfo) (bool, error) {
+	if p.dedup == nil {
+		return true, nil
+	}
+	target := strings.ToLower(info.Header(p.headers.Target)) + "|" + info.Header(p.headers.Operation)
+
+	if p.dedupScope == "entry" && !payload.IsXml() && payload.Bundle.Type != models.BundleTypeTransaction {
+		entries := make([]models.BundleEntry, 0, len(payload.Bundle.Entry))
+		for _, e := range payload.Bundle.Entry {
+			key := entryKey(e)
+			if key == "" {
+				entries = append(entries, e)
+				continue
+			}
+
+			key = target + "|" + key
+			hash := dedup.Hash([]byte(target), []byte(requestLine(e)), e.Resource)
+			if p.dedup.Unchanged(key, hash) {
+				metrics.DedupSkipped.WithLabelValues(info.Topic, "entry").Inc()
+				continue
+			}
+			entries = append(entries, e)
+			payload.records = append(payload.records, dedup.Record{Key: key, Hash: hash})
+		}
+
+		if len(entries) < len(payload.Bundle.Entry) {
+			payload.SetEntries(entries)
+		}
+		return len(entries) > 0, nil
+	}
+
+	if info.Key == "" {
+		return true, nil
+	}
+	body, err := payload.Bytes()
+	if err != nil {
+		return false, err
+	}
+
+	key := messageKey(info)
+	hash := dedup.Hash([]byte(target), body)
+	if p.dedup.Unchanged(key, hash) {
+		metrics.DedupSkipped.WithLabelValues(info.Topic, "key").Inc()
+		log.Debug().
+			Str("topic", info.Topic).
+			Str("key", info.Key).
+			Int64("offset", info.Offset).
+			Msg("Unchanged message skipped")
+		return false, nil
+	}
+	payload.records = append(payload.records, dedup.Record{Key: key, Hash: hash})
+
+	return true, nil
+}
+
+// commit records the content hashes of a successfully sent payload
+func (p *Processor) commit(payload *Payload, info MessageInfo) {
+	if p.dedup == nil || len(payload.records) == 0 {
+		return
+	}
+
+	if err := p.dedup.Put(payload.records); err != nil {
+		log.Error().Err(err).
+			Str("topic", info.Topic).
+			Str("key", info.Key).
+			Int64("offset", info.Offset).
+			Msg("Failed to store content hashes")
+		return
+	}
+	metrics.DedupStored.WithLabelValues(info.Topic).Add(float64(len(payload.records)))
+}
+
+// forget removes the content hash of a message key, e.g. after its resource
+// was deleted
+func (p *Processor) forget(info MessageInfo) {
+	if p.dedup == nil {
+		return
+	}
+	if err := p.dedup.Delete(messageKey(info)); err != nil {
+		log.Error().Err(err).Str("key", info.Key).Msg("Failed to remove content hash")
+	}
+}
+
+func messageKey(info MessageInfo) string {
+	return info.Topic + "|" + info.Key
+}
+
+func requestLine(e models.BundleEntry) string {
+	if e.Request == nil {
+		return ""
+	}
+	return e.Request.Method.Code() + " " + e.Request.Url
+}
+
+func entryKey(e models.BundleEntry) string {
+	if e.FullUrl != nil {
+		return *e.FullUrl
+	}
+	if e.Request != nil {
+		return e.Request.Url
+	}
+	return ""
+}
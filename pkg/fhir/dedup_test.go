@@ -0,0 +1,108 @@
+package fhir
+
+import (
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProcessMessageDedup(t *testing.T) {
+	cases := []struct {
+		name     string
+		scope    string
+		payloads []string
+		sent     []int
+		// bodies are sent unchanged
+		unchanged bool
+	}{
+		{
+			name:  "key unchanged",
+			scope: "key",
+			payloads: []string{
+				`{"resourceType": "Bundle","type": "batch","entry": [{"fullUrl": "Patient/1","resource": {"resourceType": "Patient","id": "1"},"request": {"method": "PUT", "url": "Patient/1"}}]}`,
+				`{"resourceType": "Bundle","type": "batch","entry": [{"fullUrl": "Patient/1","resource": {"resourceType": "Patient","id": "1"},"request": {"method": "PUT", "url": "Patient/1"}}]}`,
+				`{"resourceType": "Bundle","type": "batch","entry": [{"fullUrl": "Patient/1","resource": {"resourceType": "Patient","id": "1","gender": "other"},"request": {"method": "PUT", "url": "Patient/1"}}]}`,
+			},
+			sent: []int{1, 0, 1},
+		},
+		{
+			name:  "entry unchanged",
+			scope: "entry",
+			payloads: []string{
+				`{"resourceType": "Bundle","type": "batch","entry": [{"fullUrl": "Patient/1","resource": {"resourceType": "Patient","id": "1"},"request": {"method": "PUT", "url": "Patient/1"}}]}`,
+				`{"resourceType": "Bundle","type": "batch","entry": [{"fullUrl": "Patient/1","resource": {"resourceType": "Patient","id": "1"},"request": {"method": "PUT", "url": "Patient/1"}},{"fullUrl": "Patient/2","resource": {"resourceType": "Patient","id": "2"},"request": {"method": "PUT", "url": "Patient/2"}}]}`,
+				`{"resourceType": "Bundle","type": "batch","entry": [{"fullUrl": "Patient/2","resource": {"resourceType": "Patient","id": "2"},"request": {"method": "PUT", "url": "Patient/2"}}]}`,
+			},
+			sent: []int{1, 1, 0},
+		},
+		{
+			name:  "entry scope transaction",
+			scope: "entry",
+			payloads: []string{
+				`{"resourceType": "Bundle","type": "transaction","entry": [{"fullUrl": "urn:uuid:1","resource": {"resourceType": "Patient"},"request": {"method": "POST", "url": "Patient"}},{"fullUrl": "urn:uuid:2","resource": {"resourceType": "Observation","subject": {"reference": "urn:uuid:1"}},"request": {"method": "POST", "url": "Observation"}}]}`,
+				`{"resourceType": "Bundle","type": "transaction","entry": [{"fullUrl": "urn:uuid:1","resource": {"resourceType": "Patient"},"request": {"method": "POST", "url": "Patient"}},{"fullUrl": "urn:uuid:2","resource": {"resourceType": "Observation","status": "final","subject": {"reference": "urn:uuid:1"}},"request": {"method": "POST", "url": "Observation"}}]}`,
+				`{"resourceType": "Bundle","type": "transaction","entry": [{"fullUrl": "urn:uuid:1","resource": {"resourceType": "Patient"},"request": {"method": "POST", "url": "Patient"}},{"fullUrl": "urn:uuid:2","resource": {"resourceType": "Observation","status": "final","subject": {"reference": "urn:uuid:1"}},"request": {"method": "POST", "url": "Observation"}}]}`,
+			},
+			sent:      []int{1, 1, 0},
+			unchanged: true,
+		},
+		{
+			name:      "entry scope xml",
+			scope:     "entry",
+			payloads:  []string{xmlBundle, xmlBundle},
+			sent:      []int{1, 0},
+			unchanged: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			baseUrl := "https://dummy-url/fhir"
+			p := NewProcessor(config.Fhir{
+				Server: config.Server{BaseUrl: baseUrl},
+				Dedup:  config.Dedup{Enabled: true, Path: filepath.Join(t.TempDir(), "dedup.db"), Scope: c.scope},
+			})
+			defer p.Close()
+
+			// set up mock
+			httpmock.Reset()
+			httpmock.ActivateNonDefault(p.client.rest.GetClient())
+			var bodies []string
+			httpmock.RegisterResponder("POST", baseUrl, func(req *http.Request) (*http.Response, error) {
+				b, _ := io.ReadAll(req.Body)
+				bodies = append(bodies, string(b))
+				return httpmock.NewStringResponse(200, `{"type": "batch-response", "entry": [{"response": {"status": "200"}}], "resourceType": "Bundle"}`), nil
+			})
+
+			testTopic := "test"
+			for i, payload := range c.payloads {
+				calls := httpmock.GetTotalCallCount()
+
+				ok := p.ProcessMessage(&source.Message{
+					Origin: source.Origin{Topic: testTopic, Offset: int64(i)},
+					Value:  []byte(payload),
+					Key:    []byte("test"),
+				})
+
+				assert.True(t, ok)
+				assert.Equal(t, c.sent[i], httpmock.GetTotalCallCount()-calls, "message %d", i)
+			}
+
+			if c.unchanged {
+				for i, body := range bodies {
+					assert.Equal(t, strings.TrimSpace(strings.TrimPrefix(c.payloads[i], `<?xml version="1.0" encoding="UTF-8"?>`)), body)
+				}
+			} else if c.scope == "entry" {
+				// only the changed entry is sent
+				assert.NotContains(t, bodies[1], `"Patient/1"`)
+				assert.Contains(t, bodies[1], `"Patient/2"`)
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package fhir
+
+import (
+	"errors"
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dependencies parks messages whose references cannot be resolved yet, e.g.
+// Observations of patients which are loaded from another topic. Parked
+// messages of dependent topics are retried after one of the topics they depend
+// on has progressed. With the reference policy "hold", parked messages are
+// also retried after the hold wait time. Later messages with the key of a
+// parked message are parked behind it. Offsets are not stored past parked
+// messages
+type Dependencies struct {
+	config config.Dependencies
+	// topics maps lower case topics to the lower case topics they depend on
+	topics map[string][]string
+	// hold parks messages of all topics for up to HoldRetries checks, if set
+	hold *config.References
+	now  func() time.Time
+
+	mu sync.Mutex
+	// number of processed messages by topic
+	progress map[string]int64
+	parked   map[string][]*parkedMessage
+	// number of parked messages by topic and key
+	keys map[topicKey]int
+	// last processed message by topic partition
+	last map[partitionKey]*source.Message
+	// first park time and number of checks of parked messages
+	attempts map[offsetKey]*attempt
+}
+
+type parkedMessage struct {
+	msg      *source.Message
+	info     MessageInfo
+	since    time.Time
+	retryAt  time.Time
+	progress map[string]int64
+}
+
+type attempt struct {
+	since time.Time
+	count int
+}
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+type offsetKey struct {
+	topic     string
+	partition int32
+	offset    int64
+}
+
+type topicKey struct {
+	topic string
+	key   string
+}
+
+func NewDependencies(config config.Dependencies, references config.References) *Dependencies {
+	// keys of configuration maps are lower case
+	topics := make(map[string][]string)
+	for topic, dependencies := range config.Topics {
+		for _, t := range dependencies {
+			topics[strings.ToLower(topic)] = append(topics[strings.ToLower(topic)], strings.ToLower(t))
+		}
+	}
+	hold := &references
+	if references.Policy != "hold" {
+		hold = nil
+	}
+
+	return &Dependencies{
+		config:   config,
+		topics:   topics,
+		hold:     hold,
+		now:      time.Now,
+		progress: make(map[string]int64),
+		parked:   make(map[string][]*parkedMessage),
+		keys:     make(map[topicKey]int),
+		last:     make(map[partitionKey]*source.Message),
+		attempts: make(map[offsetKey]*attempt),
+	}
+}
+
+// park adds the message to the retry queue of its topic, if the topic has
+// dependencies or messages are held. Messages parked longer than the maximum
+// wait time, held messages exceeding their retries and messages exceeding the
+// queue size are not parked. Messages behind a parked message of their key are
+// parked regardless
+func (d *Dependencies) park(msg *source.Message, info MessageInfo, behind bool) bool {
+	topic := strings.ToLower(info.Topic)
+	dependencies := d.topics[topic]
+	if len(dependencies) == 0 && d.hold == nil {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	parked := d.parked[topic]
+	a := &attempt{since: now}
+	if !behind {
+		key := offsetKey{topic, info.Partition, info.Offset}
+		if previous, ok := d.attempts[key]; ok {
+			a = previous
+		}
+		a.count++
+		expired := len(dependencies) > 0 && now.Sub(a.since) > d.config.MaxWait
+		if len(dependencies) == 0 {
+			expired = a.count > d.hold.HoldRetries
+		}
+		if expired || (d.config.MaxParked > 0 && len(parked) >= d.config.MaxParked) {
+			delete(d.attempts, key)
+			return false
+		}
+		d.attempts[key] = a
+	}
+
+	progress := make(map[string]int64)
+	for _, t := range dependencies {
+		progress[t] = d.progress[t]
+	}
+	var retryAt time.Time
+	if d.hold != nil {
+		retryAt = now.Add(d.hold.HoldWait)
+	}
+	d.parked[topic] = append(parked, &parkedMessage{msg: msg, info: info, since: a.since, retryAt: retryAt, progress: progress})
+	if info.Key != "" {
+		d.keys[topicKey{topic, info.Key}]++
+	}
+	return true
+}
+
+// behind checks if a message with the key of the message is parked
+func (d *Dependencies) behind(info MessageInfo) bool {
+	if info.Key == "" {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.keys[topicKey{strings.ToLower(info.Topic), info.Key}] > 0
+}
+
+// due removes and returns the parked messages of the topic, whose dependency
+// topics have progressed since they were parked, whose hold wait time elapsed
+// or which exceeded the maximum wait time. The first parked message of a key
+// decides for the later ones, so they keep their order
+func (d *Dependencies) due(topic string) []*source.Message {
+	topic = strings.ToLower(topic)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	decided := make(map[string]bool)
+	var due []*source.Message
+	var remaining []*parkedMessage
+	for _, p := range d.parked[topic] {
+		progressed, ok := decided[p.info.Key]
+		if !ok || p.info.Key == "" {
+			progressed = len(p.progress) > 0 && now.Sub(p.since) > d.config.MaxWait
+			progressed = progressed || (d.hold != nil && !now.Before(p.retryAt))
+			for t, count := range p.progress {
+				progressed = progressed || d.progress[t] > count
+			}
+			decided[p.info.Key] = progressed
+		}
+
+		if !progressed {
+			remaining = append(remaining, p)
+			continue
+		}
+		due = append(due, p.msg)
+		if p.info.Key != "" {
+			key := topicKey{topic, p.info.Key}
+			if d.keys[key]--; d.keys[key] == 0 {
+				delete(d.keys, key)
+			}
+		}
+	}
+	d.parked[topic] = remaining
+	return due
+}
+
+// processed records a successfully processed message
+func (d *Dependencies) processed(info MessageInfo, msg *source.Message) {
+	topic := strings.ToLower(info.Topic)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.progress[topic]++
+	delete(d.attempts, offsetKey{topic, info.Partition, info.Offset})
+	key := partitionKey{topic, info.Partition}
+	if last, ok := d.last[key]; !ok || last.Origin.Offset < msg.Origin.Offset {
+		d.last[key] = msg
+	}
+}
+
+// stored returns the message whose offset can be stored for the message's
+// partition: the message itself or the message before the first parked one
+func (d *Dependencies) stored(msg *source.Message) *source.Message {
+	info := NewMessageInfo(msg)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	first := msg.Origin.Offset + 1
+	for _, p := range d.parked[strings.ToLower(info.Topic)] {
+		if p.info.Partition == info.Partition && p.msg.Origin.Offset < first {
+			first = p.msg.Origin.Offset
+		}
+	}
+	if first > msg.Origin.Offset {
+		return msg
+	}
+
+	stored := *msg
+	stored.Origin.Offset = first - 1
+	return &stored
+}
+
+// Stored returns the message to acknowledge after the message was processed,
+// which is the message before the first parked one of its partition, if any.
+// Offsets are not stored past parked messages
+func (p *Processor) Stored(msg *source.Message) *source.Message {
+	if p.dependencies == nil {
+		return msg
+	}
+	return p.dependencies.stored(msg)
+}
+
+// RetryParked processes the due parked messages of the topic. It returns the
+// messages to acknowledge afterward and false, if a message failed
+func (p *Processor) RetryParked(topic string) ([]*source.Message, bool) {
+	if p.dependencies == nil {
+		return nil, true
+	}
+
+	partitions := make(map[int32]bool)
+	for _, msg := range p.dependencies.due(topic) {
+		log.Debug().
+			Str("topic", topic).
+			Str("key", string(msg.Key)).
+			Int64("offset", msg.Origin.Offset).
+			Msg("Retrying parked message")
+		if !p.ProcessMessage(msg) {
+			return nil, false
+		}
+		partitions[msg.Origin.Partition] = true
+	}
+
+	var stored []*source.Message
+	p.dependencies.mu.Lock()
+	for partition := range partitions {
+		if last, ok := p.dependencies.last[partitionKey{strings.ToLower(topic), partition}]; ok {
+			stored = append(stored, last)
+		}
+	}
+	p.dependencies.mu.Unlock()
+
+	for i, msg := range stored {
+		stored[i] = p.dependencies.stored(msg)
+	}
+	return stored, true
+}
+
+// processed records the message as processed for dependent topics
+func (p *Processor) processed(info MessageInfo, msg *source.Message) {
+	if p.dependencies != nil {
+		p.dependencies.processed(info, msg)
+	}
+}
+
+// park parks the message, if it failed due to dangling references
+func (p *Processor) park(msg *source.Message, info MessageInfo, err error) bool {
+	var dangling *DanglingReferencesError
+	if p.dependencies == nil || !errors.As(err, &dangling) || !p.dependencies.park(msg, info, false) {
+		return false
+	}
+
+	log.Info().
+		Str("topic", info.Topic).
+		Str("key", info.Key).
+		Int64("offset", info.Offset).
+		Strs("references", dangling.References).
+		Msg("Message parked until its references can be resolved")
+	return true
+}
+
+// parkBehind parks the message, if a message with its key is parked. Otherwise,
+// an older version of the resource could overwrite this one
+func (p *Processor) parkBehind(msg *source.Message, info MessageInfo) bool {
+	if p.dependencies == nil || !p.dependencies.behind(info) || !p.dependencies.park(msg, info, true) {
+		return false
+	}
+
+	log.Info().
+		Str("topic", info.Topic).
+		Str("key", info.Key).
+		Int64("offset", info.Offset).
+		Msg("Message parked behind a parked message of its key")
+	return true
+}
+
+// DanglingReferencesError is returned for messages with references which can
+// be resolved neither in their bundle nor on the server. Such messages are
+// sent to the dead letter queue, if not parked
+type DanglingReferencesError struct {
+	References []string
+}
+
+func (e *DanglingReferencesError) Error() string {
+	return "dangling references: " + strings.Join(e.References, ", ")
+}
+
+func (e *DanglingReferencesError) Unwrap() error {
+	return &DeadLetterError{Reason: e.Error()}
+}
@@ -0,0 +1,183 @@
+package fhir
+
+import (
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newDependenciesTestProcessor() *Processor {
+	baseUrl := "https://dummy-url/fhir"
+	p := NewProcessor(config.Fhir{
+		Server:       config.Server{BaseUrl: baseUrl},
+		References:   config.References{Enabled: true, Policy: "reject", Lookup: true},
+		Dependencies: config.Dependencies{Topics: map[string][]string{"lab-fhir": {"person-fhir"}}, MaxWait: time.Hour},
+	})
+
+	httpmock.Reset()
+	httpmock.ActivateNonDefault(p.client.rest.GetClient())
+	httpmock.RegisterResponder("POST", baseUrl, httpmock.NewStringResponder(200,
+		`{"type": "batch-response", "entry": [{"response": {"status": "200"}}], "resourceType": "Bundle"}`))
+	// the patient exists after the person topic progressed
+	httpmock.RegisterResponder("GET", baseUrl+"/Patient", httpmock.ResponderFromMultipleResponses([]*http.Response{
+		httpmock.NewStringResponse(200, `{"resourceType": "Bundle","type": "searchset","total": 0}`),
+		httpmock.NewStringResponse(200, `{"resourceType": "Bundle","type": "searchset","total": 1}`),
+	}))
+	return p
+}
+
+func testMessage(topic string, offset int64, value string) *source.Message {
+	return &source.Message{
+		Origin: source.Origin{Topic: topic, Offset: int64(offset)},
+		Value:  []byte(value),
+	}
+}
+
+func TestProcessMessageParked(t *testing.T) {
+	p := newDependenciesTestProcessor()
+
+	observation := testMessage("lab-fhir", 5, `{"resourceType": "Observation","id": "o1","subject": {"reference": "Patient/p1"}}`)
+	assert.True(t, p.ProcessMessage(observation))
+	assert.Equal(t, 0, httpmock.GetCallCountInfo()["POST https://dummy-url/fhir"])
+
+	// offsets are not stored past the parked message
+	next := testMessage("lab-fhir", 6, `{"resourceType": "Observation","id": "o2"}`)
+	assert.True(t, p.ProcessMessage(next))
+	assert.Equal(t, int64(4), p.Stored(next).Origin.Offset)
+
+	// not due before the person topic progressed
+	stored, ok := p.RetryParked("lab-fhir")
+	assert.True(t, ok)
+	assert.Empty(t, stored)
+
+	assert.True(t, p.ProcessMessage(testMessage("person-fhir", 1, `{"resourceType": "Patient","id": "p1"}`)))
+
+	stored, ok = p.RetryParked("lab-fhir")
+	assert.True(t, ok)
+	assert.Equal(t, []*source.Message{next}, stored)
+	assert.Equal(t, 3, httpmock.GetCallCountInfo()["POST https://dummy-url/fhir"])
+	assert.Equal(t, next, p.Stored(next))
+}
+
+func TestProcessMessageParkedExpired(t *testing.T) {
+	p := newDependenciesTestProcessor()
+	now := time.Now()
+	p.dependencies.now = func() time.Time { return now }
+
+	observation := testMessage("lab-fhir", 5, `{"resourceType": "Observation","id": "o1","subject": {"reference": "Patient/p1"}}`)
+	assert.True(t, p.ProcessMessage(observation))
+
+	// still dangling after the maximum wait time, without dead letter queue
+	httpmock.RegisterResponder("GET", "https://dummy-url/fhir/Patient",
+		httpmock.NewStringResponder(200, `{"resourceType": "Bundle","type": "searchset","total": 0}`))
+	now = now.Add(2 * time.Hour)
+
+	_, ok := p.RetryParked("lab-fhir")
+	assert.False(t, ok)
+}
+
+func TestProcessMessageParkedBehind(t *testing.T) {
+	p := newDependenciesTestProcessor()
+
+	first := testMessage("lab-fhir", 5, `{"resourceType": "Observation","id": "o1","subject": {"reference": "Patient/p1"}}`)
+	first.Key = []byte("o1")
+	assert.True(t, p.ProcessMessage(first))
+
+	// the newer version must not be overwritten by the parked one
+	second := testMessage("lab-fhir", 6, `{"resourceType": "Observation","id": "o1","status": "final"}`)
+	second.Key = []byte("o1")
+	assert.True(t, p.ProcessMessage(second))
+	other := testMessage("lab-fhir", 7, `{"resourceType": "Observation","id": "o2"}`)
+	other.Key = []byte("o2")
+	assert.True(t, p.ProcessMessage(other))
+	assert.Equal(t, 1, httpmock.GetCallCountInfo()["POST https://dummy-url/fhir"])
+	assert.Equal(t, int64(4), p.Stored(other).Origin.Offset)
+
+	assert.True(t, p.ProcessMessage(testMessage("person-fhir", 1, `{"resourceType": "Patient","id": "p1"}`)))
+
+	stored, ok := p.RetryParked("lab-fhir")
+	assert.True(t, ok)
+	assert.Equal(t, []*source.Message{other}, stored)
+	assert.Equal(t, 4, httpmock.GetCallCountInfo()["POST https://dummy-url/fhir"])
+	assert.Empty(t, p.dependencies.keys)
+}
+
+func TestProcessMessageParkedTopicCase(t *testing.T) {
+	baseUrl := "https://dummy-url/fhir"
+	p := NewProcessor(config.Fhir{
+		Server:       config.Server{BaseUrl: baseUrl},
+		References:   config.References{Enabled: true, Policy: "reject", Lookup: true},
+		Dependencies: config.Dependencies{Topics: map[string][]string{"lab-fhir": {"Person-FHIR"}}, MaxWait: time.Hour},
+	})
+
+	httpmock.Reset()
+	httpmock.ActivateNonDefault(p.client.rest.GetClient())
+	httpmock.RegisterResponder("GET", baseUrl+"/Patient",
+		httpmock.NewStringResponder(200, `{"resourceType": "Bundle","type": "searchset","total": 0}`))
+
+	observation := testMessage("Lab-FHIR", 5, `{"resourceType": "Observation","id": "o1","subject": {"reference": "Patient/p1"}}`)
+	assert.True(t, p.ProcessMessage(observation))
+	assert.Len(t, p.dependencies.parked["lab-fhir"], 1)
+	assert.Equal(t, map[string]int64{"person-fhir": 0}, p.dependencies.parked["lab-fhir"][0].progress)
+}
+
+func newHoldTestProcessor(now *time.Time) *Processor {
+	baseUrl := "https://dummy-url/fhir"
+	p := NewProcessor(config.Fhir{
+		Server:     config.Server{BaseUrl: baseUrl},
+		References: config.References{Enabled: true, Policy: "hold", Lookup: true, HoldWait: 10 * time.Second, HoldRetries: 1},
+	})
+	p.dependencies.now = func() time.Time { return *now }
+
+	httpmock.Reset()
+	httpmock.ActivateNonDefault(p.client.rest.GetClient())
+	httpmock.RegisterResponder("POST", baseUrl, httpmock.NewStringResponder(200,
+		`{"type": "batch-response", "entry": [{"response": {"status": "200"}}], "resourceType": "Bundle"}`))
+	return p
+}
+
+func TestProcessMessageHeld(t *testing.T) {
+	now := time.Now()
+	p := newHoldTestProcessor(&now)
+	// the patient is loaded by another producer in the meantime
+	httpmock.RegisterResponder("GET", "https://dummy-url/fhir/Patient", httpmock.ResponderFromMultipleResponses([]*http.Response{
+		httpmock.NewStringResponse(200, `{"resourceType": "Bundle","type": "searchset","total": 0}`),
+		httpmock.NewStringResponse(200, `{"resourceType": "Bundle","type": "searchset","total": 1}`),
+	}))
+
+	observation := testMessage("lab-fhir", 5, `{"resourceType": "Observation","id": "o1","subject": {"reference": "Patient/p1"}}`)
+	assert.True(t, p.ProcessMessage(observation))
+	assert.Equal(t, 0, httpmock.GetCallCountInfo()["POST https://dummy-url/fhir"])
+
+	// not due before the hold wait time elapsed
+	stored, ok := p.RetryParked("lab-fhir")
+	assert.True(t, ok)
+	assert.Empty(t, stored)
+
+	now = now.Add(10 * time.Second)
+	stored, ok = p.RetryParked("lab-fhir")
+	assert.True(t, ok)
+	assert.Equal(t, []*source.Message{observation}, stored)
+	assert.Equal(t, 1, httpmock.GetCallCountInfo()["POST https://dummy-url/fhir"])
+}
+
+func TestProcessMessageHeldExpired(t *testing.T) {
+	now := time.Now()
+	p := newHoldTestProcessor(&now)
+	httpmock.RegisterResponder("GET", "https://dummy-url/fhir/Patient",
+		httpmock.NewStringResponder(200, `{"resourceType": "Bundle","type": "searchset","total": 0}`))
+
+	observation := testMessage("lab-fhir", 5, `{"resourceType": "Observation","id": "o1","subject": {"reference": "Patient/p1"}}`)
+	assert.True(t, p.ProcessMessage(observation))
+
+	// still dangling after the retries, without dead letter queue
+	now = now.Add(10 * time.Second)
+	_, ok := p.RetryParked("lab-fhir")
+	assert.False(t, ok)
+	// initial check and retry
+	assert.Equal(t, 2, httpmock.GetCallCountInfo()["GET https://dummy-url/fhir/Patient"])
+}
@@ -0,0 +1,125 @@
+package fhir
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// ValidationReport counts the validated resources and the issues of the
+// server's $validate operation by resource type
+type ValidationReport struct {
+	mu        sync.Mutex
+	validated map[string]int
+	// issue counts by resource type and [severity]/[code]
+	issues map[string]map[string]int
+	// messages which would be sent to the dead letter queue by reason
+	deadLetters map[string]int
+}
+
+func NewValidationReport() *ValidationReport {
+	return &ValidationReport{validated: make(map[string]int), issues: make(map[string]map[string]int),
+		deadLetters: make(map[string]int)}
+}
+
+func (r *ValidationReport) add(resourceType string, outcome models.OperationOutcome) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.validated[resourceType]++
+	for _, issue := range outcome.Issue {
+		if issue.Severity == models.IssueSeverityInformation {
+			continue
+		}
+		if r.issues[resourceType] == nil {
+			r.issues[resourceType] = make(map[string]int)
+		}
+		r.issues[resourceType][issue.Severity.Code()+"/"+issue.Code.Code()]++
+	}
+}
+
+func (r *ValidationReport) deadLetter(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.deadLetters[reason]++
+}
+
+// Log logs the counts of each resource type and of the dead letters
+func (r *ValidationReport) Log() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.deadLetters) > 0 {
+		deadLetters := zerolog.Dict()
+		for reason, count := range r.deadLetters {
+			deadLetters.Int(reason, count)
+		}
+		log.Info().Dict("dead-letters", deadLetters).Msg("Validation report")
+	}
+	if len(r.validated) == 0 {
+		log.Info().Msg("Validation report: no resources validated")
+		return
+	}
+	for _, resourceType := range slices.Sorted(maps.Keys(r.validated)) {
+		issues := zerolog.Dict()
+		for code, count := range r.issues[resourceType] {
+			issues.Int(code, count)
+		}
+		log.Info().
+			Str("resource-type", resourceType).
+			Int("validated", r.validated[resourceType]).
+			Dict("issues", issues).
+			Msg("Validation report")
+	}
+}
+
+// Report returns the validation report of the dry run or nil, if dry run is
+// disabled
+func (p *Processor) Report() *ValidationReport {
+	return p.report
+}
+
+// validate sends the payload's resources to the $validate operation of the
+// target server instead of storing them
+func (p *Processor) validate(payload *Payload, info MessageInfo) error {
+	client, err := p.target(info)
+	if err != nil {
+		return err
+	}
+	headers := info.propagated(p.headers.Propagate)
+
+	// XML bundles are validated as a whole
+	if payload.IsXml() && payload.Type == BundlePayload {
+		outcome, err := client.Validate("Bundle", payload.raw, payload.ContentType, headers)
+		if err != nil {
+			return err
+		}
+		p.report.add("Bundle", outcome)
+		return nil
+	}
+
+	for i, e := range payload.Bundle.Entry {
+		if e.Resource == nil {
+			continue
+		}
+		var resource struct {
+			ResourceType string `json:"resourceType"`
+		}
+		if err = json.Unmarshal(e.Resource, &resource); err != nil || resource.ResourceType == "" {
+			return fmt.Errorf("missing resource type of entry %d", i)
+		}
+
+		outcome, err := client.Validate(resource.ResourceType, payload.EntryBody(i), payload.ContentType, headers)
+		if err != nil {
+			return err
+		}
+		p.report.add(resource.ResourceType, outcome)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package fhir
+
+import (
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestProcessMessageDryRun(t *testing.T) {
+	baseUrl := "https://dummy-url/fhir"
+	p := NewProcessor(config.Fhir{
+		Server:    config.Server{BaseUrl: baseUrl},
+		Tombstone: config.Tombstone{Mode: "delete", KeyPattern: `^(?P<type>[A-Za-z]+)/(?P<id>[A-Za-z0-9\-.]{1,64})$`},
+		DryRun:    config.DryRun{Enabled: true},
+	})
+
+	httpmock.Reset()
+	httpmock.ActivateNonDefault(p.client.rest.GetClient())
+	httpmock.RegisterResponder("POST", baseUrl+"/Patient/$validate", httpmock.NewStringResponder(200,
+		`{"resourceType": "OperationOutcome","issue": [{"severity": "information","code": "informational"}]}`))
+	httpmock.RegisterResponder("POST", baseUrl+"/Observation/$validate", httpmock.NewStringResponder(400,
+		`{"resourceType": "OperationOutcome","issue": [{"severity": "error","code": "required"},{"severity": "error","code": "required"},
+		{"severity": "warning","code": "code-invalid"}]}`))
+
+	testTopic := "test"
+	messages := []*source.Message{
+		{Value: []byte(`{"resourceType": "Bundle","type": "batch","entry": [{"resource": {"resourceType": "Patient","id": "1"}},
+			{"resource": {"resourceType": "Observation","id": "2"}}]}`)},
+		{Value: []byte(`{"resourceType": "Observation","id": "3"}`)},
+		{Key: []byte("Patient/1")},
+	}
+	for _, msg := range messages {
+		msg.Origin = source.Origin{Topic: testTopic}
+		assert.True(t, p.ProcessMessage(msg))
+	}
+
+	// nothing is stored or deleted
+	assert.Equal(t, 3, httpmock.GetTotalCallCount())
+	assert.Equal(t, map[string]int{"Patient": 1, "Observation": 2}, p.Report().validated)
+	assert.Equal(t, map[string]map[string]int{
+		"Observation": {"error/required": 4, "warning/code-invalid": 2},
+	}, p.Report().issues)
+}
+
+func TestProcessMessageDryRunFailed(t *testing.T) {
+	baseUrl := "https://dummy-url/fhir"
+	p := NewProcessor(config.Fhir{Server: config.Server{BaseUrl: baseUrl}, DryRun: config.DryRun{Enabled: true}})
+
+	httpmock.Reset()
+	httpmock.ActivateNonDefault(p.client.rest.GetClient())
+	httpmock.RegisterResponder("POST", baseUrl+"/Patient/$validate", httpmock.NewStringResponder(503, `unavailable`))
+
+	testTopic := "test"
+	ok := p.ProcessMessage(&source.Message{
+		Origin: source.Origin{Topic: testTopic},
+		Value:  []byte(`{"resourceType": "Patient","id": "1"}`),
+	})
+
+	assert.False(t, ok)
+	assert.Empty(t, p.Report().validated)
+}
+
+func TestProcessMessageDryRunDeadLetter(t *testing.T) {
+	baseUrl := "https://dummy-url/fhir"
+	p := NewProcessor(config.Fhir{Server: config.Server{BaseUrl: baseUrl}, DryRun: config.DryRun{Enabled: true}})
+	p.transformers = []Transformer{deadLetterTransformer{}}
+	queue := &testDeadLetterQueue{}
+	p.SetDeadLetterQueue(queue)
+
+	httpmock.Reset()
+	httpmock.ActivateNonDefault(p.client.rest.GetClient())
+
+	ok := p.ProcessMessage(&source.Message{
+		Origin: source.Origin{Topic: "test"},
+		Value:  []byte(`{"resourceType": "Observation","id": "1"}`),
+	})
+
+	// nothing is produced to the dead letter topic
+	assert.True(t, ok)
+	assert.Empty(t, queue.reasons)
+	assert.Equal(t, 0, httpmock.GetTotalCallCount())
+	assert.Equal(t, map[string]int{"unmapped": 1}, p.Report().deadLetters)
+}
@@ -0,0 +1,146 @@
+package fhir
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var comparison = regexp.MustCompile(`^([A-Za-z0-9_.]+)\s*(!=|=)\s*(.+)$`)
+
+// Predicate is a boolean expression on a resource. It supports a subset of
+// FHIRPath: simple paths with exists(), empty() and not(), equality (=, !=)
+// against string, number and boolean literals, combined by "and" / "or"
+type Predicate func(resource Resource) bool
+
+func ParsePredicate(expr string) (Predicate, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return func(Resource) bool { return true }, nil
+	}
+
+	if parts := splitUnquoted(expr, " or "); len(parts) > 1 {
+		return combine(parts, false)
+	}
+	if parts := splitUnquoted(expr, " and "); len(parts) > 1 {
+		return combine(parts, true)
+	}
+
+	if inner, ok := strings.CutSuffix(expr, ".not()"); ok {
+		p, err := ParsePredicate(inner)
+		if err != nil {
+			return nil, err
+		}
+		return func(r Resource) bool { return !p(r) }, nil
+	}
+	if path, ok := strings.CutSuffix(expr, ".exists()"); ok {
+		return func(r Resource) bool { return len(evaluate(r, path)) > 0 }, nil
+	}
+	if path, ok := strings.CutSuffix(expr, ".empty()"); ok {
+		return func(r Resource) bool { return len(evaluate(r, path)) == 0 }, nil
+	}
+
+	if m := comparison.FindStringSubmatch(expr); m != nil {
+		path, operator := m[1], m[2]
+		literal, err := parseLiteral(strings.TrimSpace(m[3]))
+		if err != nil {
+			return nil, err
+		}
+		return func(r Resource) bool {
+			found := false
+			for _, v := range evaluate(r, path) {
+				found = found || fmt.Sprint(v) == literal
+			}
+			return found == (operator == "=")
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported expression: %s", expr)
+}
+
+// splitUnquoted splits the expression at the separator outside of string
+// literals. Quotes are escaped by a backslash within literals
+func splitUnquoted(expr, sep string) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(expr); i++ {
+		switch {
+		case quoted && expr[i] == '\\':
+			i++
+		case expr[i] == '\'':
+			quoted = !quoted
+		case !quoted && strings.HasPrefix(expr[i:], sep):
+			parts = append(parts, expr[start:i])
+			start = i + len(sep)
+			i = start - 1
+		}
+	}
+	return append(parts, expr[start:])
+}
+
+func combine(parts []string, all bool) (Predicate, error) {
+	predicates := make([]Predicate, 0, len(parts))
+	for _, part := range parts {
+		p, err := ParsePredicate(part)
+		if err != nil {
+			return nil, err
+		}
+		predicates = append(predicates, p)
+	}
+
+	return func(r Resource) bool {
+		for _, p := range predicates {
+			if p(r) != all {
+				return !all
+			}
+		}
+		return all
+	}, nil
+}
+
+func parseLiteral(literal string) (string, error) {
+	if strings.HasPrefix(literal, "'") {
+		if len(literal) < 2 || !strings.HasSuffix(literal, "'") {
+			return "", fmt.Errorf("unterminated string literal: %s", literal)
+		}
+		return strings.ReplaceAll(literal[1:len(literal)-1], "\\'", "'"), nil
+	}
+	return literal, nil
+}
+
+// evaluate returns all values at the dot separated path. Arrays are traversed
+// implicitly. A leading resource type is ignored
+func evaluate(resource Resource, path string) []interface{} {
+	segments := strings.Split(path, ".")
+	if len(segments) > 0 && segments[0] == resource.Type() {
+		segments = segments[1:]
+	}
+
+	values := []interface{}{map[string]interface{}(resource)}
+	for _, s := range segments {
+		var next []interface{}
+		for _, v := range values {
+			if m, ok := v.(map[string]interface{}); ok {
+				next = append(next, flatten(m[s])...)
+			}
+		}
+		values = next
+	}
+	return values
+}
+
+func flatten(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		var values []interface{}
+		for _, e := range v {
+			values = append(values, flatten(e)...)
+		}
+		return values
+	default:
+		return []interface{}{v}
+	}
+}
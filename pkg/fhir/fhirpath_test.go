@@ -0,0 +1,53 @@
+package fhir
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParsePredicate(t *testing.T) {
+	var resource Resource
+	_ = json.Unmarshal([]byte(`{"resourceType": "Observation","status": "final","valueQuantity": {"value": 5},
+		"code": {"coding": [{"system": "http://loinc.org","code": "718-7"},{"system": "http://local","code": "hb"}]}}`), &resource)
+
+	cases := []struct {
+		name     string
+		expr     string
+		expected bool
+	}{
+		{"empty", "", true},
+		{"exists", "status.exists()", true},
+		{"existsNested", "code.coding.code.exists()", true},
+		{"existsMissing", "subject.exists()", false},
+		{"emptyMissing", "subject.empty()", true},
+		{"not", "status.exists().not()", false},
+		{"equals", "status = 'final'", true},
+		{"equalsTypePrefix", "Observation.status = 'final'", true},
+		{"notEquals", "status != 'final'", false},
+		{"equalsAnyCoding", "code.coding.system = 'http://local'", true},
+		{"equalsNumber", "valueQuantity.value = 5", true},
+		{"and", "status = 'final' and subject.exists()", false},
+		{"or", "status = 'final' or subject.exists()", true},
+		{"quotedAnd", "status = 'final and amended'", false},
+		{"quotedOr", "status = 'draft or final' or status = 'final'", true},
+		{"escapedQuote", "status = 'it\\'s final'", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p, err := ParsePredicate(c.expr)
+
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, p(resource))
+		})
+	}
+}
+
+func TestParsePredicateInvalid(t *testing.T) {
+	_, err := ParsePredicate("status.where(code = 'x')")
+	assert.Error(t, err)
+
+	_, err = ParsePredicate("status = 'final")
+	assert.Error(t, err)
+}
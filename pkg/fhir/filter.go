@@ -3,10 +3,15 @@ package fhir
 import (
 	"encoding/json"
 	"fhir-to-server/pkg/config"
-	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
 	"time"
 )
 
+// Filter decides whether a message is processed. Messages which don't pass a
+// filter are skipped
+type Filter interface {
+	Apply(payload *Payload, msg MessageInfo) bool
+}
+
 type DateFilter struct {
 	Date       time.Time
 	Comparator func(t time.Time) bool
@@ -56,15 +61,26 @@ type DateTimeResource struct {
 }
 
 func (f *DateFilter) apply(fhirData []byte) bool {
-	bundle, err := models.UnmarshalBundle(fhirData)
-	check(err)
+	payload, err := ParsePayload(fhirData, "")
+	if err != nil {
+		check(err)
+		return false
+	}
+
+	return f.applyPayload(payload)
+}
+
+func (f *DateFilter) Apply(payload *Payload, _ MessageInfo) bool {
+	return f.applyPayload(payload)
+}
 
-	for _, e := range bundle.Entry {
+func (f *DateFilter) applyPayload(payload *Payload) bool {
+	for _, resource := range payload.Resources() {
 		var r DateTimeResource
-		err = json.Unmarshal(e.Resource, &r)
+		err := json.Unmarshal(resource, &r)
 		check(err)
 
-		if *r.Type == "Patient" || *r.Type == "Consent" {
+		if r.Type != nil && (*r.Type == "Patient" || *r.Type == "Consent") {
 			return true
 		}
 
@@ -18,6 +18,7 @@ func TestApply(t *testing.T) {
 		"Procedure.recordedDate skip":              testApplyFilterSkipProcedureRecorded,
 		"Encounter.Period valid":                   testApplyFilterValidEncounterPeriod,
 		"Condition.period valid inclusive":         testApplyFilterValidConditionInclusive,
+		"Observation resource skip":                testApplyFilterSkipObservationResource,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			fn(t)
@@ -147,6 +148,22 @@ func testApplyFilterValidConditionInclusive(t *testing.T) {
 		"to pass the filter (Date: %s, Comparator: %s) but it didn't", conf.Value, conf.Comparator)
 }
 
+func testApplyFilterSkipObservationResource(t *testing.T) {
+	t.Parallel()
+	conf := config.DateConfig{Value: createTime("2018-03-01"), Comparator: ">"}
+	f := NewDateFilter(conf)
+	testResource := []byte(`
+{
+  "resourceType": "Observation",
+  "effectiveDateTime": "2017-12-24T18:00:00+01:00"
+}
+`)
+
+	passed := f.apply(testResource)
+	assert.Falsef(t, passed, "Expected resource (Observation.effectiveDateTime: 2017-12-24T18:00:00+01:00) "+
+		"to be skipped by the filter (Date: %s, Comparator: %s) but it wasn't", conf.Value, conf.Comparator)
+}
+
 func createTime(value string) *time.Time {
 	t, _ := time.ParseInLocation("2006-01-02", value, loc)
 	return &t
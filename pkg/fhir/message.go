@@ -0,0 +1,52 @@
+package fhir
+
+import (
+	"fhir-to-server/pkg/source"
+	"strings"
+)
+
+// MessageInfo holds the metadata of a consumed message. It is available to
+// filters and transformers
+type MessageInfo struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       string
+	// Headers by lower case key
+	Headers map[string]string
+}
+
+func NewMessageInfo(msg *source.Message) MessageInfo {
+	info := MessageInfo{
+		Topic:     msg.Origin.Topic,
+		Partition: msg.Origin.Partition,
+		Offset:    msg.Origin.Offset,
+		Key:       string(msg.Key),
+		Headers:   make(map[string]string),
+	}
+	for _, h := range msg.Headers {
+		info.Headers[strings.ToLower(h.Key)] = string(h.Value)
+	}
+
+	return info
+}
+
+// Header returns the value of the header with the given name (case-insensitive)
+// or an empty string, if the name is empty or the header is missing
+func (m MessageInfo) Header(name string) string {
+	if name == "" {
+		return ""
+	}
+	return m.Headers[strings.ToLower(name)]
+}
+
+// propagated returns the headers with the given names which are present
+func (m MessageInfo) propagated(names []string) map[string]string {
+	headers := make(map[string]string)
+	for _, name := range names {
+		if value := m.Header(name); value != "" {
+			headers[name] = value
+		}
+	}
+	return headers
+}
@@ -0,0 +1,103 @@
+package fhir
+
+import (
+	"fhir-to-server/pkg/config"
+	"fmt"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"slices"
+	"time"
+)
+
+// MetaStamper sets meta.source to the Kafka origin of a message and adds
+// configured meta.tag codings and meta.profile entries to each resource. Existing
+// meta elements are kept
+type MetaStamper struct {
+	config  config.Meta
+	appName string
+	now     func() time.Time
+}
+
+func NewMetaStamper(config config.Meta, appName string) *MetaStamper {
+	return &MetaStamper{config: config, appName: appName, now: time.Now}
+}
+
+// Source returns the Kafka origin of the message
+func Source(msg MessageInfo) string {
+	return fmt.Sprintf("kafka://%s/%d/%d", msg.Topic, msg.Partition, msg.Offset)
+}
+
+func (m *MetaStamper) Transform(payload *Payload, msg MessageInfo) error {
+	tags := m.tags(msg)
+
+	return transformEntries(payload, func(_ *models.BundleEntry, resource Resource) (bool, error) {
+		if resource == nil {
+			return true, nil
+		}
+
+		meta, ok := resource["meta"].(map[string]interface{})
+		if !ok {
+			meta = make(map[string]interface{})
+			resource["meta"] = meta
+		}
+
+		if m.config.Source {
+			meta["source"] = Source(msg)
+		}
+		if len(tags) > 0 {
+			meta["tag"] = mergeTags(meta["tag"], tags)
+		}
+		if len(m.config.Profiles) > 0 {
+			meta["profile"] = mergeProfiles(meta["profile"], m.config.Profiles)
+		}
+		return true, nil
+	})
+}
+
+// tags returns the configured tag codings for the message
+func (m *MetaStamper) tags(msg MessageInfo) []map[string]interface{} {
+	var tags []map[string]interface{}
+	for _, tag := range m.config.Tags {
+		var code string
+		switch tag {
+		case "loader":
+			code = m.appName
+		case "topic":
+			code = msg.Topic
+		case "load-date":
+			code = m.now().Format(time.DateOnly)
+		default:
+			continue
+		}
+		tags = append(tags, map[string]interface{}{"system": m.config.TagSystem + "/" + tag, "code": code})
+	}
+	return tags
+}
+
+// mergeTags replaces existing tags with the same system and appends new ones
+func mergeTags(existing interface{}, tags []map[string]interface{}) []interface{} {
+	merged, _ := existing.([]interface{})
+	for _, tag := range tags {
+		replaced := false
+		for i, e := range merged {
+			if coding, ok := e.(map[string]interface{}); ok && coding["system"] == tag["system"] {
+				merged[i] = tag
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, tag)
+		}
+	}
+	return merged
+}
+
+// mergeProfiles appends profiles which are not present
+func mergeProfiles(existing interface{}, profiles []string) []interface{} {
+	merged, _ := existing.([]interface{})
+	for _, profile := range profiles {
+		if !slices.Contains(merged, interface{}(profile)) {
+			merged = append(merged, profile)
+		}
+	}
+	return merged
+}
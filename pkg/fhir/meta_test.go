@@ -0,0 +1,50 @@
+package fhir
+
+import (
+	"encoding/json"
+	"fhir-to-server/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMetaStamperTransform(t *testing.T) {
+	m := NewMetaStamper(config.Meta{
+		Source:    true,
+		TagSystem: "https://fhir.diz.uni-marburg.de/CodeSystem/fhir-to-server",
+		Tags:      []string{"loader", "topic", "load-date"},
+		Profiles:  []string{"https://example.org/StructureDefinition/Patient"},
+	}, "fhir-to-server")
+	m.now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+
+	payload, _ := ParsePayload([]byte(`{"resourceType": "Bundle","type": "batch","entry": [
+		{"resource": {"resourceType": "Patient","meta": {"versionId": "1","source": "producer","profile": ["https://example.org/StructureDefinition/Patient"],
+			"tag": [{"system": "https://other/tag","code": "x"},{"system": "https://fhir.diz.uni-marburg.de/CodeSystem/fhir-to-server/topic","code": "old"}]}}},
+		{"resource": {"resourceType": "Observation"}}
+	]}`), "")
+
+	err := m.Transform(payload, MessageInfo{Topic: "person-fhir", Partition: 2, Offset: 42})
+	assert.NoError(t, err)
+
+	var patient, observation struct {
+		Meta map[string]interface{} `json:"meta"`
+	}
+	_ = json.Unmarshal(payload.Bundle.Entry[0].Resource, &patient)
+	_ = json.Unmarshal(payload.Bundle.Entry[1].Resource, &observation)
+
+	// existing meta is merged
+	assert.Equal(t, "1", patient.Meta["versionId"])
+	assert.Equal(t, "kafka://person-fhir/2/42", patient.Meta["source"])
+	assert.Equal(t, []interface{}{"https://example.org/StructureDefinition/Patient"}, patient.Meta["profile"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"system": "https://other/tag", "code": "x"},
+		map[string]interface{}{"system": "https://fhir.diz.uni-marburg.de/CodeSystem/fhir-to-server/topic", "code": "person-fhir"},
+		map[string]interface{}{"system": "https://fhir.diz.uni-marburg.de/CodeSystem/fhir-to-server/loader", "code": "fhir-to-server"},
+		map[string]interface{}{"system": "https://fhir.diz.uni-marburg.de/CodeSystem/fhir-to-server/load-date", "code": "2024-05-01"},
+	}, patient.Meta["tag"])
+
+	// meta is created
+	assert.Equal(t, "kafka://person-fhir/2/42", observation.Meta["source"])
+	assert.Len(t, observation.Meta["tag"], 3)
+	assert.Equal(t, []interface{}{"https://example.org/StructureDefinition/Patient"}, observation.Meta["profile"])
+}
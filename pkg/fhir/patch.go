@@ -0,0 +1,161 @@
+package fhir
+
+import (
+	"encoding/json"
+	"fhir-to-server/pkg/config"
+	"fmt"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"strings"
+)
+
+// PatchTransformer applies configured patch operations to resources selected
+// by resource type and predicate
+type PatchTransformer struct {
+	rules []patchRule
+}
+
+type patchRule struct {
+	config config.PatchRule
+	where  Predicate
+	// values of the operations, in order
+	values []interface{}
+}
+
+func NewPatchTransformer(rules []config.PatchRule) (*PatchTransformer, error) {
+	t := &PatchTransformer{}
+	for _, r := range rules {
+		where, err := ParsePredicate(r.Where)
+		if err != nil {
+			return nil, err
+		}
+		rule := patchRule{config: r, where: where}
+		for _, op := range r.Operations {
+			if err = validateOperation(op); err != nil {
+				return nil, err
+			}
+			rule.values = append(rule.values, patchValue(op.Value))
+		}
+		t.rules = append(t.rules, rule)
+	}
+	return t, nil
+}
+
+func validateOperation(op config.PatchOperation) error {
+	if op.Path == "" {
+		return fmt.Errorf("missing path of %s operation", op.Op)
+	}
+	switch op.Op {
+	case "set":
+		if op.Value == "" || patchValue(op.Value) == nil {
+			return fmt.Errorf("missing value of set operation: %s", op.Path)
+		}
+		return nil
+	case "remove", "replace-coding":
+		return nil
+	case "rename":
+		if op.To == "" {
+			return fmt.Errorf("missing target of rename operation: %s", op.Path)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported patch operation: %s", op.Op)
+	}
+}
+
+func (t *PatchTransformer) Transform(payload *Payload, _ MessageInfo) error {
+	return transformEntries(payload, func(_ *models.BundleEntry, resource Resource) (bool, error) {
+		if resource == nil {
+			return true, nil
+		}
+		for _, r := range t.rules {
+			if r.config.ResourceType != "" && r.config.ResourceType != resource.Type() {
+				continue
+			}
+			if !r.where(resource) {
+				continue
+			}
+			for i, op := range r.config.Operations {
+				applyOperation(resource, op, r.values[i])
+			}
+		}
+		return true, nil
+	})
+}
+
+// patchValue decodes a JSON value. Other values are plain strings
+func patchValue(value string) interface{} {
+	d := json.NewDecoder(strings.NewReader(value))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil || d.More() {
+		return value
+	}
+	return v
+}
+
+func applyOperation(resource Resource, op config.PatchOperation, value interface{}) {
+	segments := strings.Split(op.Path, ".")
+	if segments[0] == resource.Type() {
+		segments = segments[1:]
+	}
+	parentPath, key := segments[:len(segments)-1], segments[len(segments)-1]
+
+	for _, parent := range parents(map[string]interface{}(resource), parentPath, op.Op == "set") {
+		switch op.Op {
+		case "set":
+			parent[key] = value
+		case "remove":
+			delete(parent, key)
+		case "rename":
+			if v, ok := parent[key]; ok {
+				delete(parent, key)
+				parent[op.To] = v
+			}
+		case "replace-coding":
+			for _, c := range flatten(parent[key]) {
+				if coding, ok := c.(map[string]interface{}); ok {
+					replaceCoding(coding, op)
+				}
+			}
+		}
+	}
+}
+
+// parents returns the objects at the path. Missing objects are created, if
+// create is set
+func parents(element map[string]interface{}, path []string, create bool) []map[string]interface{} {
+	if len(path) == 0 {
+		return []map[string]interface{}{element}
+	}
+
+	next, ok := element[path[0]]
+	if !ok && create {
+		next = make(map[string]interface{})
+		element[path[0]] = next
+	}
+
+	var result []map[string]interface{}
+	for _, v := range flatten(next) {
+		if m, ok := v.(map[string]interface{}); ok {
+			result = append(result, parents(m, path[1:], create)...)
+		}
+	}
+	return result
+}
+
+// replaceCoding replaces system and code of a matching coding
+func replaceCoding(coding map[string]interface{}, op config.PatchOperation) {
+	if op.System != "" && coding["system"] != op.System {
+		return
+	}
+	if op.Code != "" && coding["code"] != op.Code {
+		return
+	}
+
+	if op.NewSystem != "" {
+		coding["system"] = op.NewSystem
+	}
+	if op.NewCode != "" {
+		coding["code"] = op.NewCode
+	}
+}
@@ -0,0 +1,103 @@
+package fhir
+
+import (
+	"encoding/json"
+	"fhir-to-server/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPatchTransformerTransform(t *testing.T) {
+	p, err := NewPatchTransformer([]config.PatchRule{
+		{
+			ResourceType: "Observation",
+			Where:        "status.empty()",
+			Operations:   []config.PatchOperation{{Op: "set", Path: "status", Value: "final"}},
+		},
+		{
+			ResourceType: "Observation",
+			Operations: []config.PatchOperation{
+				{Op: "replace-coding", Path: "code.coding", System: "http://loinc.org/", NewSystem: "http://loinc.org"},
+				{Op: "rename", Path: "valueString", To: "valueCode"},
+				{Op: "remove", Path: "meta.security"},
+				{Op: "set", Path: "category.text", Value: "laboratory"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	payload, _ := ParsePayload([]byte(`{"resourceType": "Bundle","type": "batch","entry": [
+		{"resource": {"resourceType": "Observation","meta": {"security": [{"code": "x"}]},"category": [{"coding": []},{}],
+			"code": {"coding": [{"system": "http://loinc.org/","code": "718-7"},{"system": "http://local","code": "hb"}]},"valueString": "pos"}},
+		{"resource": {"resourceType": "Observation","status": "preliminary"}},
+		{"resource": {"resourceType": "Patient"}}
+	]}`), "")
+
+	err = p.Transform(payload, MessageInfo{})
+	assert.NoError(t, err)
+
+	var first, second, patient map[string]interface{}
+	_ = json.Unmarshal(payload.Bundle.Entry[0].Resource, &first)
+	_ = json.Unmarshal(payload.Bundle.Entry[1].Resource, &second)
+	_ = json.Unmarshal(payload.Bundle.Entry[2].Resource, &patient)
+
+	assert.Equal(t, "final", first["status"])
+	assert.Equal(t, map[string]interface{}{"coding": []interface{}{
+		map[string]interface{}{"system": "http://loinc.org", "code": "718-7"},
+		map[string]interface{}{"system": "http://local", "code": "hb"},
+	}}, first["code"])
+	assert.Equal(t, "pos", first["valueCode"])
+	assert.NotContains(t, first, "valueString")
+	assert.Equal(t, map[string]interface{}{}, first["meta"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"coding": []interface{}{}, "text": "laboratory"},
+		map[string]interface{}{"text": "laboratory"},
+	}, first["category"])
+
+	// status is only set, if missing
+	assert.Equal(t, "preliminary", second["status"])
+	// rules are restricted to their resource type
+	assert.Equal(t, map[string]interface{}{"resourceType": "Patient"}, patient)
+}
+
+func TestPatchTransformerJsonValue(t *testing.T) {
+	p, err := NewPatchTransformer([]config.PatchRule{{
+		ResourceType: "Observation",
+		Operations: []config.PatchOperation{
+			{Op: "set", Path: "valueQuantity", Value: `{"value": 1.5, "unitCode": "mg"}`},
+			{Op: "set", Path: "note.text", Value: `"1"`},
+		},
+	}})
+	assert.NoError(t, err)
+
+	payload, _ := ParsePayload([]byte(`{"resourceType": "Observation","note": [{}]}`), "")
+	err = p.Transform(payload, MessageInfo{})
+	assert.NoError(t, err)
+
+	var resource map[string]interface{}
+	_ = json.Unmarshal(payload.Bundle.Entry[0].Resource, &resource)
+
+	assert.Equal(t, map[string]interface{}{"value": 1.5, "unitCode": "mg"}, resource["valueQuantity"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"text": "1"}}, resource["note"])
+}
+
+func TestNewPatchTransformerInvalid(t *testing.T) {
+	cases := []struct {
+		name string
+		rule config.PatchRule
+	}{
+		{"where", config.PatchRule{Where: "status.matches('x')"}},
+		{"op", config.PatchRule{Operations: []config.PatchOperation{{Op: "move", Path: "status"}}}},
+		{"path", config.PatchRule{Operations: []config.PatchOperation{{Op: "remove"}}}},
+		{"rename", config.PatchRule{Operations: []config.PatchOperation{{Op: "rename", Path: "status"}}}},
+		{"setMissingValue", config.PatchRule{Operations: []config.PatchOperation{{Op: "set", Path: "status"}}}},
+		{"setNull", config.PatchRule{Operations: []config.PatchOperation{{Op: "set", Path: "status", Value: "null"}}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := NewPatchTransformer([]config.PatchRule{c.rule})
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package fhir
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fhir-to-server/pkg/dedup"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"strings"
+)
+
+type PayloadType int
+
+const (
+	BundlePayload PayloadType = iota
+	ResourcePayload
+	NdjsonPayload
+)
+
+func (t PayloadType) String() string {
+	switch t {
+	case ResourcePayload:
+		return "resource"
+	case NdjsonPayload:
+		return "ndjson"
+	default:
+		return "bundle"
+	}
+}
+
+// Payload is the parsed content of a message: a bundle, a single resource or
+// newline delimited resources (NDJSON). Single resources are represented as
+// bundle entries with a request to create or update them
+type Payload struct {
+	Type        PayloadType
+	ContentType string
+	Bundle      models.Bundle
+	raw         []byte
+	// modified payloads are sent as JSON bundle
+	modified bool
+	// content hashes to record after successful processing
+	records []dedup.Record
+}
+
+// ParsePayload parses JSON or XML content. The content type is sniffed from
+// the data, if it is empty
+func ParsePayload(data []byte, contentType string) (*Payload, error) {
+	data = bytes.TrimSpace(data)
+
+	if strings.Contains(contentType, "xml") || (contentType == "" && isXml(data)) {
+		return parseXmlPayload(data)
+	}
+
+	var r ResourceTypeDto
+	if err := json.Unmarshal(data, &r); err != nil {
+		if bytes.ContainsRune(data, '\n') {
+			return parseNdjson(data)
+		}
+		return nil, err
+	}
+	if r.Type == nil {
+		return nil, errors.New("missing resourceType")
+	}
+
+	if *r.Type == "Bundle" {
+		bundle, err := models.UnmarshalBundle(data)
+		if err != nil {
+			return nil, err
+		}
+		return &Payload{Type: BundlePayload, ContentType: JsonContentType, Bundle: bundle, raw: data}, nil
+	}
+
+	entry, err := resourceEntry(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Payload{
+		Type:        ResourcePayload,
+		ContentType: JsonContentType,
+		Bundle:      models.Bundle{Type: models.BundleTypeBatch, Entry: []models.BundleEntry{entry}},
+		raw:         data,
+	}, nil
+}
+
+func parseNdjson(data []byte) (*Payload, error) {
+	p := &Payload{
+		Type:        NdjsonPayload,
+		ContentType: JsonContentType,
+		Bundle:      models.Bundle{Type: models.BundleTypeBatch},
+		raw:         data,
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		entry, err := resourceEntry(bytes.Clone(line))
+		if err != nil {
+			return nil, err
+		}
+		p.Bundle.Entry = append(p.Bundle.Entry, entry)
+	}
+
+	return p, scanner.Err()
+}
+
+// resourceEntry creates a batch entry for the resource: an update, if the
+// resource has an id, otherwise a create
+func resourceEntry(resource []byte) (models.BundleEntry, error) {
+	var r struct {
+		Type *string `json:"resourceType"`
+		Id   *string `json:"id"`
+	}
+	if err := json.Unmarshal(resource, &r); err != nil {
+		return models.BundleEntry{}, err
+	}
+	if r.Type == nil || *r.Type == "Bundle" {
+		return models.BundleEntry{}, errors.New("invalid resourceType for single resource")
+	}
+
+	request := &models.BundleEntryRequest{Method: models.HTTPVerbPOST, Url: *r.Type}
+	if r.Id != nil {
+		request = &models.BundleEntryRequest{Method: models.HTTPVerbPUT, Url: *r.Type + "/" + *r.Id}
+	}
+
+	return models.BundleEntry{Resource: resource, Request: request}, nil
+}
+
+// Resources returns the resources of all entries
+func (p *Payload) Resources() []json.RawMessage {
+	resources := make([]json.RawMessage, 0, len(p.Bundle.Entry))
+	for _, e := range p.Bundle.Entry {
+		if e.Resource != nil {
+			resources = append(resources, e.Resource)
+		}
+	}
+	return resources
+}
+
+// IsXml checks if the payload's content is FHIR XML
+func (p *Payload) IsXml() bool {
+	return p.ContentType == XmlContentType
+}
+
+// Bytes returns the payload as a bundle to be sent. Bundles are returned
+// unchanged, resources are wrapped in a batch bundle
+func (p *Payload) Bytes() ([]byte, error) {
+	switch {
+	case p.modified:
+		return p.Bundle.MarshalJSON()
+	case p.Type == BundlePayload:
+		return p.raw, nil
+	case p.IsXml():
+		return wrapXmlResource(p.raw, p.Bundle.Entry[0].Request), nil
+	default:
+		return p.Bundle.MarshalJSON()
+	}
+}
+
+// EntryBody returns the resource of the entry at index i in the payload's
+// content type
+func (p *Payload) EntryBody(i int) []byte {
+	if p.IsXml() && p.Type == ResourcePayload && !p.modified {
+		return p.raw
+	}
+	return p.Bundle.Entry[i].Resource
+}
+
+// SetEntries replaces the payload's entries. The payload is sent as FHIR
+// JSON afterward
+func (p *Payload) SetEntries(entries []models.BundleEntry) {
+	p.Bundle.Entry = entries
+	p.ContentType = JsonContentType
+	p.modified = true
+}
+
+// toDelete replaces the payload's entries by requests to delete their
+// resources
+func (p *Payload) toDelete() error {
+	entries := make([]models.BundleEntry, 0, len(p.Bundle.Entry))
+	for _, e := range p.Bundle.Entry {
+		url, err := resourceUrl(e)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, models.BundleEntry{
+			Request: &models.BundleEntryRequest{Method: models.HTTPVerbDELETE, Url: url},
+		})
+	}
+	p.SetEntries(entries)
+
+	return nil
+}
+
+// resourceUrl returns the relative url ([type]/[id]) of the entry's resource or
+// the conditional url of its update request
+func resourceUrl(e models.BundleEntry) (string, error) {
+	var r struct {
+		Type *string `json:"resourceType"`
+		Id   *string `json:"id"`
+	}
+	if e.Resource != nil {
+		if err := json.Unmarshal(e.Resource, &r); err != nil {
+			return "", err
+		}
+	}
+
+	switch {
+	case r.Type != nil && r.Id != nil:
+		return *r.Type + "/" + *r.Id, nil
+	case e.Request != nil && e.Request.Method == models.HTTPVerbPUT:
+		return e.Request.Url, nil
+	case e.Request != nil && e.Request.Method == models.HTTPVerbDELETE:
+		return e.Request.Url, nil
+	default:
+		return "", errors.New("unable to determine resource url of entry")
+	}
+}
@@ -0,0 +1,83 @@
+package fhir
+
+import (
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParsePayload(t *testing.T) {
+	cases := []struct {
+		name         string
+		data         string
+		expectedType PayloadType
+		requests     []string
+	}{
+		{
+			name:         "bundle",
+			data:         `{"resourceType": "Bundle","type": "batch","entry": [{"resource": {"resourceType": "Patient"},"request": {"method": "PUT", "url": "Patient/1"}}]}`,
+			expectedType: BundlePayload,
+			requests:     []string{"PUT Patient/1"},
+		},
+		{
+			name:         "resource with id",
+			data:         `{"resourceType": "Observation","id": "42","status": "final"}`,
+			expectedType: ResourcePayload,
+			requests:     []string{"PUT Observation/42"},
+		},
+		{
+			name:         "resource without id",
+			data:         `{"resourceType": "Observation","status": "final"}`,
+			expectedType: ResourcePayload,
+			requests:     []string{"POST Observation"},
+		},
+		{
+			name: "ndjson",
+			data: `{"resourceType": "Patient","id": "1"}
+{"resourceType": "Observation","id": "2"}
+
+`,
+			expectedType: NdjsonPayload,
+			requests:     []string{"PUT Patient/1", "PUT Observation/2"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p, err := ParsePayload([]byte(c.data), "")
+
+			assert.NoError(t, err)
+			assert.Equal(t, c.expectedType, p.Type)
+			assert.Len(t, p.Resources(), len(c.requests))
+
+			var requests []string
+			for _, e := range p.Bundle.Entry {
+				requests = append(requests, e.Request.Method.Code()+" "+e.Request.Url)
+			}
+			assert.Equal(t, c.requests, requests)
+		})
+	}
+}
+
+func TestParsePayloadInvalid(t *testing.T) {
+	for _, data := range []string{
+		`invalid`,
+		`{"id": "1"}`,
+		"{\"resourceType\": \"Patient\"}\n{\"resourceType\": \"Bundle\"}",
+	} {
+		_, err := ParsePayload([]byte(data), "")
+		assert.Error(t, err, data)
+	}
+}
+
+func TestPayloadBytes(t *testing.T) {
+	p, _ := ParsePayload([]byte(`{"resourceType": "Patient","id": "1"}`), "")
+
+	b, err := p.Bytes()
+	assert.NoError(t, err)
+
+	bundle, err := models.UnmarshalBundle(b)
+	assert.NoError(t, err)
+	assert.Equal(t, models.BundleTypeBatch, bundle.Type)
+	assert.Len(t, bundle.Entry, 1)
+}
@@ -1,58 +1,440 @@
 package fhir
 
 import (
+	"errors"
+	"fhir-to-server/pkg/codec"
 	"fhir-to-server/pkg/config"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"fhir-to-server/pkg/dedup"
+	"fhir-to-server/pkg/source"
+	"fmt"
 	"github.com/rs/zerolog/log"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"net/http"
+	"strings"
 )
 
 type Processor struct {
-	client *Client
-	filter *DateFilter
+	client       *Client
+	targets      map[string]*Client
+	decoder      *codec.Decoder
+	deserializer codec.Deserializer
+	filters      []Filter
+	transformers []Transformer
+	tombstone    *TombstoneHandler
+	provenance   *ProvenanceBuilder
+	dedup        *dedup.Store
+	dedupScope   string
+	headers      config.Headers
+	batch        config.Batch
+	resourceMode string
+	deadLetters  DeadLetterQueue
+	report       *ValidationReport
+	dependencies *Dependencies
 }
 
 func NewProcessor(config config.Fhir) *Processor {
-	var filter *DateFilter
-	if config.Filter.Date.Value == nil {
-		filter = nil
-	} else {
-		filter = NewDateFilter(config.Filter.Date)
+	deserializer, err := codec.NewDeserializer(config.Deserializer)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid deserializer configuration")
+	}
+
+	switch config.Prefer {
+	case "", "minimal", "representation", "OperationOutcome":
+	default:
+		log.Fatal().Str("prefer", config.Prefer).Msg("Invalid return preference")
+	}
+
+	var decoder *codec.Decoder
+	if config.Decoding.Enabled {
+		if decoder, err = codec.NewDecoder(config.Decoding); err != nil {
+			log.Fatal().Err(err).Msg("Invalid decoding configuration")
+		}
+	}
+
+	var filters []Filter
+	if config.Filter.Date.Value != nil {
+		filters = append(filters, NewDateFilter(config.Filter.Date))
+	}
+
+	var transformers []Transformer
+	if len(config.Transformations) > 0 {
+		patch, err := NewPatchTransformer(config.Transformations)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid transformation configuration")
+		}
+		transformers = append(transformers, patch)
+	}
+	if config.ConceptMap.Enabled {
+		mapper, err := NewConceptMapper(config.ConceptMap)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", config.ConceptMap.Path).Msg("Unable to load concept maps")
+		}
+		transformers = append(transformers, mapper)
+	}
+	if config.Pseudonymization.Enabled {
+		pseudonymizer, err := NewPseudonymizer(config.Pseudonymization)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Unable to create pseudonymization transformer")
+		}
+		transformers = append(transformers, pseudonymizer)
+	}
+	if config.Meta.Enabled {
+		transformers = append(transformers, NewMetaStamper(config.Meta, config.AppName))
+	}
+	if config.Validation.Enabled {
+		validator, err := NewValidator(config.Validation)
+		if err != nil {
+			log.Fatal().Err(err).Str("profiles", config.Validation.Profiles).Msg("Unable to load profiles")
+		}
+		transformers = append(transformers, validator)
+	}
+	var references *ReferenceChecker
+	if config.References.Enabled {
+		if config.References.Policy == "hold" && !config.References.Lookup {
+			log.Fatal().Msg("Reference policy 'hold' requires lookup of references")
+		}
+		references = NewReferenceChecker(config.References)
+		transformers = append(transformers, references)
+	}
+	// messages with dangling references are parked for dependent topics and
+	// the policy hold
+	var dependencies *Dependencies
+	hold := config.References.Enabled && config.References.Policy == "hold"
+	if len(config.Dependencies.Topics) > 0 {
+		// messages are parked for dangling references only, which the policy reorder ignores
+		if !config.References.Enabled || !config.References.Lookup ||
+			(config.References.Policy != "reject" && config.References.Policy != "hold") {
+			log.Fatal().Msg("Topic dependencies require reference checks with lookup and policy 'reject' or 'hold'")
+		}
+	}
+	if len(config.Dependencies.Topics) > 0 || hold {
+		dependencies = NewDependencies(config.Dependencies, config.References)
+	}
+	var provenance *ProvenanceBuilder
+	if config.Provenance.Enabled {
+		provenance = NewProvenanceBuilder(config.Provenance, config.AppName)
+		if !provenance.separate() {
+			transformers = append(transformers, provenance)
+		}
+	}
+
+	// additional target servers by lower case name, like configuration keys
+	targets := make(map[string]*Client)
+	for name, server := range config.Targets {
+		targetConfig := config
+		targetConfig.Server = server
+		targets[strings.ToLower(name)] = NewClient(targetConfig)
+	}
+
+	var tombstone *TombstoneHandler
+	if config.Tombstone.Mode == "delete" {
+		tombstone = NewTombstoneHandler(config.Tombstone)
+	}
+
+	// dry run validates resources without storing them
+	var report *ValidationReport
+	if config.DryRun.Enabled {
+		report = NewValidationReport()
+		tombstone = nil
+	}
+
+	var store *dedup.Store
+	if config.Dedup.Enabled && !config.DryRun.Enabled {
+		var err error
+		store, err = dedup.Open(config.Dedup)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", config.Dedup.Path).Msg("Unable to open deduplication store")
+		}
 	}
-	return &Processor{client: NewClient(config), filter: filter}
+
+	p := &Processor{
+		client:       NewClient(config),
+		targets:      targets,
+		decoder:      decoder,
+		deserializer: deserializer,
+		filters:      filters,
+		transformers: transformers,
+		tombstone:    tombstone,
+		provenance:   provenance,
+		dedup:        store,
+		dedupScope:   config.Dedup.Scope,
+		headers:      config.Headers,
+		batch:        config.Batch,
+		resourceMode: config.ResourceMode,
+		report:       report,
+		dependencies: dependencies,
+	}
+	if references != nil {
+		references.target = p.target
+	}
+	return p
 }
 
-func (p *Processor) ProcessMessage(msg *kafka.Message) bool {
+// ProcessMessage sends the message to the FHIR server and returns whether it
+// was processed. Failed messages are rejected with their error, successful
+// messages are acknowledged by the caller (see Stored)
+func (p *Processor) ProcessMessage(msg *source.Message) bool {
+	info := NewMessageInfo(msg)
 
-	if len(msg.Value) == 0 {
-		// tombstone record
-		log.Warn().
-			Str("topic", *msg.TopicPartition.Topic).
-			Str("key", string(msg.Key)).
-			Str("offset", msg.TopicPartition.Offset.String()).
-			Msg("Tombstone record encountered. Message ignored")
+	if p.parkBehind(msg, info) {
 		return true
 	}
 
-	// filter
-	if p.filter != nil && !p.filter.apply(msg.Value) {
-		// filtered, don't send but mark processed
+	if len(msg.Value) == 0 && p.tombstone != nil {
+		err := p.handleTombstone(info)
+		if err != nil {
+			log.Error().Err(err).
+				Str("topic", info.Topic).
+				Str("key", info.Key).
+				Int64("offset", info.Offset).
+				Msg("Failed to process tombstone record")
+			msg.Nack(err)
+			return false
+		}
+		p.processed(info, msg)
 		return true
 	}
 
-	success := p.client.Send(msg.Value)
-	if success {
-		log.Debug().
-			Str("topic", *msg.TopicPartition.Topic).
-			Str("key", string(msg.Key)).
-			Str("offset", msg.TopicPartition.Offset.String()).
-			Msg("Successfully processed message")
+	payload, err := p.prepare(msg, info)
+	if err != nil {
+		if p.park(msg, info, err) {
+			return true
+		}
+		if err = p.deadLetter(msg, info, err); err == nil {
+			p.processed(info, msg)
+			return true
+		}
+	}
+	if err == nil && payload == nil {
+		// skipped, don't send but mark processed
+		p.processed(info, msg)
 		return true
 	}
 
-	log.Error().
-		Str("topic", *msg.TopicPartition.Topic).
-		Str("key", string(msg.Key)).
-		Str("offset", msg.TopicPartition.Offset.String()).
+	if err == nil {
+		if err = p.send(payload, info); err == nil {
+			p.commit(payload, info)
+			p.processed(info, msg)
+			log.Debug().
+				Str("topic", info.Topic).
+				Str("key", info.Key).
+				Int64("offset", info.Offset).
+				Msg("Successfully processed message")
+			return true
+		}
+	}
+
+	log.Error().Err(err).
+		Str("topic", info.Topic).
+		Str("key", info.Key).
+		Int64("offset", info.Offset).
 		Msg("Failed to process message")
+	msg.Nack(err)
 	return false
 }
+
+// Submit processes the message like ProcessMessage, but returns the status
+// and body of the FHIR server's response instead of dead lettering or parking
+// failed messages. Messages failing before they are sent result in an
+// OperationOutcome
+func (p *Processor) Submit(msg *source.Message) (int, []byte) {
+	info := NewMessageInfo(msg)
+
+	payload, err := p.prepare(msg, info)
+	if err != nil {
+		log.Warn().Err(err).Str("topic", info.Topic).Str("key", info.Key).Msg("Submitted message rejected")
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			return http.StatusUnprocessableEntity, marshalOutcome(validationErr.Outcome)
+		}
+		return http.StatusBadRequest, errorOutcome(models.IssueTypeProcessing, err)
+	}
+	if payload == nil {
+		// skipped
+		return http.StatusNoContent, nil
+	}
+	if p.report != nil {
+		if err = p.validate(payload, info); err != nil {
+			return http.StatusBadGateway, errorOutcome(models.IssueTypeTransient, err)
+		}
+		return http.StatusAccepted, nil
+	}
+
+	client, err := p.target(info)
+	if err != nil {
+		return http.StatusBadRequest, errorOutcome(models.IssueTypeNotFound, err)
+	}
+	body, err := payload.Bytes()
+	if err != nil {
+		return http.StatusBadRequest, errorOutcome(models.IssueTypeProcessing, err)
+	}
+	status, response, err := client.Exchange(body, payload.ContentType, info.propagated(p.headers.Propagate))
+	if err != nil {
+		return http.StatusBadGateway, errorOutcome(models.IssueTypeTransient, err)
+	}
+
+	// failed requests are answered with the server's response, e.g. an OperationOutcome
+	if status < 200 || status >= 300 {
+		return status, response
+	}
+	locations, ok := parseResponse(response)
+	if !ok {
+		return status, response
+	}
+	if err = p.sendProvenance(client, client.relative(locations), info); err != nil {
+		return http.StatusBadGateway, errorOutcome(models.IssueTypeTransient, err)
+	}
+	p.commit(payload, info)
+	p.processed(info, msg)
+	return status, response
+}
+
+// errorOutcome returns an OperationOutcome of the error
+func errorOutcome(code models.IssueType, err error) []byte {
+	diagnostics := err.Error()
+	return marshalOutcome(models.OperationOutcome{Issue: []models.OperationOutcomeIssue{
+		{Severity: models.IssueSeverityError, Code: code, Diagnostics: &diagnostics},
+	}})
+}
+
+func marshalOutcome(outcome models.OperationOutcome) []byte {
+	data, _ := outcome.MarshalJSON()
+	return data
+}
+
+// prepare parses the payload of the message to be sent. The payload is nil,
+// if the message is skipped
+func (p *Processor) prepare(msg *source.Message, info MessageInfo) (*Payload, error) {
+	if len(msg.Value) == 0 {
+		// tombstone record
+		log.Warn().
+			Str("topic", info.Topic).
+			Str("key", info.Key).
+			Int64("offset", info.Offset).
+			Msg("Tombstone record encountered. Message ignored")
+		return nil, nil
+	}
+
+	value := msg.Value
+	var err error
+	if p.decoder != nil {
+		if value, err = p.decoder.Decode(value, info.Header(p.headers.ContentEncoding)); err != nil {
+			return nil, err
+		}
+	}
+	if p.deserializer != nil {
+		if value, err = p.deserializer.Deserialize(info.Topic, value); err != nil {
+			return nil, err
+		}
+	}
+
+	payload, err := ParsePayload(value, info.Header(p.headers.ContentType))
+	if err != nil {
+		return nil, err
+	}
+
+	// filter
+	for _, f := range p.filters {
+		if !f.Apply(payload, info) {
+			return nil, nil
+		}
+	}
+
+	// skip unchanged content (before transformations, which may add volatile data)
+	if ok, err := p.deduplicate(payload, info); !ok {
+		return nil, err
+	}
+
+	// transform
+	for _, t := range p.transformers {
+		if err = t.Transform(payload, info); err != nil {
+			return nil, err
+		}
+	}
+
+	// operation
+	switch operation := strings.ToLower(info.Header(p.headers.Operation)); operation {
+	case "":
+	case "delete":
+		if err = payload.toDelete(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported operation: %s", operation)
+	}
+
+	return payload, nil
+}
+
+// Transform applies the configured transformers to the data and returns the
+// transformed payload
+func (p *Processor) Transform(data []byte, info MessageInfo) ([]byte, error) {
+	payload, err := ParsePayload(data, "")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range p.transformers {
+		if err = t.Transform(payload, info); err != nil {
+			return nil, err
+		}
+	}
+	return payload.Bytes()
+}
+
+// Close releases the processor's resources
+func (p *Processor) Close() {
+	if p.dedup != nil {
+		check(p.dedup.Close())
+	}
+}
+
+// send sends bundles as they are. Single resources are either wrapped in a
+// batch bundle or sent as individual requests, depending on the resource mode.
+// In dry run mode, resources are validated instead
+func (p *Processor) send(payload *Payload, info MessageInfo) error {
+	if p.report != nil {
+		return p.validate(payload, info)
+	}
+
+	client, err := p.target(info)
+	if err != nil {
+		return err
+	}
+	headers := info.propagated(p.headers.Propagate)
+
+	var locations []string
+	if payload.Type != BundlePayload && p.resourceMode == "rest" {
+		for i, e := range payload.Bundle.Entry {
+			location, ok := client.SendResource(e.Request.Method.Code(), e.Request.Url, payload.EntryBody(i), payload.ContentType, headers)
+			if !ok {
+				return fmt.Errorf("failed to send resource: %s %s", e.Request.Method.Code(), e.Request.Url)
+			}
+			locations = append(locations, location)
+		}
+	} else {
+		body, err := payload.Bytes()
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if locations, ok = client.SendBundle(body, payload.ContentType, headers); !ok {
+			return fmt.Errorf("failed to send %s", payload.Type)
+		}
+	}
+
+	return p.sendProvenance(client, locations, info)
+}
+
+// target returns the client of the target server selected by the message's
+// target header or the default client
+func (p *Processor) target(info MessageInfo) (*Client, error) {
+	name := info.Header(p.headers.Target)
+	if name == "" {
+		return p.client, nil
+	}
+	if client, ok := p.targets[strings.ToLower(name)]; ok {
+		return client, nil
+	}
+	return nil, fmt.Errorf("unknown target server: %s", name)
+}
@@ -1,10 +1,15 @@
 package fhir
 
 import (
+	"encoding/json"
 	"fhir-to-server/pkg/config"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"fhir-to-server/pkg/source"
+	"github.com/hamba/avro/v2"
 	"github.com/jarcoal/httpmock"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -21,6 +26,18 @@ func TestProcessMessage(t *testing.T) {
 			resultOk: true,
 			wasSent:  true,
 		},
+		{
+			name:     "resource",
+			payload:  []byte(`{"resourceType": "Patient","id": "1"}`),
+			resultOk: true,
+			wasSent:  true,
+		},
+		{
+			name:     "invalid",
+			payload:  []byte(`invalid`),
+			resultOk: false,
+			wasSent:  false,
+		},
 		{
 			name:     "tombstone",
 			payload:  nil,
@@ -47,10 +64,10 @@ func TestProcessMessage(t *testing.T) {
 			httpmock.RegisterResponder("POST", baseUrl, responder)
 
 			testTopic := "test"
-			ok := p.ProcessMessage(&kafka.Message{
-				TopicPartition: kafka.TopicPartition{Topic: &testTopic, Offset: 42},
-				Value:          c.payload,
-				Key:            []byte("test"),
+			ok := p.ProcessMessage(&source.Message{
+				Origin: source.Origin{Topic: testTopic, Offset: 42},
+				Value:  c.payload,
+				Key:    []byte("test"),
 			})
 			assert.Equal(t, c.resultOk, ok, "Expected Kafka message to be processed ok: %s", c.resultOk)
 			assert.Equal(t, c.wasSent, httpmock.GetTotalCallCount() == 1)
@@ -58,3 +75,254 @@ func TestProcessMessage(t *testing.T) {
 
 	}
 }
+
+func TestProcessMessageRestMode(t *testing.T) {
+	baseUrl := "https://dummy-url/fhir"
+	p := NewProcessor(config.Fhir{Server: config.Server{BaseUrl: baseUrl}, ResourceMode: "rest"})
+
+	// set up mock
+	httpmock.Reset()
+	httpmock.ActivateNonDefault(p.client.rest.GetClient())
+	httpmock.RegisterResponder("PUT", baseUrl+"/Patient/1", httpmock.NewStringResponder(200, `{"resourceType": "Patient","id": "1"}`))
+	httpmock.RegisterResponder("POST", baseUrl+"/Observation", httpmock.NewStringResponder(201, `{"resourceType": "Observation","id": "2"}`))
+
+	testTopic := "test"
+	ok := p.ProcessMessage(&source.Message{
+		Origin: source.Origin{Topic: testTopic, Offset: 42},
+		Value:  []byte("{\"resourceType\": \"Patient\",\"id\": \"1\"}\n{\"resourceType\": \"Observation\"}"),
+		Key:    []byte("test"),
+	})
+
+	assert.True(t, ok)
+	assert.Equal(t, 2, httpmock.GetTotalCallCount())
+}
+
+func TestProcessMessageHeaders(t *testing.T) {
+	cases := []struct {
+		name     string
+		headers  []source.Header
+		url      string
+		method   string
+		resultOk bool
+	}{
+		{
+			name:     "default target",
+			url:      "https://default/fhir",
+			method:   "POST",
+			resultOk: true,
+		},
+		{
+			name:     "target",
+			headers:  []source.Header{{Key: "fhir-target", Value: []byte("research")}},
+			url:      "https://research/fhir",
+			method:   "POST",
+			resultOk: true,
+		},
+		{
+			name:     "mixed case target",
+			headers:  []source.Header{{Key: "fhir-target", Value: []byte("Research")}},
+			url:      "https://research/fhir",
+			method:   "POST",
+			resultOk: true,
+		},
+		{
+			name:     "unknown target",
+			headers:  []source.Header{{Key: "fhir-target", Value: []byte("unknown")}},
+			resultOk: false,
+		},
+		{
+			name:     "delete",
+			headers:  []source.Header{{Key: "FHIR-Operation", Value: []byte("DELETE")}},
+			url:      "https://default/fhir",
+			method:   "POST",
+			resultOk: true,
+		},
+		{
+			name:     "unsupported operation",
+			headers:  []source.Header{{Key: "fhir-operation", Value: []byte("patch")}},
+			resultOk: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := config.Fhir{
+				Server:  config.Server{BaseUrl: "https://default/fhir"},
+				Targets: map[string]config.Server{"research": {BaseUrl: "https://research/fhir"}},
+				Headers: config.Headers{
+					Target:    "fhir-target",
+					Operation: "fhir-operation",
+					Propagate: []string{"traceparent"},
+				},
+			}
+			p := NewProcessor(conf)
+
+			// set up mock
+			httpmock.Reset()
+			httpmock.ActivateNonDefault(p.client.rest.GetClient())
+			httpmock.ActivateNonDefault(p.targets["research"].rest.GetClient())
+			var body, traceparent string
+			responder := func(req *http.Request) (*http.Response, error) {
+				b, _ := io.ReadAll(req.Body)
+				body = string(b)
+				traceparent = req.Header.Get("traceparent")
+				return httpmock.NewStringResponse(200, `{"type": "batch-response", "entry": [{"response": {"status": "204"}}], "resourceType": "Bundle"}`), nil
+			}
+			httpmock.RegisterResponder("POST", "https://default/fhir", responder)
+			httpmock.RegisterResponder("POST", "https://research/fhir", responder)
+
+			testTopic := "test"
+			trace := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+			ok := p.ProcessMessage(&source.Message{
+				Origin:  source.Origin{Topic: testTopic, Offset: 42},
+				Value:   []byte(`{"resourceType": "Bundle","type": "batch","entry": [{"resource": {"resourceType": "Patient", "id": "1"},"request": {"method": "PUT", "url": "Patient/1"}}]}`),
+				Key:     []byte("test"),
+				Headers: append(c.headers, source.Header{Key: "traceparent", Value: []byte(trace)}),
+			})
+
+			assert.Equal(t, c.resultOk, ok)
+			if c.url == "" {
+				assert.Equal(t, 0, httpmock.GetTotalCallCount())
+				return
+			}
+			assert.Equal(t, 1, httpmock.GetCallCountInfo()[c.method+" "+c.url])
+			assert.Equal(t, trace, traceparent)
+			if c.name == "delete" {
+				assert.Contains(t, body, `"method":"DELETE","url":"Patient/1"`)
+				assert.NotContains(t, body, `"resource"`)
+			}
+		})
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	cases := []struct {
+		name     string
+		payload  []byte
+		code     int
+		resp     string
+		expected int
+		wasSent  bool
+	}{
+		{
+			name:     "success",
+			payload:  []byte(`{"resourceType": "Bundle","type": "batch","entry": [{"resource": {"resourceType": "Patient"}}]}`),
+			code:     200,
+			resp:     `{"type": "batch-response", "entry": [{"response": {"status": "201"}}], "resourceType": "Bundle"}`,
+			expected: 200,
+			wasSent:  true,
+		},
+		{
+			name:     "serverError",
+			payload:  []byte(`{"resourceType": "Bundle","type": "batch","entry": [{"resource": {"resourceType": "Patient"}}]}`),
+			code:     500,
+			resp:     `{"resourceType": "OperationOutcome"}`,
+			expected: 500,
+			wasSent:  true,
+		},
+		{
+			name:    "rejected",
+			payload: []byte(`{"resourceType": "Bundle","type": "transaction","entry": [{"resource": {"resourceType": "Patient"}}]}`),
+			code:    422,
+			resp: `{"resourceType": "OperationOutcome","issue": [{"severity": "error","code": "processing",
+				"diagnostics": "Patient.gender: unknown code"}]}`,
+			expected: 422,
+			wasSent:  true,
+		},
+		{
+			name:     "invalid",
+			payload:  []byte(`invalid`),
+			expected: 400,
+			wasSent:  false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			baseUrl := "https://dummy-url/fhir"
+			p := NewProcessor(config.Fhir{Server: config.Server{BaseUrl: baseUrl}})
+
+			httpmock.Reset()
+			httpmock.ActivateNonDefault(p.client.rest.GetClient())
+			httpmock.RegisterResponder("POST", baseUrl, httpmock.NewStringResponder(c.code, c.resp))
+
+			testTopic := "test"
+			status, body := p.Submit(&source.Message{
+				Origin: source.Origin{Topic: testTopic},
+				Value:  c.payload,
+			})
+
+			assert.Equal(t, c.expected, status)
+			assert.Contains(t, string(body), `"resourceType"`)
+			assert.Equal(t, c.wasSent, httpmock.GetTotalCallCount() == 1)
+			if c.wasSent {
+				// the server's response is passed through unchanged
+				assert.Equal(t, c.resp, string(body))
+			}
+		})
+	}
+}
+
+func TestProcessMessageNack(t *testing.T) {
+	baseUrl := "https://dummy-url/fhir"
+	p := NewProcessor(config.Fhir{Server: config.Server{BaseUrl: baseUrl}})
+
+	httpmock.Reset()
+	httpmock.ActivateNonDefault(p.client.rest.GetClient())
+	httpmock.RegisterResponder("POST", baseUrl,
+		httpmock.NewStringResponder(200, `{"type": "batch-response", "entry": [{"response": {"status": "200"}}], "resourceType": "Bundle"}`))
+
+	valid := &source.Message{Origin: source.Origin{Topic: "test", Offset: 1}, Value: []byte(`{"resourceType": "Patient","id": "1"}`)}
+	invalid := &source.Message{Origin: source.Origin{Topic: "test", Offset: 2}, Value: []byte(`invalid`)}
+	s := source.NewMemorySource(valid, invalid)
+
+	for {
+		msg, err := s.Receive(0)
+		if err != nil {
+			break
+		}
+		if p.ProcessMessage(msg) {
+			msg.Ack()
+		}
+	}
+
+	assert.Equal(t, []*source.Message{valid}, s.Acked)
+	assert.Equal(t, []*source.Message{invalid}, s.Nacked)
+}
+
+func TestProcessMessageDeserializer(t *testing.T) {
+	schema := `{"type":"record","name":"Envelope","fields":[{"name":"bundle","type":"string"}]}`
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"schema": schema})
+	}))
+	t.Cleanup(registry.Close)
+
+	baseUrl := "https://dummy-url/fhir"
+	p := NewProcessor(config.Fhir{
+		Server: config.Server{BaseUrl: baseUrl},
+		Deserializer: config.Deserializer{
+			Topics:   map[string]string{"lab": "avro"},
+			Field:    "bundle",
+			Registry: config.Registry{Url: registry.URL},
+		},
+	})
+
+	httpmock.Reset()
+	httpmock.ActivateNonDefault(p.client.rest.GetClient())
+	var body []byte
+	httpmock.RegisterResponder("POST", baseUrl, func(req *http.Request) (*http.Response, error) {
+		body, _ = io.ReadAll(req.Body)
+		return httpmock.NewStringResponse(200, `{"type": "batch-response", "entry": [{"response": {"status": "200"}}], "resourceType": "Bundle"}`), nil
+	})
+
+	bundle := `{"resourceType":"Bundle","type":"batch","entry":[{"resource":{"resourceType":"Patient"}}]}`
+	record, err := avro.Marshal(avro.MustParse(schema), map[string]any{"bundle": bundle})
+	assert.NoError(t, err)
+	value := append([]byte{0, 0, 0, 0, 1}, record...)
+
+	assert.True(t, p.ProcessMessage(&source.Message{Origin: source.Origin{Topic: "lab"}, Value: value}))
+	assert.Equal(t, bundle, string(body))
+
+	// raw values are not in the wire format
+	assert.False(t, p.ProcessMessage(&source.Message{Origin: source.Origin{Topic: "lab"}, Value: []byte(bundle)}))
+}
@@ -0,0 +1,221 @@
+package fhir
+
+import (
+	"encoding/json"
+	"fmt"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// primitive value formats of the R4 specification
+var primitiveFormats = map[string]*regexp.Regexp{
+	"code":        regexp.MustCompile(`^[^\s]+( [^\s]+)*$`),
+	"id":          idPattern,
+	"uri":         regexp.MustCompile(`^\S*$`),
+	"url":         regexp.MustCompile(`^\S*$`),
+	"canonical":   regexp.MustCompile(`^\S*$`),
+	"oid":         regexp.MustCompile(`^urn:oid:[0-2](\.(0|[1-9][0-9]*))+$`),
+	"uuid":        regexp.MustCompile(`^urn:uuid:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`),
+	"integer":     regexp.MustCompile(`^-?([0]|([1-9][0-9]*))$`),
+	"positiveInt": regexp.MustCompile(`^\+?[1-9][0-9]*$`),
+	"unsignedInt": regexp.MustCompile(`^(0|[1-9][0-9]*)$`),
+	"decimal":     regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`),
+	"date":        regexp.MustCompile(`^([0-9]([0-9]([0-9][1-9]|[1-9]0)|[1-9]00)|[1-9]000)(-(0[1-9]|1[0-2])(-(0[1-9]|[1-2][0-9]|3[0-1]))?)?$`),
+	"dateTime":    regexp.MustCompile(`^([0-9]([0-9]([0-9][1-9]|[1-9]0)|[1-9]00)|[1-9]000)(-(0[1-9]|1[0-2])(-(0[1-9]|[1-2][0-9]|3[0-1])(T([01][0-9]|2[0-3]):[0-5][0-9]:([0-5][0-9]|60)(\.[0-9]+)?(Z|(\+|-)((0[0-9]|1[0-3]):[0-5][0-9]|14:00)))?)?)?$`),
+	"instant":     regexp.MustCompile(`^([0-9]([0-9]([0-9][1-9]|[1-9]0)|[1-9]00)|[1-9]000)-(0[1-9]|1[0-2])-(0[1-9]|[1-2][0-9]|3[0-1])T([01][0-9]|2[0-3]):[0-5][0-9]:([0-5][0-9]|60)(\.[0-9]+)?(Z|(\+|-)((0[0-9]|1[0-3]):[0-5][0-9]|14:00))$`),
+	"time":        regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]:([0-5][0-9]|60)(\.[0-9]+)?$`),
+}
+
+var numericTypes = map[string]bool{"integer": true, "positiveInt": true, "unsignedInt": true, "decimal": true}
+
+// Profiles holds StructureDefinitions of resources. Base definitions (e.g. of
+// the hl7.fhir.r4.core package) apply to all resources of their type, profiles
+// to resources which claim conformance in meta.profile
+type Profiles struct {
+	base     map[string]*structureDefinition
+	profiles map[string]*structureDefinition
+}
+
+type structureDefinition struct {
+	ResourceType string `json:"resourceType"`
+	Url          string `json:"url"`
+	Kind         string `json:"kind"`
+	Type         string `json:"type"`
+	Derivation   string `json:"derivation"`
+	Snapshot     struct {
+		Element []elementDefinition `json:"element"`
+	} `json:"snapshot"`
+}
+
+type elementDefinition struct {
+	Path      string `json:"path"`
+	SliceName string `json:"sliceName"`
+	Min       int    `json:"min"`
+	Max       string `json:"max"`
+	Type      []struct {
+		Code string `json:"code"`
+	} `json:"type"`
+}
+
+// LoadProfiles reads the resource StructureDefinitions with a snapshot from the
+// JSON files of the directory and its subdirectories
+func LoadProfiles(dir string) (*Profiles, error) {
+	p := &Profiles{base: make(map[string]*structureDefinition), profiles: make(map[string]*structureDefinition)}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".json" {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var sd structureDefinition
+		if json.Unmarshal(data, &sd) != nil || sd.ResourceType != "StructureDefinition" ||
+			sd.Kind != "resource" || len(sd.Snapshot.Element) == 0 {
+			return nil
+		}
+		if sd.Derivation == "specialization" {
+			p.base[sd.Type] = &sd
+		} else {
+			p.profiles[sd.Url] = &sd
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(p.base)+len(p.profiles) == 0 {
+		return nil, fmt.Errorf("no StructureDefinition found in %s", dir)
+	}
+	return p, nil
+}
+
+// Validate checks the resource against the base definition of its type and
+// the profiles of meta.profile. Unknown profiles are reported as warnings
+func (p *Profiles) Validate(resource Resource) []models.OperationOutcomeIssue {
+	var issues []models.OperationOutcomeIssue
+	if sd, ok := p.base[resource.Type()]; ok {
+		issues = append(issues, sd.validate(resource)...)
+	}
+
+	meta, _ := resource["meta"].(map[string]interface{})
+	for _, url := range flatten(meta["profile"]) {
+		url, _ := url.(string)
+		canonical, _, _ := strings.Cut(url, "|")
+		sd, ok := p.profiles[canonical]
+		if !ok {
+			issue := newIssue(models.IssueTypeNotSupported, resource.Type()+".meta.profile",
+				fmt.Sprintf("Unknown profile: %s", url))
+			issue.Severity = models.IssueSeverityWarning
+			issues = append(issues, issue)
+			continue
+		}
+		issues = append(issues, sd.validate(resource)...)
+	}
+	return issues
+}
+
+// validate checks cardinalities and primitive formats of the snapshot's
+// elements. Slices are not evaluated. The JSON representation (arrays) is
+// checked by the base structure
+func (sd *structureDefinition) validate(resource Resource) []models.OperationOutcomeIssue {
+	var issues []models.OperationOutcomeIssue
+	for _, e := range sd.Snapshot.Element {
+		segments := strings.Split(e.Path, ".")
+		if len(segments) < 2 || e.SliceName != "" {
+			continue
+		}
+		parentPath, name := segments[1:len(segments)-1], segments[len(segments)-1]
+
+		for _, parent := range parents(map[string]interface{}(resource), parentPath, false) {
+			count := 0
+			for key, value := range parent {
+				elementType, ok := e.matches(name, key)
+				if !ok {
+					continue
+				}
+				values := flatten(value)
+				count += len(values)
+
+				for _, v := range values {
+					if !validPrimitive(elementType, v) {
+						issues = append(issues, newIssue(models.IssueTypeValue, e.Path,
+							fmt.Sprintf("Invalid %s value of %s: %v", elementType, e.Path, v)))
+					}
+				}
+			}
+
+			if count < e.Min {
+				issues = append(issues, newIssue(models.IssueTypeRequired, e.Path,
+					fmt.Sprintf("Element %s requires at least %d values (%s)", e.Path, e.Min, sd.Url)))
+			}
+			if max, err := strconv.Atoi(e.Max); err == nil && count > max {
+				issues = append(issues, newIssue(models.IssueTypeStructure, e.Path,
+					fmt.Sprintf("Element %s allows at most %d values (%s)", e.Path, max, sd.Url)))
+			}
+		}
+	}
+	return issues
+}
+
+// matches checks if the key is the element's name and returns its type. Keys
+// of choice elements ([name][x]) end with their type
+func (e elementDefinition) matches(name, key string) (string, bool) {
+	choice, isChoice := strings.CutSuffix(name, "[x]")
+	if !isChoice {
+		if key != name {
+			return "", false
+		}
+		if len(e.Type) == 1 {
+			return e.Type[0].Code, true
+		}
+		return "", true
+	}
+
+	suffix, ok := strings.CutPrefix(key, choice)
+	if !ok || suffix == "" || !unicode.IsUpper(rune(suffix[0])) {
+		return "", false
+	}
+	for _, t := range e.Type {
+		if strings.EqualFold(t.Code, suffix) {
+			return t.Code, true
+		}
+	}
+	return "", false
+}
+
+// validPrimitive checks the format of primitive values. Values of other types
+// are valid
+func validPrimitive(elementType string, value interface{}) bool {
+	switch elementType {
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "string", "markdown", "http://hl7.org/fhirpath/System.String":
+		_, ok := value.(string)
+		return ok
+	}
+
+	format, ok := primitiveFormats[elementType]
+	if !ok {
+		return true
+	}
+	switch v := value.(type) {
+	case string:
+		return !numericTypes[elementType] && format.MatchString(v)
+	case json.Number:
+		return numericTypes[elementType] && format.MatchString(v.String())
+	case float64:
+		return numericTypes[elementType] && format.MatchString(strconv.FormatFloat(v, 'f', -1, 64))
+	default:
+		return false
+	}
+}
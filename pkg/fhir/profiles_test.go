@@ -0,0 +1,68 @@
+package fhir
+
+import (
+	"encoding/json"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testProfile = `{"resourceType": "StructureDefinition","url": "https://example.org/StructureDefinition/LabObservation",
+	"kind": "resource","type": "Observation","derivation": "constraint","snapshot": {"element": [
+		{"path": "Observation","min": 0,"max": "*"},
+		{"path": "Observation.identifier","min": 1,"max": "1","type": [{"code": "Identifier"}]},
+		{"path": "Observation.effective[x]","min": 1,"max": "1","type": [{"code": "dateTime"},{"code": "Period"}]},
+		{"path": "Observation.component","min": 0,"max": "*","type": [{"code": "BackboneElement"}]},
+		{"path": "Observation.component.valueInteger","min": 0,"max": "1","type": [{"code": "integer"}]},
+		{"path": "Observation.category","sliceName": "laboratory","min": 1,"max": "1"}
+	]}}`
+
+func TestProfilesValidate(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "package"), 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "package", "lab.json"), []byte(testProfile), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "package", "other.json"), []byte(`{"resourceType": "ValueSet"}`), 0600))
+
+	profiles, err := LoadProfiles(dir)
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name     string
+		resource string
+		codes    []models.IssueType
+	}{
+		{"noProfile", `{"resourceType": "Observation"}`, nil},
+		{"valid", `{"resourceType": "Observation","meta": {"profile": ["https://example.org/StructureDefinition/LabObservation|1.0"]},
+			"identifier": [{"value": "1"}],"effectiveDateTime": "2024-05-01T12:00:00+02:00","component": [{"valueInteger": 5}]}`, nil},
+		{"missing", `{"resourceType": "Observation","meta": {"profile": ["https://example.org/StructureDefinition/LabObservation"]}}`,
+			[]models.IssueType{models.IssueTypeRequired, models.IssueTypeRequired}},
+		{"max", `{"resourceType": "Observation","meta": {"profile": ["https://example.org/StructureDefinition/LabObservation"]},
+			"identifier": [{"value": "1"},{"value": "2"}],"effectiveDateTime": "2024-05-01"}`,
+			[]models.IssueType{models.IssueTypeStructure}},
+		{"format", `{"resourceType": "Observation","meta": {"profile": ["https://example.org/StructureDefinition/LabObservation"]},
+			"identifier": [{"value": "1"}],"effectiveDateTime": "01.05.2024","component": [{"valueInteger": "5"}]}`,
+			[]models.IssueType{models.IssueTypeValue, models.IssueTypeValue}},
+		{"unknownProfile", `{"resourceType": "Observation","meta": {"profile": ["https://example.org/StructureDefinition/Other"]}}`,
+			[]models.IssueType{models.IssueTypeNotSupported}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var resource Resource
+			_ = json.Unmarshal([]byte(c.resource), &resource)
+
+			var codes []models.IssueType
+			for _, issue := range profiles.Validate(resource) {
+				codes = append(codes, issue.Code)
+			}
+			assert.Equal(t, c.codes, codes)
+		})
+	}
+}
+
+func TestLoadProfilesEmpty(t *testing.T) {
+	_, err := LoadProfiles(t.TempDir())
+	assert.Error(t, err)
+}
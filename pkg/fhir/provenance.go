@@ -0,0 +1,142 @@
+package fhir
+
+import (
+	"encoding/json"
+	"fhir-to-server/pkg/config"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"strings"
+	"time"
+)
+
+// ProvenanceBuilder creates Provenance resources targeting the resources of a
+// message with an agent representing this service and an entity referencing
+// the Kafka origin. In "append" mode, the Provenance is added as an entry to
+// the outgoing bundle. In "separate" mode, it's sent after success with the
+// server assigned locations as targets
+type ProvenanceBuilder struct {
+	config  config.Provenance
+	appName string
+	now     func() time.Time
+}
+
+func NewProvenanceBuilder(config config.Provenance, appName string) *ProvenanceBuilder {
+	return &ProvenanceBuilder{config: config, appName: appName, now: time.Now}
+}
+
+func (b *ProvenanceBuilder) separate() bool {
+	return b.config.Mode == "separate"
+}
+
+// Transform appends a Provenance entry targeting all resources of the payload
+func (b *ProvenanceBuilder) Transform(payload *Payload, msg MessageInfo) error {
+	if payload.IsXml() {
+		return fmt.Errorf("provenance is not supported for XML payloads")
+	}
+
+	transaction := payload.Bundle.Type == models.BundleTypeTransaction
+	var targets []interface{}
+	for _, e := range payload.Bundle.Entry {
+		if target := entryTarget(e, transaction); target != nil {
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	resource, err := json.Marshal(b.provenance(targets, msg))
+	if err != nil {
+		return err
+	}
+	payload.SetEntries(append(payload.Bundle.Entry, models.BundleEntry{
+		Resource: resource,
+		Request:  &models.BundleEntryRequest{Method: models.HTTPVerbPOST, Url: "Provenance"},
+	}))
+
+	return nil
+}
+
+// entryTarget returns a reference to the entry's resource: a literal
+// reference, if the resource has an id, its fullUrl within transactions or a
+// logical reference by its first identifier
+func entryTarget(e models.BundleEntry, transaction bool) map[string]interface{} {
+	if e.Resource == nil || (e.Request != nil && e.Request.Method == models.HTTPVerbDELETE) {
+		return nil
+	}
+
+	var r struct {
+		Type       string        `json:"resourceType"`
+		Id         *string       `json:"id"`
+		Identifier []interface{} `json:"identifier"`
+	}
+	if err := json.Unmarshal(e.Resource, &r); err != nil || r.Type == "Provenance" {
+		return nil
+	}
+
+	switch {
+	case r.Id != nil:
+		return map[string]interface{}{"reference": r.Type + "/" + *r.Id}
+	case transaction && e.FullUrl != nil && strings.HasPrefix(*e.FullUrl, "urn:uuid:"):
+		return map[string]interface{}{"reference": *e.FullUrl}
+	case len(r.Identifier) > 0:
+		return map[string]interface{}{"type": r.Type, "identifier": r.Identifier[0]}
+	default:
+		return nil
+	}
+}
+
+func (b *ProvenanceBuilder) provenance(targets []interface{}, msg MessageInfo) Resource {
+	return Resource{
+		"resourceType": "Provenance",
+		"target":       targets,
+		"recorded":     b.now().Format(time.RFC3339),
+		"agent": []interface{}{map[string]interface{}{
+			"type": map[string]interface{}{"coding": []interface{}{map[string]interface{}{
+				"system": "http://terminology.hl7.org/CodeSystem/provenance-participant-type",
+				"code":   "assembler",
+			}}},
+			"who": map[string]interface{}{"display": b.appName},
+		}},
+		"entity": []interface{}{map[string]interface{}{
+			"role": "source",
+			"what": map[string]interface{}{
+				"identifier": map[string]interface{}{"system": b.config.EntitySystem, "value": Source(msg)},
+				"display":    Source(msg),
+			},
+		}},
+	}
+}
+
+// sendProvenance sends a Provenance targeting the server assigned locations
+// of a successfully sent message
+func (p *Processor) sendProvenance(client *Client, locations []string, info MessageInfo) error {
+	if p.provenance == nil || !p.provenance.separate() {
+		return nil
+	}
+
+	var targets []interface{}
+	for _, l := range locations {
+		if l != "" && !strings.HasPrefix(l, "Provenance/") {
+			targets = append(targets, map[string]interface{}{"reference": l})
+		}
+	}
+	if len(targets) == 0 {
+		log.Debug().
+			Str("topic", info.Topic).
+			Str("key", info.Key).
+			Int64("offset", info.Offset).
+			Msg("No locations to create Provenance for")
+		return nil
+	}
+
+	resource, err := json.Marshal(p.provenance.provenance(targets, info))
+	if err != nil {
+		return err
+	}
+	if _, ok := client.SendResource("POST", "Provenance", resource, JsonContentType, info.propagated(p.headers.Propagate)); !ok {
+		return fmt.Errorf("failed to send Provenance")
+	}
+	return nil
+}
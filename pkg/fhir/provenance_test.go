@@ -0,0 +1,105 @@
+package fhir
+
+import (
+	"encoding/json"
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestProvenanceTransform(t *testing.T) {
+	b := NewProvenanceBuilder(config.Provenance{Mode: "append", EntitySystem: "https://example.org/kafka"}, "fhir-to-server")
+	b.now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+
+	payload, _ := ParsePayload([]byte(`{"resourceType": "Bundle","type": "transaction","entry": [
+		{"fullUrl": "urn:uuid:1","resource": {"resourceType": "Patient","identifier": [{"system": "https://example.org/pid","value": "1"}]},"request": {"method": "POST","url": "Patient"}},
+		{"fullUrl": "urn:uuid:2","resource": {"resourceType": "Encounter","identifier": [{"system": "https://example.org/eid","value": "2"}]},"request": {"method": "POST","url": "Encounter"}},
+		{"resource": {"resourceType": "Observation","id": "3"},"request": {"method": "PUT","url": "Observation/3"}},
+		{"request": {"method": "DELETE","url": "Observation/4"}}
+	]}`), "")
+
+	err := b.Transform(payload, MessageInfo{Topic: "lab-fhir", Partition: 1, Offset: 7})
+	assert.NoError(t, err)
+	assert.Len(t, payload.Bundle.Entry, 5)
+
+	entry := payload.Bundle.Entry[4]
+	assert.Equal(t, "POST", entry.Request.Method.Code())
+	assert.Equal(t, "Provenance", entry.Request.Url)
+
+	var provenance map[string]interface{}
+	_ = json.Unmarshal(entry.Resource, &provenance)
+	assert.Equal(t, "Provenance", provenance["resourceType"])
+	assert.Equal(t, "2024-05-01T12:00:00Z", provenance["recorded"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"reference": "urn:uuid:1"},
+		map[string]interface{}{"reference": "urn:uuid:2"},
+		map[string]interface{}{"reference": "Observation/3"},
+	}, provenance["target"])
+
+	agent := provenance["agent"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "fhir-to-server", agent["who"].(map[string]interface{})["display"])
+
+	what := provenance["entity"].([]interface{})[0].(map[string]interface{})["what"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"system": "https://example.org/kafka", "value": "kafka://lab-fhir/1/7"}, what["identifier"])
+}
+
+func TestProvenanceTransformBatch(t *testing.T) {
+	b := NewProvenanceBuilder(config.Provenance{Mode: "append"}, "fhir-to-server")
+
+	payload, _ := ParsePayload([]byte(`{"resourceType": "Bundle","type": "batch","entry": [
+		{"fullUrl": "urn:uuid:1","resource": {"resourceType": "Patient","identifier": [{"system": "https://example.org/pid","value": "1"}]},"request": {"method": "POST","url": "Patient"}}
+	]}`), "")
+
+	err := b.Transform(payload, MessageInfo{})
+	assert.NoError(t, err)
+
+	// logical reference in batches
+	var provenance map[string]interface{}
+	_ = json.Unmarshal(payload.Bundle.Entry[1].Resource, &provenance)
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"type":       "Patient",
+		"identifier": map[string]interface{}{"system": "https://example.org/pid", "value": "1"},
+	}}, provenance["target"])
+}
+
+func TestProcessMessageSeparateProvenance(t *testing.T) {
+	baseUrl := "https://dummy-url/fhir"
+	p := NewProcessor(config.Fhir{
+		Server:     config.Server{BaseUrl: baseUrl},
+		Provenance: config.Provenance{Enabled: true, Mode: "separate"},
+		AppName:    "fhir-to-server",
+	})
+
+	// set up mock
+	httpmock.Reset()
+	httpmock.ActivateNonDefault(p.client.rest.GetClient())
+	httpmock.RegisterResponder("POST", baseUrl, httpmock.NewStringResponder(200, `{"type": "transaction-response", "entry": [
+		{"response": {"status": "201", "location": "https://dummy-url/fhir/Patient/abc/_history/1"}},
+		{"response": {"status": "201", "location": "Observation/def/_history/1"}}
+	], "resourceType": "Bundle"}`))
+	var provenance map[string]interface{}
+	httpmock.RegisterResponder("POST", baseUrl+"/Provenance", func(req *http.Request) (*http.Response, error) {
+		b, _ := io.ReadAll(req.Body)
+		_ = json.Unmarshal(b, &provenance)
+		return httpmock.NewStringResponse(201, ""), nil
+	})
+
+	testTopic := "test"
+	ok := p.ProcessMessage(&source.Message{
+		Origin: source.Origin{Topic: testTopic, Offset: 42},
+		Value:  []byte(`{"resourceType": "Bundle","type": "transaction","entry": [{"resource": {"resourceType": "Patient"},"request": {"method": "POST","url": "Patient"}},{"resource": {"resourceType": "Observation"},"request": {"method": "POST","url": "Observation"}}]}`),
+		Key:    []byte("test"),
+	})
+
+	assert.True(t, ok)
+	assert.Equal(t, 2, httpmock.GetTotalCallCount())
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"reference": "Patient/abc/_history/1"},
+		map[string]interface{}{"reference": "Observation/def/_history/1"},
+	}, provenance["target"])
+}
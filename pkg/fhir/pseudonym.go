@@ -0,0 +1,471 @@
+package fhir
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fhir-to-server/pkg/config"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// secret is a key which is never written to logs
+type secret []byte
+
+func (s secret) String() string {
+	return "[redacted]"
+}
+
+func (s secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"[redacted]"`), nil
+}
+
+var (
+	literalReference = regexp.MustCompile(`^(.*?)([A-Z][A-Za-z]+)/([A-Za-z0-9\-.]{1,64})(/_history/.*)?$`)
+	dateValue        = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}`)
+	// resource types with direct identifiers of persons
+	personTypes = map[string]bool{"Patient": true, "RelatedPerson": true, "Person": true, "Practitioner": true}
+	// elements which are not subject to date shifting
+	dateShiftSkipped = map[string]bool{
+		"meta": true, "id": true, "reference": true, "url": true, "system": true, "code": true,
+		"value": true, "display": true, "text": true, "div": true,
+	}
+)
+
+// Pseudonymizer replaces direct identifiers by keyed HMAC pseudonyms. Identifier
+// values of configured systems and ids of configured resource types are
+// replaced consistently in all references, so linkage across entries and
+// messages stays intact. Names, addresses and telecom of persons are removed or
+// generalized and dates are shifted by a per-patient offset
+type Pseudonymizer struct {
+	key     secret
+	systems map[string]bool
+	idTypes map[string]bool
+	config  config.Pseudonymization
+}
+
+func NewPseudonymizer(config config.Pseudonymization) (*Pseudonymizer, error) {
+	key, err := loadKey(config)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Pseudonymizer{key: key, systems: make(map[string]bool), idTypes: make(map[string]bool), config: config}
+	for _, s := range config.IdentifierSystems {
+		p.systems[s] = true
+	}
+	for _, t := range config.IdTypes {
+		p.idTypes[t] = true
+	}
+	return p, nil
+}
+
+// loadKey reads the key from the configured file or environment variable
+func loadKey(config config.Pseudonymization) (secret, error) {
+	var key []byte
+	if config.KeyFile != "" {
+		content, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = []byte(strings.TrimSpace(string(content)))
+	} else if config.KeyEnv != "" {
+		key = []byte(os.Getenv(config.KeyEnv))
+	}
+
+	if len(key) == 0 {
+		return nil, errors.New("missing pseudonymization key")
+	}
+	return key, nil
+}
+
+// pseudonym returns the keyed HMAC of the value in the given domain
+func (p *Pseudonymizer) pseudonym(domain, value string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(domain + "|" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (p *Pseudonymizer) Transform(payload *Payload, _ MessageInfo) error {
+	patients := p.patients(payload)
+	return transformEntries(payload, func(entry *models.BundleEntry, resource Resource) (bool, error) {
+		if entry.FullUrl != nil {
+			fullUrl := p.RewriteReference(*entry.FullUrl)
+			entry.FullUrl = &fullUrl
+		}
+		if entry.Request != nil {
+			entry.Request.Url = p.RewriteReference(entry.Request.Url)
+			if entry.Request.IfNoneExist != nil {
+				query := p.query(*entry.Request.IfNoneExist)
+				entry.Request.IfNoneExist = &query
+			}
+		}
+		if resource != nil {
+			p.transformResource(resource, patients)
+		}
+		return true, nil
+	})
+}
+
+func (p *Pseudonymizer) transformResource(r Resource, patients map[string]string) {
+	resourceType := r.Type()
+
+	// the date shift offset depends on the original patient reference
+	days := p.dateShift(r, patients)
+
+	if personTypes[resourceType] {
+		p.personal(r)
+	}
+	p.identifiers(r)
+	if id := r.Id(); id != "" && p.idTypes[resourceType] {
+		r["id"] = p.pseudonym(resourceType, id)
+	}
+	if days != 0 {
+		shiftDates(r, days)
+	}
+}
+
+// RewriteReference rewrites literal references ([type]/[id]) and conditional
+// references ([type]?identifier=[system]|[value])
+func (p *Pseudonymizer) RewriteReference(ref string) string {
+	if resourceType, query, ok := strings.Cut(ref, "?"); ok {
+		return resourceType + "?" + p.query(query)
+	}
+
+	m := literalReference.FindStringSubmatch(ref)
+	if m == nil || !p.idTypes[m[2]] {
+		return ref
+	}
+	return m[1] + m[2] + "/" + p.pseudonym(m[2], m[3]) + m[4]
+}
+
+// query rewrites identifier search parameters of configured systems
+func (p *Pseudonymizer) query(query string) string {
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok || name != "identifier" {
+			continue
+		}
+		system, v, ok := strings.Cut(value, "|")
+		if ok && p.systems[system] {
+			params[i] = name + "=" + system + "|" + p.pseudonym(system, v)
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// identifiers rewrites identifiers and references in the element recursively
+func (p *Pseudonymizer) identifiers(element interface{}) {
+	switch e := element.(type) {
+	case map[string]interface{}:
+		for k, v := range e {
+			switch k {
+			case "identifier":
+				p.identifier(v)
+			case "reference":
+				if ref, ok := v.(string); ok {
+					e[k] = p.RewriteReference(ref)
+				}
+			}
+			p.identifiers(v)
+		}
+	case Resource:
+		p.identifiers(map[string]interface{}(e))
+	case []interface{}:
+		for _, v := range e {
+			p.identifiers(v)
+		}
+	}
+}
+
+func (p *Pseudonymizer) identifier(element interface{}) {
+	switch e := element.(type) {
+	case []interface{}:
+		for _, v := range e {
+			p.identifier(v)
+		}
+	case map[string]interface{}:
+		system, _ := e["system"].(string)
+		value, ok := e["value"].(string)
+		if ok && p.systems[system] {
+			e["value"] = p.pseudonym(system, value)
+		}
+	}
+}
+
+// personal removes or generalizes names, addresses and telecom
+func (p *Pseudonymizer) personal(element interface{}) {
+	switch e := element.(type) {
+	case Resource:
+		p.personal(map[string]interface{}(e))
+	case map[string]interface{}:
+		for k, v := range e {
+			switch k {
+			case "name":
+				apply(e, k, p.config.Name, generalizeName)
+			case "address":
+				apply(e, k, p.config.Address, generalizeAddress)
+			case "telecom":
+				apply(e, k, p.config.Telecom, generalizeTelecom)
+			default:
+				p.personal(v)
+			}
+		}
+	case []interface{}:
+		for _, v := range e {
+			p.personal(v)
+		}
+	}
+}
+
+func apply(e map[string]interface{}, key, action string, generalize func(map[string]interface{}) map[string]interface{}) {
+	switch action {
+	case "remove":
+		delete(e, key)
+	case "generalize":
+		switch values := e[key].(type) {
+		case []interface{}:
+			for i, v := range values {
+				if m, ok := v.(map[string]interface{}); ok {
+					values[i] = generalize(m)
+				}
+			}
+		case map[string]interface{}:
+			// single elements, e.g. Patient.contact.name
+			e[key] = generalize(values)
+		}
+	}
+}
+
+func generalizeName(name map[string]interface{}) map[string]interface{} {
+	return keep(name, "use", map[string]interface{}{
+		"extension": []interface{}{map[string]interface{}{
+			"url":       "http://hl7.org/fhir/StructureDefinition/data-absent-reason",
+			"valueCode": "masked",
+		}},
+	})
+}
+
+func generalizeAddress(address map[string]interface{}) map[string]interface{} {
+	generalized := keep(address, "use", keep(address, "type", keep(address, "country", nil)))
+	if postalCode, ok := address["postalCode"].(string); ok && len(postalCode) > 2 {
+		generalized["postalCode"] = postalCode[:2]
+	}
+	return generalized
+}
+
+func generalizeTelecom(telecom map[string]interface{}) map[string]interface{} {
+	return keep(telecom, "use", keep(telecom, "system", nil))
+}
+
+// keep copies the element's value by key to target
+func keep(element map[string]interface{}, key string, target map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		target = make(map[string]interface{})
+	}
+	if v, ok := element[key]; ok {
+		target[key] = v
+	}
+	return target
+}
+
+// patientIdentifier is an identifier of a Patient resource
+type patientIdentifier struct {
+	System string `json:"system"`
+	Value  string `json:"value"`
+}
+
+// patients maps the fullUrls, literal references ([type]/[id]) and
+// identifiers of the payload's Patient resources to their date shift key, so
+// references of other entries resolve to the same patient
+func (p *Pseudonymizer) patients(payload *Payload) map[string]string {
+	patients := make(map[string]string)
+	if p.config.DateShift <= 0 || payload.IsXml() {
+		return patients
+	}
+
+	for _, e := range payload.Bundle.Entry {
+		var r struct {
+			Type       string              `json:"resourceType"`
+			Id         string              `json:"id"`
+			Identifier []patientIdentifier `json:"identifier"`
+		}
+		if e.Resource == nil || json.Unmarshal(e.Resource, &r) != nil || r.Type != "Patient" {
+			continue
+		}
+		key := p.patientKey(r.Id, r.Identifier)
+		if key == "" {
+			continue
+		}
+		if e.FullUrl != nil {
+			patients[*e.FullUrl] = key
+		}
+		if r.Id != "" {
+			patients["Patient/"+r.Id] = key
+		}
+		for _, i := range r.Identifier {
+			patients[identifierKey(i)] = key
+		}
+	}
+	return patients
+}
+
+// patientKey derives the date shift key of a patient: its logical id, like
+// literal references of other messages, or without an id an identifier of the
+// configured systems (in order) or any other identifier
+func (p *Pseudonymizer) patientKey(id string, identifiers []patientIdentifier) string {
+	if id != "" {
+		return "Patient/" + id
+	}
+	for _, system := range p.config.IdentifierSystems {
+		for _, i := range identifiers {
+			if i.System == system && i.Value != "" {
+				return identifierKey(i)
+			}
+		}
+	}
+	if len(identifiers) > 0 && identifiers[0].Value != "" {
+		return identifierKey(identifiers[0])
+	}
+	return ""
+}
+
+func identifierKey(i patientIdentifier) string {
+	return "identifier|" + i.System + "|" + i.Value
+}
+
+// dateShift returns the number of days to shift dates of the resource. It is
+// derived from the patient (resource or reference) of the resource, which is
+// resolved to the same key for all resources of a patient in the bundle
+func (p *Pseudonymizer) dateShift(r Resource, patients map[string]string) int {
+	if p.config.DateShift <= 0 {
+		return 0
+	}
+
+	patient := ""
+	if r.Type() == "Patient" {
+		patient = p.patientKey(r.Id(), identifiers(r["identifier"]))
+	} else {
+		for _, k := range []string{"subject", "patient", "beneficiary"} {
+			if ref, ok := r[k].(map[string]interface{}); ok {
+				if patient = patientReference(ref, patients); patient != "" {
+					break
+				}
+			}
+		}
+	}
+	if patient == "" {
+		return 0
+	}
+
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte("date-shift|" + patient))
+	offset := int(binary.BigEndian.Uint32(mac.Sum(nil)[:4]) % uint32(2*p.config.DateShift+1))
+	return offset - p.config.DateShift
+}
+
+// patientReference returns the date shift key of a Patient reference: a
+// fullUrl (e.g. urn:uuid) of the bundle, a literal reference (relative or
+// absolute), a conditional reference or a logical reference by identifier
+func patientReference(ref map[string]interface{}, patients map[string]string) string {
+	key := ""
+	if s, ok := ref["reference"].(string); ok {
+		if resolved, ok := patients[s]; ok {
+			return resolved
+		}
+		if query, ok := strings.CutPrefix(s, "Patient?"); ok {
+			for _, param := range strings.Split(query, "&") {
+				value, ok := strings.CutPrefix(param, "identifier=")
+				if system, v, found := strings.Cut(value, "|"); ok && found {
+					key = identifierKey(patientIdentifier{System: system, Value: v})
+				}
+			}
+		} else if m := literalReference.FindStringSubmatch(s); m != nil && m[2] == "Patient" {
+			key = "Patient/" + m[3]
+		}
+	}
+	if ids := identifiers(ref["identifier"]); key == "" && len(ids) > 0 {
+		key = identifierKey(ids[0])
+	}
+
+	if resolved, ok := patients[key]; ok {
+		return resolved
+	}
+	return key
+}
+
+// identifiers returns the identifiers of an element (single or list) with a
+// value
+func identifiers(element interface{}) []patientIdentifier {
+	values, ok := element.([]interface{})
+	if !ok {
+		values = []interface{}{element}
+	}
+
+	var ids []patientIdentifier
+	for _, v := range values {
+		identifier, _ := v.(map[string]interface{})
+		system, _ := identifier["system"].(string)
+		if value, ok := identifier["value"].(string); ok && value != "" {
+			ids = append(ids, patientIdentifier{System: system, Value: value})
+		}
+	}
+	return ids
+}
+
+// shiftDates shifts all dates with day precision in the element recursively
+func shiftDates(element interface{}, days int) {
+	switch e := element.(type) {
+	case Resource:
+		shiftDates(map[string]interface{}(e), days)
+	case map[string]interface{}:
+		for k, v := range e {
+			if dateShiftSkipped[k] {
+				continue
+			}
+			if s, ok := v.(string); ok {
+				e[k] = shiftDate(s, days)
+			} else {
+				shiftDates(v, days)
+			}
+		}
+	case []interface{}:
+		for i, v := range e {
+			if s, ok := v.(string); ok {
+				e[i] = shiftDate(s, days)
+			} else {
+				shiftDates(v, days)
+			}
+		}
+	}
+}
+
+func shiftDate(value string, days int) string {
+	if !dateValue.MatchString(value) {
+		return value
+	}
+
+	if len(value) == len(time.DateOnly) {
+		if t, err := time.Parse(time.DateOnly, value); err == nil {
+			return t.AddDate(0, 0, days).Format(time.DateOnly)
+		}
+		return value
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return value
+	}
+	layout := time.RFC3339
+	if strings.Contains(value, ".") {
+		layout = time.RFC3339Nano
+	}
+	return t.AddDate(0, 0, days).Format(layout)
+}
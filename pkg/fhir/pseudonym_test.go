@@ -0,0 +1,218 @@
+package fhir
+
+import (
+	"encoding/json"
+	"fhir-to-server/pkg/config"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const pseudonymBundle = `{
+  "resourceType": "Bundle",
+  "type": "batch",
+  "entry": [
+    {
+      "fullUrl": "Patient/599999",
+      "resource": {
+        "resourceType": "Patient",
+        "id": "599999",
+        "identifier": [{"system": "https://fhir.diz.uni-marburg.de/sid/patient-id", "value": "666666"}],
+        "name": [{"use": "official", "family": "Lustig", "given": ["Peter"]}],
+        "address": [{"type": "both", "line": ["Straße", "1"], "city": "Marburg", "postalCode": "35037", "country": "DE"}],
+        "telecom": [{"system": "phone", "value": "0123"}],
+        "birthDate": "1937-10-27"
+      },
+      "request": {"method": "PUT", "url": "Patient/599999", "ifNoneExist": "identifier=https://fhir.diz.uni-marburg.de/sid/patient-id|666666"}
+    },
+    {
+      "fullUrl": "Observation/1",
+      "resource": {
+        "resourceType": "Observation",
+        "id": "1",
+        "status": "final",
+        "subject": {"reference": "Patient/599999"},
+        "effectiveDateTime": "2023-02-20T12:52:00+01:00",
+        "valueQuantity": {"value": 1.50, "unit": "mg"}
+      },
+      "request": {"method": "PUT", "url": "Observation/1"}
+    }
+  ]
+}`
+
+func newTestPseudonymizer(t *testing.T) *Pseudonymizer {
+	t.Setenv("TEST_PSEUDONYMIZATION_KEY", "secret-key")
+	p, err := NewPseudonymizer(config.Pseudonymization{
+		KeyEnv:            "TEST_PSEUDONYMIZATION_KEY",
+		IdentifierSystems: []string{"https://fhir.diz.uni-marburg.de/sid/patient-id"},
+		IdTypes:           []string{"Patient"},
+		Name:              "remove",
+		Address:           "generalize",
+		Telecom:           "generalize",
+		DateShift:         30,
+	})
+	assert.NoError(t, err)
+	return p
+}
+
+func TestPseudonymizerTransform(t *testing.T) {
+	p := newTestPseudonymizer(t)
+	payload, _ := ParsePayload([]byte(pseudonymBundle), "")
+
+	err := p.Transform(payload, MessageInfo{})
+	assert.NoError(t, err)
+
+	var patient, observation map[string]interface{}
+	_ = json.Unmarshal(payload.Bundle.Entry[0].Resource, &patient)
+	_ = json.Unmarshal(payload.Bundle.Entry[1].Resource, &observation)
+
+	pseudoId := p.pseudonym("Patient", "599999")
+	pseudoValue := p.pseudonym("https://fhir.diz.uni-marburg.de/sid/patient-id", "666666")
+
+	// ids and references
+	assert.Equal(t, pseudoId, patient["id"])
+	assert.Equal(t, "Patient/"+pseudoId, *payload.Bundle.Entry[0].FullUrl)
+	assert.Equal(t, "Patient/"+pseudoId, payload.Bundle.Entry[0].Request.Url)
+	assert.Equal(t, "Patient/"+pseudoId, observation["subject"].(map[string]interface{})["reference"])
+	assert.Equal(t, "Observation/1", payload.Bundle.Entry[1].Request.Url)
+
+	// identifiers
+	assert.Equal(t, pseudoValue, patient["identifier"].([]interface{})[0].(map[string]interface{})["value"])
+	assert.Equal(t, "identifier=https://fhir.diz.uni-marburg.de/sid/patient-id|"+pseudoValue, *payload.Bundle.Entry[0].Request.IfNoneExist)
+
+	// personal data
+	assert.NotContains(t, patient, "name")
+	assert.Equal(t, []interface{}{map[string]interface{}{"type": "both", "postalCode": "35", "country": "DE"}}, patient["address"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"system": "phone"}}, patient["telecom"])
+
+	// dates are shifted by the same offset
+	birthDate, _ := time.Parse(time.DateOnly, patient["birthDate"].(string))
+	effective, _ := time.Parse(time.RFC3339, observation["effectiveDateTime"].(string))
+	birthShift := birthDate.Sub(time.Date(1937, 10, 27, 0, 0, 0, 0, time.UTC))
+	effectiveShift := effective.Sub(time.Date(2023, 2, 20, 12, 52, 0, 0, time.FixedZone("", 3600)))
+	assert.Equal(t, birthShift.Hours(), effectiveShift.Hours())
+	assert.LessOrEqual(t, birthShift.Abs(), 30*24*time.Hour)
+
+	// decimals are preserved
+	assert.Contains(t, string(payload.Bundle.Entry[1].Resource), `"value":1.50`)
+}
+
+func TestPseudonymizerDateShiftKey(t *testing.T) {
+	p := newTestPseudonymizer(t)
+	system := "https://fhir.diz.uni-marburg.de/sid/patient-id"
+
+	cases := []struct {
+		name   string
+		bundle string
+		// reference to the patient in another message
+		reference string
+	}{
+		{
+			name:      "urnUuid",
+			reference: "Patient?identifier=" + system + "|42",
+			bundle: `{"resourceType": "Bundle", "type": "transaction", "entry": [
+				{"fullUrl": "urn:uuid:a", "resource": {"resourceType": "Patient", "identifier": [{"system": "` + system + `", "value": "42"}], "birthDate": "2000-01-01"}, "request": {"method": "POST", "url": "Patient"}},
+				{"fullUrl": "urn:uuid:b", "resource": {"resourceType": "Observation", "subject": {"reference": "urn:uuid:a"}, "effectiveDateTime": "2000-01-01"}, "request": {"method": "POST", "url": "Observation"}}]}`,
+		},
+		{
+			name:      "absoluteReference",
+			reference: "Patient/7",
+			bundle: `{"resourceType": "Bundle", "type": "batch", "entry": [
+				{"fullUrl": "https://server/fhir/Patient/7", "resource": {"resourceType": "Patient", "id": "7", "identifier": [{"system": "urn:other", "value": "x"}, {"system": "` + system + `", "value": "42"}], "birthDate": "2000-01-01"}},
+				{"resource": {"resourceType": "Observation", "subject": {"reference": "https://server/fhir/Patient/7"}, "effectiveDateTime": "2000-01-01"}}]}`,
+		},
+		{
+			name:      "identifierReference",
+			reference: "Patient/7",
+			bundle: `{"resourceType": "Bundle", "type": "batch", "entry": [
+				{"resource": {"resourceType": "Patient", "id": "7", "identifier": [{"system": "` + system + `", "value": "42"}], "birthDate": "2000-01-01"}},
+				{"resource": {"resourceType": "Observation", "subject": {"identifier": {"system": "` + system + `", "value": "42"}}, "effectiveDateTime": "2000-01-01"}}]}`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// the offset of the patient's resources in other messages
+			expected := p.dateShift(Resource{"resourceType": "Observation", "subject": map[string]interface{}{
+				"reference": c.reference,
+			}}, map[string]string{})
+			assert.NotZero(t, expected)
+
+			payload, err := ParsePayload([]byte(c.bundle), "")
+			assert.NoError(t, err)
+
+			assert.NoError(t, p.Transform(payload, MessageInfo{}))
+
+			var patient, observation map[string]interface{}
+			_ = json.Unmarshal(payload.Bundle.Entry[0].Resource, &patient)
+			_ = json.Unmarshal(payload.Bundle.Entry[1].Resource, &observation)
+			shifted := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, expected).Format(time.DateOnly)
+			assert.Equal(t, shifted, patient["birthDate"])
+			assert.Equal(t, shifted, observation["effectiveDateTime"])
+		})
+	}
+}
+
+func TestPseudonymizerContact(t *testing.T) {
+	p := newTestPseudonymizer(t)
+	p.config.Name = "generalize"
+	payload, _ := ParsePayload([]byte(`{"resourceType": "Patient", "id": "1", "contact": [{
+		"name": {"use": "official", "family": "Doe", "given": ["Jane"]},
+		"address": {"use": "home", "line": ["Main Street 1"], "postalCode": "35037", "country": "DE"},
+		"telecom": [{"system": "phone", "value": "0123"}]}]}`), "")
+
+	err := p.Transform(payload, MessageInfo{})
+	assert.NoError(t, err)
+
+	var patient map[string]interface{}
+	_ = json.Unmarshal(payload.Bundle.Entry[0].Resource, &patient)
+	contact := patient["contact"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"use": "official", "extension": []interface{}{map[string]interface{}{
+		"url":       "http://hl7.org/fhir/StructureDefinition/data-absent-reason",
+		"valueCode": "masked",
+	}}}, contact["name"])
+	assert.Equal(t, map[string]interface{}{"use": "home", "postalCode": "35", "country": "DE"}, contact["address"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"system": "phone"}}, contact["telecom"])
+}
+
+func TestPseudonymizerXml(t *testing.T) {
+	p := newTestPseudonymizer(t)
+	payload, _ := ParsePayload([]byte(`<Patient xmlns="http://hl7.org/fhir"><id value="1"/></Patient>`), "")
+
+	err := p.Transform(payload, MessageInfo{})
+
+	assert.Error(t, err)
+}
+
+func TestPseudonymizerKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	_ = os.WriteFile(keyFile, []byte("file-key\n"), 0600)
+
+	p, err := NewPseudonymizer(config.Pseudonymization{KeyFile: keyFile})
+	assert.NoError(t, err)
+	assert.Equal(t, secret("file-key"), p.key)
+
+	// never printed
+	assert.Equal(t, "[redacted]", fmt.Sprint(p.key))
+	b, _ := json.Marshal(p.key)
+	assert.Equal(t, `"[redacted]"`, string(b))
+
+	_, err = NewPseudonymizer(config.Pseudonymization{KeyEnv: "MISSING_TEST_PSEUDONYMIZATION_KEY"})
+	assert.Error(t, err)
+}
+
+func TestShiftDate(t *testing.T) {
+	cases := map[string]string{
+		"2020-02-28":                    "2020-03-01",
+		"2020-02-28T23:00:00+01:00":     "2020-03-01T23:00:00+01:00",
+		"2020-02-28T23:00:00.123+01:00": "2020-03-01T23:00:00.123+01:00",
+		"2020-02":                       "2020-02",
+		"text":                          "text",
+	}
+	for value, expected := range cases {
+		assert.Equal(t, expected, shiftDate(value, 2), value)
+	}
+}
@@ -0,0 +1,254 @@
+package fhir
+
+import (
+	"encoding/json"
+	"errors"
+	"fhir-to-server/pkg/config"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReferenceChecker finds references of a payload's resources, which are not
+// resolved by other entries of the bundle and, optionally, by resources on the
+// target server. Depending on the policy, entries are reordered so referenced
+// entries come first or messages with dangling references are rejected. Held
+// messages are parked by the processor and checked again later
+type ReferenceChecker struct {
+	config config.References
+	target func(info MessageInfo) (*Client, error)
+
+	mu sync.Mutex
+	// existing references on the server by their expiry
+	cache map[string]time.Time
+}
+
+func NewReferenceChecker(config config.References) *ReferenceChecker {
+	return &ReferenceChecker{config: config, cache: make(map[string]time.Time)}
+}
+
+// reference is a reference of the entry at index entry
+type reference struct {
+	entry int
+	value string
+}
+
+func (c *ReferenceChecker) Transform(payload *Payload, info MessageInfo) error {
+	if payload.IsXml() {
+		return errors.New("transformations are not supported for XML payloads")
+	}
+
+	resources := make([]Resource, len(payload.Bundle.Entry))
+	for i, e := range payload.Bundle.Entry {
+		if e.Resource != nil {
+			if err := json.Unmarshal(e.Resource, &resources[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	dangling, resolved, err := c.dangling(payload.Bundle.Entry, resources, info)
+	if err != nil {
+		return err
+	}
+
+	if c.config.Policy == "reorder" {
+		payload.SetEntries(reorder(payload.Bundle.Entry, resolved))
+	}
+
+	if len(dangling) == 0 {
+		return nil
+	}
+	if c.config.Policy == "reorder" {
+		log.Warn().
+			Str("topic", info.Topic).
+			Str("key", info.Key).
+			Int64("offset", info.Offset).
+			Strs("references", values(dangling)).
+			Msg("Dangling references")
+		return nil
+	}
+	return &DanglingReferencesError{References: values(dangling)}
+}
+
+// dangling returns the references which are neither resolved in the bundle nor
+// on the server. Resolved maps each entry to the entries it references
+func (c *ReferenceChecker) dangling(entries []models.BundleEntry, resources []Resource, info MessageInfo) ([]reference, map[int][]int, error) {
+	entryIds := make(map[string]int)
+	for i, e := range entries {
+		for _, id := range identities(e, resources[i]) {
+			entryIds[id] = i
+		}
+	}
+
+	var dangling []reference
+	resolved := make(map[int][]int)
+	for i, resource := range resources {
+		for _, ref := range collectReferences(resource) {
+			if j, ok := entryIds[ref]; ok {
+				if j != i {
+					resolved[i] = append(resolved[i], j)
+				}
+				continue
+			}
+			if !isLocal(ref) {
+				continue
+			}
+			exists, err := c.exists(ref, info)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !exists {
+				dangling = append(dangling, reference{entry: i, value: ref})
+			}
+		}
+	}
+	return dangling, resolved, nil
+}
+
+// exists checks if the reference resolves on the target server. Existing
+// references are cached
+func (c *ReferenceChecker) exists(ref string, info MessageInfo) (bool, error) {
+	if !c.config.Lookup || strings.HasPrefix(ref, "urn:") {
+		return false, nil
+	}
+	client, err := c.target(info)
+	if err != nil {
+		return false, err
+	}
+	key := client.config.Server.BaseUrl + "/" + ref
+
+	c.mu.Lock()
+	expiry, cached := c.cache[key]
+	c.mu.Unlock()
+	if cached && time.Now().Before(expiry) {
+		return true, nil
+	}
+
+	exists, err := client.Exists(searchQuery(ref))
+	if err != nil || !exists {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.config.CacheSize > 0 && len(c.cache) >= c.config.CacheSize {
+		clear(c.cache)
+	}
+	c.cache[key] = time.Now().Add(c.config.CacheTtl)
+	return true, nil
+}
+
+// identities returns the references which resolve to the entry: its fullUrl,
+// [type]/[id] and conditional references of its request and identifiers
+func identities(e models.BundleEntry, resource Resource) []string {
+	var ids []string
+	if e.FullUrl != nil {
+		ids = append(ids, *e.FullUrl)
+	}
+	if resource == nil {
+		return ids
+	}
+
+	resourceType := resource.Type()
+	if id := resource.Id(); id != "" {
+		ids = append(ids, resourceType+"/"+id)
+	}
+	if e.Request != nil {
+		if strings.HasPrefix(e.Request.Url, resourceType+"?") {
+			ids = append(ids, e.Request.Url)
+		}
+		if e.Request.IfNoneExist != nil {
+			ids = append(ids, resourceType+"?"+*e.Request.IfNoneExist)
+		}
+	}
+	for _, i := range flatten(resource["identifier"]) {
+		identifier, _ := i.(map[string]interface{})
+		system, _ := identifier["system"].(string)
+		value, _ := identifier["value"].(string)
+		if value != "" {
+			ids = append(ids, resourceType+"?identifier="+system+"|"+value,
+				resourceType+"?identifier="+url.QueryEscape(system+"|"+value))
+		}
+	}
+	return ids
+}
+
+// collectReferences returns the values of all Reference.reference elements of
+// the element except references to contained resources
+func collectReferences(element interface{}) []string {
+	var refs []string
+	switch e := element.(type) {
+	case Resource:
+		return collectReferences(map[string]interface{}(e))
+	case map[string]interface{}:
+		for k, v := range e {
+			if s, ok := v.(string); ok && k == "reference" && !strings.HasPrefix(s, "#") {
+				refs = append(refs, s)
+				continue
+			}
+			if k != "contained" {
+				refs = append(refs, collectReferences(v)...)
+			}
+		}
+	case []interface{}:
+		for _, v := range e {
+			refs = append(refs, collectReferences(v)...)
+		}
+	}
+	return refs
+}
+
+// isLocal checks if the reference is relative ([type]/[id] or conditional) or
+// a urn, which must be resolved in the bundle. Absolute urls are external
+func isLocal(ref string) bool {
+	return !strings.HasPrefix(ref, "http://") && !strings.HasPrefix(ref, "https://")
+}
+
+// searchQuery returns the search for a relative reference
+func searchQuery(ref string) string {
+	if resourceType, query, conditional := strings.Cut(ref, "?"); conditional {
+		return resourceType + "?" + query
+	}
+	resourceType, id, _ := strings.Cut(ref, "/")
+	id, _, _ = strings.Cut(id, "/_history")
+	return resourceType + "?_id=" + url.QueryEscape(id)
+}
+
+// reorder sorts the entries so that referenced entries precede the entries
+// referencing them. Otherwise, the order is kept. Entries in reference cycles
+// keep their order
+func reorder(entries []models.BundleEntry, resolved map[int][]int) []models.BundleEntry {
+	result := make([]models.BundleEntry, 0, len(entries))
+	added := make([]bool, len(entries))
+	visiting := make([]bool, len(entries))
+
+	var visit func(i int)
+	visit = func(i int) {
+		if added[i] || visiting[i] {
+			return
+		}
+		visiting[i] = true
+		for _, j := range resolved[i] {
+			visit(j)
+		}
+		added[i] = true
+		result = append(result, entries[i])
+	}
+	for i := range entries {
+		visit(i)
+	}
+	return result
+}
+
+func values(refs []reference) []string {
+	result := make([]string, len(refs))
+	for i, r := range refs {
+		result[i] = fmt.Sprintf("%s (entry %d)", r.value, r.entry)
+	}
+	return result
+}
@@ -0,0 +1,112 @@
+package fhir
+
+import (
+	"encoding/json"
+	"errors"
+	"fhir-to-server/pkg/config"
+	"fmt"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const referencesBundle = `{"resourceType": "Bundle","type": "transaction","entry": [
+	{"fullUrl": "urn:uuid:obs","resource": {"resourceType": "Observation","id": "o1","subject": {"reference": "Patient/p1"},
+		"encounter": {"reference": "urn:uuid:enc"},"performer": [{"reference": "Practitioner?identifier=https://example.org/lanr|123"}],
+		"hasMember": [{"reference": "#contained"},{"reference": "https://other.org/fhir/Observation/1"}]},
+		"request": {"method": "PUT","url": "Observation/o1"}},
+	{"fullUrl": "urn:uuid:enc","resource": {"resourceType": "Encounter","subject": {"reference": "Patient/p1"}},
+		"request": {"method": "POST","url": "Encounter"}},
+	{"resource": {"resourceType": "Patient","id": "p1"},"request": {"method": "PUT","url": "Patient/p1"}}
+]}`
+
+func newTestReferenceChecker(policy string, lookup bool) (*ReferenceChecker, *Client) {
+	client := NewClient(config.Fhir{Server: config.Server{BaseUrl: "https://dummy-url/fhir"}})
+	c := NewReferenceChecker(config.References{Policy: policy, Lookup: lookup, CacheTtl: time.Hour})
+	c.target = func(MessageInfo) (*Client, error) { return client, nil }
+	return c, client
+}
+
+func entryTypes(payload *Payload) []string {
+	var types []string
+	for _, e := range payload.Bundle.Entry {
+		var r Resource
+		_ = json.Unmarshal(e.Resource, &r)
+		types = append(types, r.Type())
+	}
+	return types
+}
+
+func TestReferenceCheckerReorder(t *testing.T) {
+	c, _ := newTestReferenceChecker("reorder", false)
+	payload, _ := ParsePayload([]byte(referencesBundle), "")
+
+	err := c.Transform(payload, MessageInfo{})
+
+	// the practitioner can't be resolved, but reorder never rejects
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Patient", "Encounter", "Observation"}, entryTypes(payload))
+}
+
+func TestReferenceCheckerReject(t *testing.T) {
+	cases := []struct {
+		name     string
+		total    int
+		rejected bool
+	}{
+		{"exists", 1, false},
+		{"missing", 0, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			checker, client := newTestReferenceChecker("reject", true)
+			httpmock.Reset()
+			httpmock.ActivateNonDefault(client.rest.GetClient())
+			httpmock.RegisterResponderWithQuery("GET", "https://dummy-url/fhir/Practitioner",
+				"identifier=https://example.org/lanr|123&_summary=count",
+				httpmock.NewStringResponder(200, fmt.Sprintf(`{"resourceType": "Bundle","type": "searchset","total": %d}`, c.total)))
+			payload, _ := ParsePayload([]byte(referencesBundle), "")
+
+			err := checker.Transform(payload, MessageInfo{})
+
+			var dlErr *DeadLetterError
+			assert.Equal(t, c.rejected, errors.As(err, &dlErr))
+			if c.rejected {
+				assert.ErrorContains(t, err, "Practitioner?identifier=https://example.org/lanr|123 (entry 0)")
+			}
+			// order is kept
+			assert.Equal(t, []string{"Observation", "Encounter", "Patient"}, entryTypes(payload))
+			assert.Equal(t, 1, httpmock.GetTotalCallCount())
+		})
+	}
+}
+
+func TestReferenceCheckerHold(t *testing.T) {
+	checker, client := newTestReferenceChecker("hold", true)
+	httpmock.Reset()
+	httpmock.ActivateNonDefault(client.rest.GetClient())
+	// the patient is loaded by another producer in the meantime
+	httpmock.RegisterResponder("GET", "https://dummy-url/fhir/Patient", httpmock.ResponderFromMultipleResponses([]*http.Response{
+		httpmock.NewStringResponse(200, `{"resourceType": "Bundle","type": "searchset","total": 0}`),
+		httpmock.NewStringResponse(200, `{"resourceType": "Bundle","type": "searchset","total": 1}`),
+	}))
+	payload, _ := ParsePayload([]byte(`{"resourceType": "Observation","subject": {"reference": "Patient/p1"}}`), "")
+
+	// held messages are not waited for, but parked by the processor
+	err := checker.Transform(payload, MessageInfo{})
+	var dangling *DanglingReferencesError
+	assert.True(t, errors.As(err, &dangling))
+	assert.Equal(t, 1, httpmock.GetTotalCallCount())
+
+	err = checker.Transform(payload, MessageInfo{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, httpmock.GetTotalCallCount())
+
+	// existing references are cached
+	err = checker.Transform(payload, MessageInfo{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, httpmock.GetTotalCallCount())
+}
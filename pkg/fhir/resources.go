@@ -0,0 +1,157 @@
+package fhir
+
+import (
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"reflect"
+)
+
+// resourceTypes are the models of the R4 resource types used for structural
+// validation
+var resourceTypes = map[string]reflect.Type{
+	"Account":                           reflect.TypeOf(models.Account{}),
+	"ActivityDefinition":                reflect.TypeOf(models.ActivityDefinition{}),
+	"AdverseEvent":                      reflect.TypeOf(models.AdverseEvent{}),
+	"AllergyIntolerance":                reflect.TypeOf(models.AllergyIntolerance{}),
+	"Appointment":                       reflect.TypeOf(models.Appointment{}),
+	"AppointmentResponse":               reflect.TypeOf(models.AppointmentResponse{}),
+	"AuditEvent":                        reflect.TypeOf(models.AuditEvent{}),
+	"Basic":                             reflect.TypeOf(models.Basic{}),
+	"Binary":                            reflect.TypeOf(models.Binary{}),
+	"BiologicallyDerivedProduct":        reflect.TypeOf(models.BiologicallyDerivedProduct{}),
+	"BodyStructure":                     reflect.TypeOf(models.BodyStructure{}),
+	"Bundle":                            reflect.TypeOf(models.Bundle{}),
+	"CapabilityStatement":               reflect.TypeOf(models.CapabilityStatement{}),
+	"CarePlan":                          reflect.TypeOf(models.CarePlan{}),
+	"CareTeam":                          reflect.TypeOf(models.CareTeam{}),
+	"CatalogEntry":                      reflect.TypeOf(models.CatalogEntry{}),
+	"ChargeItem":                        reflect.TypeOf(models.ChargeItem{}),
+	"ChargeItemDefinition":              reflect.TypeOf(models.ChargeItemDefinition{}),
+	"Claim":                             reflect.TypeOf(models.Claim{}),
+	"ClaimResponse":                     reflect.TypeOf(models.ClaimResponse{}),
+	"ClinicalImpression":                reflect.TypeOf(models.ClinicalImpression{}),
+	"CodeSystem":                        reflect.TypeOf(models.CodeSystem{}),
+	"Communication":                     reflect.TypeOf(models.Communication{}),
+	"CommunicationRequest":              reflect.TypeOf(models.CommunicationRequest{}),
+	"CompartmentDefinition":             reflect.TypeOf(models.CompartmentDefinition{}),
+	"Composition":                       reflect.TypeOf(models.Composition{}),
+	"ConceptMap":                        reflect.TypeOf(models.ConceptMap{}),
+	"Condition":                         reflect.TypeOf(models.Condition{}),
+	"Consent":                           reflect.TypeOf(models.Consent{}),
+	"Contract":                          reflect.TypeOf(models.Contract{}),
+	"Coverage":                          reflect.TypeOf(models.Coverage{}),
+	"CoverageEligibilityRequest":        reflect.TypeOf(models.CoverageEligibilityRequest{}),
+	"CoverageEligibilityResponse":       reflect.TypeOf(models.CoverageEligibilityResponse{}),
+	"DetectedIssue":                     reflect.TypeOf(models.DetectedIssue{}),
+	"Device":                            reflect.TypeOf(models.Device{}),
+	"DeviceDefinition":                  reflect.TypeOf(models.DeviceDefinition{}),
+	"DeviceMetric":                      reflect.TypeOf(models.DeviceMetric{}),
+	"DeviceRequest":                     reflect.TypeOf(models.DeviceRequest{}),
+	"DeviceUseStatement":                reflect.TypeOf(models.DeviceUseStatement{}),
+	"DiagnosticReport":                  reflect.TypeOf(models.DiagnosticReport{}),
+	"DocumentManifest":                  reflect.TypeOf(models.DocumentManifest{}),
+	"DocumentReference":                 reflect.TypeOf(models.DocumentReference{}),
+	"EffectEvidenceSynthesis":           reflect.TypeOf(models.EffectEvidenceSynthesis{}),
+	"Encounter":                         reflect.TypeOf(models.Encounter{}),
+	"Endpoint":                          reflect.TypeOf(models.Endpoint{}),
+	"EnrollmentRequest":                 reflect.TypeOf(models.EnrollmentRequest{}),
+	"EnrollmentResponse":                reflect.TypeOf(models.EnrollmentResponse{}),
+	"EpisodeOfCare":                     reflect.TypeOf(models.EpisodeOfCare{}),
+	"EventDefinition":                   reflect.TypeOf(models.EventDefinition{}),
+	"Evidence":                          reflect.TypeOf(models.Evidence{}),
+	"EvidenceVariable":                  reflect.TypeOf(models.EvidenceVariable{}),
+	"ExampleScenario":                   reflect.TypeOf(models.ExampleScenario{}),
+	"ExplanationOfBenefit":              reflect.TypeOf(models.ExplanationOfBenefit{}),
+	"FamilyMemberHistory":               reflect.TypeOf(models.FamilyMemberHistory{}),
+	"Flag":                              reflect.TypeOf(models.Flag{}),
+	"Goal":                              reflect.TypeOf(models.Goal{}),
+	"GraphDefinition":                   reflect.TypeOf(models.GraphDefinition{}),
+	"Group":                             reflect.TypeOf(models.Group{}),
+	"GuidanceResponse":                  reflect.TypeOf(models.GuidanceResponse{}),
+	"HealthcareService":                 reflect.TypeOf(models.HealthcareService{}),
+	"ImagingStudy":                      reflect.TypeOf(models.ImagingStudy{}),
+	"Immunization":                      reflect.TypeOf(models.Immunization{}),
+	"ImmunizationEvaluation":            reflect.TypeOf(models.ImmunizationEvaluation{}),
+	"ImmunizationRecommendation":        reflect.TypeOf(models.ImmunizationRecommendation{}),
+	"ImplementationGuide":               reflect.TypeOf(models.ImplementationGuide{}),
+	"InsurancePlan":                     reflect.TypeOf(models.InsurancePlan{}),
+	"Invoice":                           reflect.TypeOf(models.Invoice{}),
+	"Library":                           reflect.TypeOf(models.Library{}),
+	"Linkage":                           reflect.TypeOf(models.Linkage{}),
+	"List":                              reflect.TypeOf(models.List{}),
+	"Location":                          reflect.TypeOf(models.Location{}),
+	"Measure":                           reflect.TypeOf(models.Measure{}),
+	"MeasureReport":                     reflect.TypeOf(models.MeasureReport{}),
+	"Media":                             reflect.TypeOf(models.Media{}),
+	"Medication":                        reflect.TypeOf(models.Medication{}),
+	"MedicationAdministration":          reflect.TypeOf(models.MedicationAdministration{}),
+	"MedicationDispense":                reflect.TypeOf(models.MedicationDispense{}),
+	"MedicationKnowledge":               reflect.TypeOf(models.MedicationKnowledge{}),
+	"MedicationRequest":                 reflect.TypeOf(models.MedicationRequest{}),
+	"MedicationStatement":               reflect.TypeOf(models.MedicationStatement{}),
+	"MedicinalProduct":                  reflect.TypeOf(models.MedicinalProduct{}),
+	"MedicinalProductAuthorization":     reflect.TypeOf(models.MedicinalProductAuthorization{}),
+	"MedicinalProductContraindication":  reflect.TypeOf(models.MedicinalProductContraindication{}),
+	"MedicinalProductIndication":        reflect.TypeOf(models.MedicinalProductIndication{}),
+	"MedicinalProductIngredient":        reflect.TypeOf(models.MedicinalProductIngredient{}),
+	"MedicinalProductInteraction":       reflect.TypeOf(models.MedicinalProductInteraction{}),
+	"MedicinalProductManufactured":      reflect.TypeOf(models.MedicinalProductManufactured{}),
+	"MedicinalProductPackaged":          reflect.TypeOf(models.MedicinalProductPackaged{}),
+	"MedicinalProductPharmaceutical":    reflect.TypeOf(models.MedicinalProductPharmaceutical{}),
+	"MedicinalProductUndesirableEffect": reflect.TypeOf(models.MedicinalProductUndesirableEffect{}),
+	"MessageDefinition":                 reflect.TypeOf(models.MessageDefinition{}),
+	"MessageHeader":                     reflect.TypeOf(models.MessageHeader{}),
+	"MolecularSequence":                 reflect.TypeOf(models.MolecularSequence{}),
+	"NamingSystem":                      reflect.TypeOf(models.NamingSystem{}),
+	"NutritionOrder":                    reflect.TypeOf(models.NutritionOrder{}),
+	"Observation":                       reflect.TypeOf(models.Observation{}),
+	"ObservationDefinition":             reflect.TypeOf(models.ObservationDefinition{}),
+	"OperationDefinition":               reflect.TypeOf(models.OperationDefinition{}),
+	"OperationOutcome":                  reflect.TypeOf(models.OperationOutcome{}),
+	"Organization":                      reflect.TypeOf(models.Organization{}),
+	"OrganizationAffiliation":           reflect.TypeOf(models.OrganizationAffiliation{}),
+	"Parameters":                        reflect.TypeOf(models.Parameters{}),
+	"Patient":                           reflect.TypeOf(models.Patient{}),
+	"PaymentNotice":                     reflect.TypeOf(models.PaymentNotice{}),
+	"PaymentReconciliation":             reflect.TypeOf(models.PaymentReconciliation{}),
+	"Person":                            reflect.TypeOf(models.Person{}),
+	"PlanDefinition":                    reflect.TypeOf(models.PlanDefinition{}),
+	"Practitioner":                      reflect.TypeOf(models.Practitioner{}),
+	"PractitionerRole":                  reflect.TypeOf(models.PractitionerRole{}),
+	"Procedure":                         reflect.TypeOf(models.Procedure{}),
+	"Provenance":                        reflect.TypeOf(models.Provenance{}),
+	"Questionnaire":                     reflect.TypeOf(models.Questionnaire{}),
+	"QuestionnaireResponse":             reflect.TypeOf(models.QuestionnaireResponse{}),
+	"RelatedPerson":                     reflect.TypeOf(models.RelatedPerson{}),
+	"RequestGroup":                      reflect.TypeOf(models.RequestGroup{}),
+	"ResearchDefinition":                reflect.TypeOf(models.ResearchDefinition{}),
+	"ResearchElementDefinition":         reflect.TypeOf(models.ResearchElementDefinition{}),
+	"ResearchStudy":                     reflect.TypeOf(models.ResearchStudy{}),
+	"ResearchSubject":                   reflect.TypeOf(models.ResearchSubject{}),
+	"RiskAssessment":                    reflect.TypeOf(models.RiskAssessment{}),
+	"RiskEvidenceSynthesis":             reflect.TypeOf(models.RiskEvidenceSynthesis{}),
+	"Schedule":                          reflect.TypeOf(models.Schedule{}),
+	"SearchParameter":                   reflect.TypeOf(models.SearchParameter{}),
+	"ServiceRequest":                    reflect.TypeOf(models.ServiceRequest{}),
+	"Slot":                              reflect.TypeOf(models.Slot{}),
+	"Specimen":                          reflect.TypeOf(models.Specimen{}),
+	"SpecimenDefinition":                reflect.TypeOf(models.SpecimenDefinition{}),
+	"StructureDefinition":               reflect.TypeOf(models.StructureDefinition{}),
+	"StructureMap":                      reflect.TypeOf(models.StructureMap{}),
+	"Subscription":                      reflect.TypeOf(models.Subscription{}),
+	"Substance":                         reflect.TypeOf(models.Substance{}),
+	"SubstanceNucleicAcid":              reflect.TypeOf(models.SubstanceNucleicAcid{}),
+	"SubstancePolymer":                  reflect.TypeOf(models.SubstancePolymer{}),
+	"SubstanceProtein":                  reflect.TypeOf(models.SubstanceProtein{}),
+	"SubstanceReferenceInformation":     reflect.TypeOf(models.SubstanceReferenceInformation{}),
+	"SubstanceSourceMaterial":           reflect.TypeOf(models.SubstanceSourceMaterial{}),
+	"SubstanceSpecification":            reflect.TypeOf(models.SubstanceSpecification{}),
+	"SupplyDelivery":                    reflect.TypeOf(models.SupplyDelivery{}),
+	"SupplyRequest":                     reflect.TypeOf(models.SupplyRequest{}),
+	"Task":                              reflect.TypeOf(models.Task{}),
+	"TerminologyCapabilities":           reflect.TypeOf(models.TerminologyCapabilities{}),
+	"TestReport":                        reflect.TypeOf(models.TestReport{}),
+	"TestScript":                        reflect.TypeOf(models.TestScript{}),
+	"ValueSet":                          reflect.TypeOf(models.ValueSet{}),
+	"VerificationResult":                reflect.TypeOf(models.VerificationResult{}),
+	"VisionPrescription":                reflect.TypeOf(models.VisionPrescription{}),
+}
@@ -0,0 +1,114 @@
+package fhir
+
+import (
+	"fhir-to-server/pkg/config"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+// TombstoneHandler deletes resources on the FHIR server for tombstone records.
+// The resource is derived from the message key by a pattern with named groups:
+// "type" and "id" for [type]/[id] or "type", "system" and "value" for a
+// conditional delete by identifier. The resource type may also be configured
+type TombstoneHandler struct {
+	config  config.Tombstone
+	pattern *regexp.Regexp
+}
+
+func NewTombstoneHandler(config config.Tombstone) *TombstoneHandler {
+	pattern, err := regexp.Compile(config.KeyPattern)
+	if err != nil {
+		log.Fatal().Err(err).Str("pattern", config.KeyPattern).Msg("Invalid tombstone key pattern")
+	}
+	return &TombstoneHandler{config: config, pattern: pattern}
+}
+
+// url returns the relative url of the resource to delete
+func (h *TombstoneHandler) url(key string) (string, error) {
+	match := h.pattern.FindStringSubmatch(key)
+	if match == nil {
+		return "", fmt.Errorf("message key doesn't match tombstone key pattern: %s", key)
+	}
+
+	groups := map[string]string{"type": h.config.ResourceType}
+	for i, name := range h.pattern.SubexpNames() {
+		if name != "" && match[i] != "" {
+			groups[name] = match[i]
+		}
+	}
+
+	resourceType := groups["type"]
+	switch {
+	case resourceType == "":
+		return "", fmt.Errorf("unable to determine resource type from key: %s", key)
+	case groups["id"] != "":
+		return resourceType + "/" + groups["id"], nil
+	case groups["value"] != "":
+		identifier := groups["value"]
+		if system := groups["system"]; system != "" {
+			identifier = system + "|" + identifier
+		}
+		return resourceType + "?identifier=" + url.QueryEscape(identifier), nil
+	default:
+		return "", fmt.Errorf("unable to determine resource id or identifier from key: %s", key)
+	}
+}
+
+// deleteSuccess checks the status of a delete response. Resources which are
+// already gone are considered deleted
+func deleteSuccess(status int) bool {
+	return statusSuccess(status) || status == http.StatusNotFound || status == http.StatusGone
+}
+
+// handleTombstone deletes the resource derived from the tombstone's key.
+// Errors are only returned, if the configured error handling is to fail
+func (p *Processor) handleTombstone(info MessageInfo) error {
+	err := p.deleteResource(info)
+	if err == nil {
+		p.forget(info)
+		log.Debug().
+			Str("topic", info.Topic).
+			Str("key", info.Key).
+			Int64("offset", info.Offset).
+			Msg("Tombstone record processed. Resource deleted")
+		return nil
+	}
+
+	if p.tombstone.config.OnError == "skip" {
+		log.Warn().Err(err).
+			Str("topic", info.Topic).
+			Str("key", info.Key).
+			Int64("offset", info.Offset).
+			Msg("Failed to delete resource for tombstone record. Message skipped")
+		return nil
+	}
+	return err
+}
+
+func (p *Processor) deleteResource(info MessageInfo) error {
+	resourceUrl, err := p.tombstone.url(info.Key)
+	if err != nil {
+		return err
+	}
+	for _, t := range p.transformers {
+		if r, ok := t.(ReferenceRewriter); ok {
+			resourceUrl = r.RewriteReference(resourceUrl)
+		}
+	}
+	client, err := p.target(info)
+	if err != nil {
+		return err
+	}
+
+	status, err := client.Delete(resourceUrl, info.propagated(p.headers.Propagate))
+	if err != nil {
+		return err
+	}
+	if !deleteSuccess(status) {
+		return fmt.Errorf("failed to delete %s: status %d", resourceUrl, status)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package fhir
+
+import (
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTombstoneUrl(t *testing.T) {
+	cases := []struct {
+		name         string
+		pattern      string
+		resourceType string
+		key          string
+		expected     string
+		expectedErr  bool
+	}{
+		{
+			name:     "type and id",
+			pattern:  `^(?P<type>[A-Za-z]+)/(?P<id>[A-Za-z0-9\-.]{1,64})$`,
+			key:      "Patient/123",
+			expected: "Patient/123",
+		},
+		{
+			name:         "configured type",
+			pattern:      `^(?P<id>.+)$`,
+			resourceType: "Patient",
+			key:          "123",
+			expected:     "Patient/123",
+		},
+		{
+			name:         "identifier",
+			pattern:      `^(?P<value>\d+)$`,
+			resourceType: "Patient",
+			key:          "123",
+			expected:     "Patient?identifier=123",
+		},
+		{
+			name:     "system and identifier",
+			pattern:  `^(?P<type>[A-Za-z]+)\|(?P<system>[^|]+)\|(?P<value>.+)$`,
+			key:      "Encounter|https://fhir.diz.uni-marburg.de/sid/encounter-id|42",
+			expected: "Encounter?identifier=https%3A%2F%2Ffhir.diz.uni-marburg.de%2Fsid%2Fencounter-id%7C42",
+		},
+		{
+			name:        "no match",
+			pattern:     `^(?P<type>[A-Za-z]+)/(?P<id>[A-Za-z0-9\-.]{1,64})$`,
+			key:         "123",
+			expectedErr: true,
+		},
+		{
+			name:        "missing type",
+			pattern:     `^(?P<id>.+)$`,
+			key:         "123",
+			expectedErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := NewTombstoneHandler(config.Tombstone{KeyPattern: c.pattern, ResourceType: c.resourceType})
+
+			actual, err := h.url(c.key)
+
+			assert.Equal(t, c.expectedErr, err != nil)
+			assert.Equal(t, c.expected, actual)
+		})
+	}
+}
+
+func TestProcessTombstone(t *testing.T) {
+	cases := []struct {
+		name     string
+		status   int
+		onError  string
+		resultOk bool
+	}{
+		{name: "deleted", status: 204, onError: "fail", resultOk: true},
+		{name: "not found", status: 404, onError: "fail", resultOk: true},
+		{name: "error", status: 412, onError: "fail", resultOk: false},
+		{name: "error skipped", status: 412, onError: "skip", resultOk: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			baseUrl := "https://dummy-url/fhir"
+			p := NewProcessor(config.Fhir{
+				Server: config.Server{BaseUrl: baseUrl},
+				Tombstone: config.Tombstone{
+					Mode:       "delete",
+					KeyPattern: `^(?P<type>[A-Za-z]+)/(?P<id>[A-Za-z0-9\-.]{1,64})$`,
+					OnError:    c.onError,
+				},
+			})
+
+			// set up mock
+			httpmock.Reset()
+			httpmock.ActivateNonDefault(p.client.rest.GetClient())
+			httpmock.RegisterResponder("DELETE", baseUrl+"/Patient/1", httpmock.NewStringResponder(c.status, ""))
+
+			testTopic := "test"
+			ok := p.ProcessMessage(&source.Message{
+				Origin: source.Origin{Topic: testTopic, Offset: 42},
+				Key:    []byte("Patient/1"),
+			})
+
+			assert.Equal(t, c.resultOk, ok)
+			assert.Equal(t, 1, httpmock.GetTotalCallCount())
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package fhir
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// Transformer modifies the payload of a message before it is sent
+type Transformer interface {
+	Transform(payload *Payload, msg MessageInfo) error
+}
+
+// ReferenceRewriter is implemented by transformers which change resource
+// references. It is used to rewrite urls which are not part of a payload, e.g.
+// of resources to delete for tombstones
+type ReferenceRewriter interface {
+	RewriteReference(ref string) string
+}
+
+// Resource is a decoded FHIR resource, which can be modified by transformers
+type Resource map[string]interface{}
+
+func (r Resource) Type() string {
+	t, _ := r["resourceType"].(string)
+	return t
+}
+
+func (r Resource) Id() string {
+	id, _ := r["id"].(string)
+	return id
+}
+
+// transformEntries decodes the resources of the payload's entries, calls fn for
+// each entry and replaces the payload's entries by the modified ones. Entries
+// are removed, if fn returns false. XML payloads can't be transformed
+func transformEntries(payload *Payload, fn func(entry *models.BundleEntry, resource Resource) (bool, error)) error {
+	if payload.IsXml() {
+		return errors.New("transformations are not supported for XML payloads")
+	}
+
+	entries := make([]models.BundleEntry, 0, len(payload.Bundle.Entry))
+	for _, e := range payload.Bundle.Entry {
+		var resource Resource
+		if e.Resource != nil {
+			d := json.NewDecoder(bytes.NewReader(e.Resource))
+			d.UseNumber()
+			if err := d.Decode(&resource); err != nil {
+				return err
+			}
+		}
+
+		keep, err := fn(&e, resource)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			continue
+		}
+
+		if resource != nil {
+			if e.Resource, err = json.Marshal(resource); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	payload.SetEntries(entries)
+	return nil
+}
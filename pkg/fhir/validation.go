@@ -0,0 +1,227 @@
+package fhir
+
+import (
+	"bytes"
+	"encoding/json"
+	"fhir-to-server/pkg/config"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9\-.]{1,64}$`)
+
+// Validator checks the resources of a payload against the R4 base structure
+// and optional StructureDefinitions. Depending on the topic's policy, invalid
+// messages fail, invalid entries are dropped or issues are only logged
+type Validator struct {
+	config   config.Validation
+	profiles *Profiles
+}
+
+// ValidationError holds the issues of a message which failed validation
+type ValidationError struct {
+	Outcome models.OperationOutcome
+}
+
+func (e *ValidationError) Error() string {
+	var diagnostics []string
+	for _, issue := range e.Outcome.Issue {
+		if issue.Severity <= models.IssueSeverityError && issue.Diagnostics != nil {
+			diagnostics = append(diagnostics, *issue.Diagnostics)
+		}
+	}
+	return "validation failed: " + strings.Join(diagnostics, "; ")
+}
+
+func NewValidator(config config.Validation) (*Validator, error) {
+	v := &Validator{config: config}
+	if config.Profiles != "" {
+		profiles, err := LoadProfiles(config.Profiles)
+		if err != nil {
+			return nil, err
+		}
+		v.profiles = profiles
+	}
+	return v, nil
+}
+
+// policy returns the validation policy of the topic
+func (v *Validator) policy(topic string) string {
+	for t, policy := range v.config.Topics {
+		if strings.EqualFold(t, topic) {
+			return policy
+		}
+	}
+	return v.config.Policy
+}
+
+func (v *Validator) Transform(payload *Payload, msg MessageInfo) error {
+	policy := v.policy(msg.Topic)
+
+	var issues []models.OperationOutcomeIssue
+	err := transformEntries(payload, func(_ *models.BundleEntry, resource Resource) (bool, error) {
+		if resource == nil {
+			return true, nil
+		}
+		entryIssues := v.Validate(resource)
+		issues = append(issues, entryIssues...)
+		return policy != "drop-entry" || !hasErrors(entryIssues), nil
+	})
+	if err != nil || len(issues) == 0 {
+		return err
+	}
+
+	outcome := models.OperationOutcome{Issue: issues}
+	failed := policy == "fail" && hasErrors(issues)
+
+	logEvent := log.Warn()
+	if failed {
+		logEvent = log.Error()
+	}
+	report, _ := outcome.MarshalJSON()
+	logEvent.
+		Str("topic", msg.Topic).
+		Str("key", msg.Key).
+		Int64("offset", msg.Offset).
+		RawJSON("outcome", report).
+		Msg("Validation issues found")
+
+	if failed {
+		return &ValidationError{Outcome: outcome}
+	}
+	return nil
+}
+
+// Validate returns the issues of the resource
+func (v *Validator) Validate(resource Resource) []models.OperationOutcomeIssue {
+	resourceType := resource.Type()
+	if resourceType == "" {
+		return []models.OperationOutcomeIssue{newIssue(models.IssueTypeRequired, "resourceType", "Missing resourceType")}
+	}
+	modelType, ok := resourceTypes[resourceType]
+	if !ok {
+		return []models.OperationOutcomeIssue{newIssue(models.IssueTypeStructure, "resourceType",
+			fmt.Sprintf("Unknown resource type: %s", resourceType))}
+	}
+
+	var issues []models.OperationOutcomeIssue
+	if id, present := resource["id"]; present {
+		if s, ok := id.(string); !ok || !idPattern.MatchString(s) {
+			issues = append(issues, newIssue(models.IssueTypeValue, resourceType+".id", fmt.Sprintf("Invalid id: %v", id)))
+		}
+	}
+	if err := decodeStrict(resource, modelType); err != nil {
+		issues = append(issues, newIssue(models.IssueTypeStructure, resourceType, err.Error()))
+	}
+	issues = append(issues, required(resource, modelType, resourceType)...)
+
+	if v.profiles != nil {
+		issues = append(issues, v.profiles.Validate(resource)...)
+	}
+	return issues
+}
+
+// decodeStrict decodes the resource into its model, which fails for unknown
+// elements, wrong cardinalities, JSON types and codes
+func decodeStrict(resource Resource, modelType reflect.Type) error {
+	element := withoutPrimitiveExtensions(map[string]interface{}(resource)).(map[string]interface{})
+	delete(element, "resourceType")
+
+	data, err := json.Marshal(element)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	return d.Decode(reflect.New(modelType).Interface())
+}
+
+// withoutPrimitiveExtensions copies the element without the extensions of
+// primitive values (_[name]), which are not part of the models
+func withoutPrimitiveExtensions(element interface{}) interface{} {
+	switch e := element.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(e))
+		for k, v := range e {
+			if !strings.HasPrefix(k, "_") {
+				result[k] = withoutPrimitiveExtensions(v)
+			}
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(e))
+		for i, v := range e {
+			result[i] = withoutPrimitiveExtensions(v)
+		}
+		return result
+	default:
+		return e
+	}
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// required checks the presence of required elements, which are the non-pointer
+// fields of the models without omitempty
+func required(element map[string]interface{}, modelType reflect.Type, path string) []models.OperationOutcomeIssue {
+	var issues []models.OperationOutcomeIssue
+	for i := 0; i < modelType.NumField(); i++ {
+		field := modelType.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" || field.Type == rawMessageType {
+			continue
+		}
+
+		value, present := element[name]
+		_, extended := element["_"+name]
+		if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer {
+			if values, isArray := value.([]interface{}); (!present && !extended) || (isArray && len(values) == 0) {
+				issues = append(issues, newIssue(models.IssueTypeRequired, path+"."+name,
+					fmt.Sprintf("Missing required element: %s.%s", path, name)))
+				continue
+			}
+		}
+
+		// nested elements
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Pointer || fieldType.Kind() == reflect.Slice {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() != reflect.Struct {
+			continue
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			issues = append(issues, required(v, fieldType, path+"."+name)...)
+		case []interface{}:
+			for j, e := range v {
+				if m, ok := e.(map[string]interface{}); ok {
+					issues = append(issues, required(m, fieldType, fmt.Sprintf("%s.%s[%d]", path, name, j))...)
+				}
+			}
+		}
+	}
+	return issues
+}
+
+func newIssue(code models.IssueType, expression, diagnostics string) models.OperationOutcomeIssue {
+	return models.OperationOutcomeIssue{
+		Severity:    models.IssueSeverityError,
+		Code:        code,
+		Diagnostics: &diagnostics,
+		Expression:  []string{expression},
+	}
+}
+
+func hasErrors(issues []models.OperationOutcomeIssue) bool {
+	for _, issue := range issues {
+		if issue.Severity <= models.IssueSeverityError {
+			return true
+		}
+	}
+	return false
+}
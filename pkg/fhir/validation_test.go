@@ -0,0 +1,83 @@
+package fhir
+
+import (
+	"encoding/json"
+	"errors"
+	"fhir-to-server/pkg/config"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestValidatorValidate(t *testing.T) {
+	cases := []struct {
+		name     string
+		resource string
+		codes    []models.IssueType
+	}{
+		{"valid", `{"resourceType": "Observation","id": "1","status": "final","code": {"text": "Hb"},"_status": {"id": "s"}}`, nil},
+		{"primitiveExtension", `{"resourceType": "Patient","_birthDate": {"extension": [{"url": "http://example.org"}]}}`, nil},
+		{"missingType", `{"id": "1"}`, []models.IssueType{models.IssueTypeRequired}},
+		{"unknownType", `{"resourceType": "Observaton"}`, []models.IssueType{models.IssueTypeStructure}},
+		{"invalidId", `{"resourceType": "Patient","id": "1/2"}`, []models.IssueType{models.IssueTypeValue}},
+		{"unknownElement", `{"resourceType": "Patient","nam": []}`, []models.IssueType{models.IssueTypeStructure}},
+		{"cardinality", `{"resourceType": "Patient","gender": ["male"]}`, []models.IssueType{models.IssueTypeStructure}},
+		{"invalidCode", `{"resourceType": "Observation","status": "done","code": {}}`, []models.IssueType{models.IssueTypeStructure}},
+		{"required", `{"resourceType": "Observation","code": {"coding": [{"code": "x"}]}}`, []models.IssueType{models.IssueTypeRequired}},
+		{"requiredNested", `{"resourceType": "Patient","extension": [{"valueString": "x"}]}`, []models.IssueType{models.IssueTypeRequired}},
+	}
+
+	v, _ := NewValidator(config.Validation{})
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var resource Resource
+			_ = json.Unmarshal([]byte(c.resource), &resource)
+
+			var codes []models.IssueType
+			for _, issue := range v.Validate(resource) {
+				codes = append(codes, issue.Code)
+			}
+			assert.Equal(t, c.codes, codes)
+		})
+	}
+}
+
+func TestValidatorTransform(t *testing.T) {
+	bundle := []byte(`{"resourceType": "Bundle","type": "batch","entry": [
+		{"resource": {"resourceType": "Patient","id": "1"}},
+		{"resource": {"resourceType": "Observation","id": "2"}}
+	]}`)
+
+	cases := []struct {
+		name    string
+		topic   string
+		entries int
+		failed  bool
+	}{
+		{"fail", "lab-fhir", 0, true},
+		{"warn", "person-fhir", 2, false},
+		{"dropEntry", "encounter-fhir", 1, false},
+	}
+
+	v, _ := NewValidator(config.Validation{
+		Policy: "fail",
+		Topics: map[string]string{"person-fhir": "warn", "encounter-fhir": "drop-entry"},
+	})
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			payload, _ := ParsePayload(bundle, "")
+
+			err := v.Transform(payload, MessageInfo{Topic: c.topic})
+
+			var validationErr *ValidationError
+			assert.Equal(t, c.failed, errors.As(err, &validationErr))
+			if c.failed {
+				assert.Len(t, validationErr.Outcome.Issue, 2)
+				assert.ErrorContains(t, err, "Missing required element: Observation.status")
+			} else {
+				assert.NoError(t, err)
+				assert.Len(t, payload.Bundle.Entry, c.entries)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package fhir
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"io"
+)
+
+const (
+	JsonContentType = "application/fhir+json"
+	XmlContentType  = "application/fhir+xml"
+)
+
+// xmlNode is a generic FHIR XML element
+type xmlNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Nodes   []xmlNode  `xml:",any"`
+}
+
+func (n xmlNode) attr(name string) (string, bool) {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+func (n xmlNode) child(name string) *xmlNode {
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == name {
+			return &n.Nodes[i]
+		}
+	}
+	return nil
+}
+
+func (n xmlNode) value(name string) string {
+	if c := n.child(name); c != nil {
+		v, _ := c.attr("value")
+		return v
+	}
+	return ""
+}
+
+// isXml sniffs the content for an XML document
+func isXml(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("<"))
+}
+
+// parseXmlPayload parses a FHIR XML bundle or resource. The payload's bundle
+// holds a JSON view of the XML resources, which is sufficient for filtering
+// but not a lossless conversion. The XML content is sent as it is
+func parseXmlPayload(data []byte) (*Payload, error) {
+	data, err := trimXmlProlog(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var root xmlNode
+	if err = xml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+
+	p := &Payload{ContentType: XmlContentType, raw: data}
+	if root.XMLName.Local != "Bundle" {
+		entry, err := resourceEntry(root.jsonResource())
+		if err != nil {
+			return nil, err
+		}
+		p.Type = ResourcePayload
+		p.Bundle = models.Bundle{Type: models.BundleTypeBatch, Entry: []models.BundleEntry{entry}}
+		return p, nil
+	}
+
+	p.Type = BundlePayload
+	if err = p.Bundle.Type.UnmarshalJSON([]byte(root.value("type"))); err != nil {
+		return nil, err
+	}
+	for _, e := range root.Nodes {
+		if e.XMLName.Local != "entry" {
+			continue
+		}
+		entry := models.BundleEntry{}
+		if fullUrl := e.value("fullUrl"); fullUrl != "" {
+			entry.FullUrl = &fullUrl
+		}
+		if r := e.child("resource"); r != nil && len(r.Nodes) > 0 {
+			entry.Resource = r.Nodes[0].jsonResource()
+		}
+		if r := e.child("request"); r != nil {
+			entry.Request = &models.BundleEntryRequest{Url: r.value("url")}
+			if err = entry.Request.Method.UnmarshalJSON([]byte(r.value("method"))); err != nil {
+				return nil, err
+			}
+		}
+		p.Bundle.Entry = append(p.Bundle.Entry, entry)
+	}
+
+	return p, nil
+}
+
+// trimXmlProlog removes the XML declaration, comments and processing
+// instructions preceding the root element
+func trimXmlProlog(data []byte) ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		offset := d.InputOffset()
+		t, err := d.Token()
+		if err == io.EOF {
+			return nil, errors.New("missing XML root element")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := t.(xml.StartElement); ok {
+			return data[offset:], nil
+		}
+	}
+}
+
+// jsonResource converts the resource element to its JSON view
+func (n xmlNode) jsonResource() json.RawMessage {
+	r, ok := n.jsonValue().(map[string]interface{})
+	if !ok {
+		r = make(map[string]interface{})
+	}
+	r["resourceType"] = n.XMLName.Local
+
+	b, _ := json.Marshal(r)
+	return b
+}
+
+func (n xmlNode) jsonValue() interface{} {
+	if v, ok := n.attr("value"); ok && len(n.Nodes) == 0 {
+		return v
+	}
+
+	obj := make(map[string]interface{})
+	for _, c := range n.Nodes {
+		name := c.XMLName.Local
+		if name == "div" {
+			// narrative xhtml
+			continue
+		}
+
+		v := c.jsonValue()
+		switch existing := obj[name].(type) {
+		case nil:
+			obj[name] = v
+		case []interface{}:
+			obj[name] = append(existing, v)
+		default:
+			obj[name] = []interface{}{existing, v}
+		}
+	}
+	return obj
+}
+
+// wrapXmlResource wraps the XML resource in a batch bundle with the given
+// request
+func wrapXmlResource(resource []byte, request *models.BundleEntryRequest) []byte {
+	var b bytes.Buffer
+	b.WriteString(`<Bundle xmlns="http://hl7.org/fhir"><type value="batch"/><entry><resource>`)
+	b.Write(resource)
+	b.WriteString(`</resource><request>`)
+	_, _ = fmt.Fprintf(&b, `<method value="%s"/><url value="`, request.Method.Code())
+	_ = xml.EscapeText(&b, []byte(request.Url))
+	b.WriteString(`"/></request></entry></Bundle>`)
+	return b.Bytes()
+}
@@ -0,0 +1,104 @@
+package fhir
+
+import (
+	"encoding/json"
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const xmlBundle = `<?xml version="1.0" encoding="UTF-8"?>
+<Bundle xmlns="http://hl7.org/fhir">
+  <type value="batch"/>
+  <entry>
+    <fullUrl value="urn:uuid:1"/>
+    <resource>
+      <Observation>
+        <id value="1"/>
+        <text><div xmlns="http://www.w3.org/1999/xhtml">narrative</div></text>
+        <status value="final"/>
+        <code>
+          <coding><system value="http://loinc.org"/><code value="1-1"/></coding>
+          <coding><system value="http://local"/><code value="A"/></coding>
+        </code>
+        <effectiveDateTime value="2023-02-20T12:52:00+01:00"/>
+      </Observation>
+    </resource>
+    <request>
+      <method value="PUT"/>
+      <url value="Observation/1"/>
+    </request>
+  </entry>
+</Bundle>`
+
+func TestParseXmlPayload(t *testing.T) {
+	p, err := ParsePayload([]byte(xmlBundle), "")
+
+	assert.NoError(t, err)
+	assert.True(t, p.IsXml())
+	assert.Equal(t, BundlePayload, p.Type)
+	assert.Len(t, p.Bundle.Entry, 1)
+	assert.Equal(t, "urn:uuid:1", *p.Bundle.Entry[0].FullUrl)
+	assert.Equal(t, "PUT", p.Bundle.Entry[0].Request.Method.Code())
+	assert.Equal(t, "Observation/1", p.Bundle.Entry[0].Request.Url)
+
+	var r map[string]interface{}
+	_ = json.Unmarshal(p.Bundle.Entry[0].Resource, &r)
+	assert.Equal(t, "Observation", r["resourceType"])
+	assert.Equal(t, "2023-02-20T12:52:00+01:00", r["effectiveDateTime"])
+	assert.Len(t, r["code"].(map[string]interface{})["coding"], 2)
+
+	// bundle is sent as it is (without prolog)
+	b, _ := p.Bytes()
+	assert.Contains(t, string(b), `<Bundle xmlns="http://hl7.org/fhir">`)
+	assert.NotContains(t, string(b), `<?xml`)
+}
+
+func TestParseXmlResource(t *testing.T) {
+	p, err := ParsePayload([]byte(`<Patient xmlns="http://hl7.org/fhir"><id value="42"/></Patient>`), XmlContentType)
+
+	assert.NoError(t, err)
+	assert.Equal(t, ResourcePayload, p.Type)
+	assert.Equal(t, "Patient/42", p.Bundle.Entry[0].Request.Url)
+
+	b, _ := p.Bytes()
+	assert.Equal(t, `<Bundle xmlns="http://hl7.org/fhir"><type value="batch"/><entry><resource>`+
+		`<Patient xmlns="http://hl7.org/fhir"><id value="42"/></Patient>`+
+		`</resource><request><method value="PUT"/><url value="Patient/42"/></request></entry></Bundle>`, string(b))
+}
+
+func TestApplyFilterXml(t *testing.T) {
+	loc, _ = time.LoadLocation("Europe/Berlin")
+	f := NewDateFilter(config.DateConfig{Value: createTime("2018-03-01"), Comparator: ">"})
+
+	assert.True(t, f.apply([]byte(xmlBundle)))
+}
+
+func TestProcessXmlMessage(t *testing.T) {
+	baseUrl := "https://dummy-url/fhir"
+	p := NewProcessor(config.Fhir{Server: config.Server{BaseUrl: baseUrl}})
+
+	// set up mock
+	httpmock.Reset()
+	httpmock.ActivateNonDefault(p.client.rest.GetClient())
+	httpmock.RegisterResponder("POST", baseUrl, func(req *http.Request) (*http.Response, error) {
+		assert.Equal(t, XmlContentType, req.Header.Get("Content-Type"))
+		assert.Equal(t, JsonContentType, req.Header.Get("Accept"))
+		return httpmock.NewStringResponse(200, `{"type": "batch-response", "entry": [{"response": {"status": "200"}}], "resourceType": "Bundle"}`), nil
+	})
+
+	testTopic := "test"
+	ok := p.ProcessMessage(&source.Message{
+		Origin:  source.Origin{Topic: testTopic, Offset: 42},
+		Value:   []byte(xmlBundle),
+		Key:     []byte("test"),
+		Headers: []source.Header{{Key: "Content-Type", Value: []byte(XmlContentType)}},
+	})
+
+	assert.True(t, ok)
+	assert.Equal(t, 1, httpmock.GetTotalCallCount())
+}
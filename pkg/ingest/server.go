@@ -0,0 +1,182 @@
+package ingest
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	models "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	fhirJson = "application/fhir+json"
+	// defaultMaxBytes limits request bodies, if no maximum size is configured
+	defaultMaxBytes = 100 << 20
+	// readHeaderTimeout limits the time to read request headers of slow clients
+	readHeaderTimeout = 10 * time.Second
+)
+
+// Submit handles a submitted bundle and returns the response status and body
+type Submit func(msg *source.Message) (int, []byte)
+
+// Handler accepts FHIR JSON bundles at POST /bundle and submits them as
+// messages of the configured topic. Request headers with the given names are
+// passed as message headers
+type Handler struct {
+	config  config.Http
+	headers []string
+	submit  Submit
+}
+
+func NewHandler(config config.Http, headers []string, submit Submit) *Handler {
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defaultMaxBytes
+	}
+	return &Handler{config: config, headers: headers, submit: submit}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/bundle" {
+		respond(w, http.StatusNotFound, outcome(models.IssueTypeNotFound, "unknown path: "+r.URL.Path))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		respond(w, http.StatusMethodNotAllowed, outcome(models.IssueTypeNotSupported, "method not allowed: "+r.Method))
+		return
+	}
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="fhir-to-server"`)
+		respond(w, http.StatusUnauthorized, outcome(models.IssueTypeLogin, "authentication required"))
+		return
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil ||
+		(mediaType != fhirJson && mediaType != "application/json") {
+		respond(w, http.StatusUnsupportedMediaType, outcome(models.IssueTypeNotSupported, "content type must be FHIR JSON"))
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.config.MaxBytes))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respond(w, http.StatusRequestEntityTooLarge, outcome(models.IssueTypeTooLong, err.Error()))
+		return
+	}
+	if err != nil {
+		respond(w, http.StatusBadRequest, outcome(models.IssueTypeStructure, err.Error()))
+		return
+	}
+
+	var bundle struct {
+		ResourceType string `json:"resourceType"`
+		Id           string `json:"id"`
+	}
+	if err = json.Unmarshal(body, &bundle); err != nil || bundle.ResourceType != "Bundle" {
+		respond(w, http.StatusBadRequest, outcome(models.IssueTypeStructure, "a FHIR JSON bundle is required"))
+		return
+	}
+
+	msg := &source.Message{
+		Key:    []byte(bundle.Id),
+		Value:  body,
+		Origin: source.Origin{Topic: h.config.Topic},
+	}
+	for _, name := range h.headers {
+		if value := r.Header.Get(name); name != "" && value != "" {
+			msg.Headers = append(msg.Headers, source.Header{Key: name, Value: []byte(value)})
+		}
+	}
+
+	status, response := h.submit(msg)
+	log.Debug().Str("key", bundle.Id).Int("status", status).Msg("Bundle submitted")
+	respond(w, status, response)
+}
+
+// authorized checks the basic auth credentials, if configured. Client
+// certificates are verified by the TLS configuration
+func (h *Handler) authorized(r *http.Request) bool {
+	if h.config.Auth == nil || h.config.Auth.User == "" {
+		return true
+	}
+	user, password, ok := r.BasicAuth()
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(h.config.Auth.User)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(h.config.Auth.Password)) == 1
+}
+
+// Produce returns a Submit function, which produces messages to the topic and
+// waits for their delivery
+func Produce(producer source.Producer, topic string) Submit {
+	return func(msg *source.Message) (int, []byte) {
+		if err := producer.Produce(msg, topic); err != nil {
+			log.Error().Err(err).Str("topic", topic).Str("key", string(msg.Key)).Msg("Failed to buffer bundle")
+			return http.StatusServiceUnavailable, outcome(models.IssueTypeTransient, err.Error())
+		}
+		return http.StatusAccepted, nil
+	}
+}
+
+// Serve listens for requests in the background. With a certificate HTTPS is
+// served and, with a client CA, clients must present a certificate issued by it
+func Serve(config config.Http, handler http.Handler) (*http.Server, error) {
+	server := &http.Server{Addr: config.Address, Handler: handler, ReadHeaderTimeout: readHeaderTimeout}
+
+	tlsConfig := config.Tls
+	if tlsConfig.ClientCaLocation != "" && tlsConfig.CertificateLocation == "" {
+		return nil, errors.New("client certificate authentication requires a server certificate")
+	}
+	if tlsConfig.ClientCaLocation != "" {
+		ca, err := os.ReadFile(tlsConfig.ClientCaLocation)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", tlsConfig.ClientCaLocation)
+		}
+		server.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	}
+	if (config.Auth == nil || config.Auth.User == "") && tlsConfig.ClientCaLocation == "" {
+		log.Warn().Str("address", config.Address).Msg("HTTP endpoint without authentication")
+	}
+
+	go func() {
+		log.Info().Str("address", config.Address).Str("mode", config.Mode).Msg("Accepting bundles via HTTP")
+		var err error
+		if tlsConfig.CertificateLocation != "" {
+			err = server.ListenAndServeTLS(tlsConfig.CertificateLocation, tlsConfig.KeyLocation)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msg("HTTP endpoint stopped")
+		}
+	}()
+	return server, nil
+}
+
+func respond(w http.ResponseWriter, status int, body []byte) {
+	if len(body) > 0 {
+		w.Header().Set("Content-Type", fhirJson)
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// outcome returns an OperationOutcome with an error
+func outcome(code models.IssueType, diagnostics string) []byte {
+	data, _ := models.OperationOutcome{Issue: []models.OperationOutcomeIssue{
+		{Severity: models.IssueSeverityError, Code: code, Diagnostics: &diagnostics},
+	}}.MarshalJSON()
+	return data
+}
@@ -0,0 +1,76 @@
+package ingest
+
+import (
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const bundle = `{"resourceType": "Bundle", "id": "b1", "type": "batch"}`
+
+func TestServeHTTP(t *testing.T) {
+	cases := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		auth        bool
+		expected    int
+		submitted   bool
+	}{
+		{"success", "POST", "/bundle", "application/fhir+json", bundle, true, http.StatusAccepted, true},
+		{"jsonWithCharset", "POST", "/bundle", "application/json; charset=utf-8", bundle, true, http.StatusAccepted, true},
+		{"unknownPath", "POST", "/other", "application/fhir+json", bundle, true, http.StatusNotFound, false},
+		{"wrongMethod", "GET", "/bundle", "", "", true, http.StatusMethodNotAllowed, false},
+		{"unauthorized", "POST", "/bundle", "application/fhir+json", bundle, false, http.StatusUnauthorized, false},
+		{"xml", "POST", "/bundle", "application/fhir+xml", "<Bundle/>", true, http.StatusUnsupportedMediaType, false},
+		{"resource", "POST", "/bundle", "application/fhir+json", `{"resourceType": "Patient"}`, true, http.StatusBadRequest, false},
+		{"tooLarge", "POST", "/bundle", "application/fhir+json", bundle + strings.Repeat(" ", 100), true, http.StatusRequestEntityTooLarge, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var submitted *source.Message
+			h := NewHandler(config.Http{
+				Topic:    "http-fhir",
+				MaxBytes: 100,
+				Auth:     &config.Auth{User: "user", Password: "secret"},
+			}, []string{"fhir-target", ""}, func(msg *source.Message) (int, []byte) {
+				submitted = msg
+				return http.StatusAccepted, nil
+			})
+
+			req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+			req.Header.Set("Content-Type", c.contentType)
+			req.Header.Set("Fhir-Target", "research")
+			if c.auth {
+				req.SetBasicAuth("user", "secret")
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, c.expected, rec.Code)
+			assert.Equal(t, c.submitted, submitted != nil)
+			if submitted != nil {
+				assert.Equal(t, "http-fhir", submitted.Origin.Topic)
+				assert.Equal(t, "b1", string(submitted.Key))
+				assert.Equal(t, bundle, string(submitted.Value))
+				assert.Equal(t, []source.Header{{Key: "fhir-target", Value: []byte("research")}}, submitted.Headers)
+			} else {
+				assert.Equal(t, fhirJson, rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestNewHandlerMaxBytes(t *testing.T) {
+	h := NewHandler(config.Http{}, nil, nil)
+
+	assert.Equal(t, int64(defaultMaxBytes), h.config.MaxBytes)
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"errors"
+	"fhir-to-server/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	"net/http"
+)
+
+const namespace = "fhir_to_server"
+
+var (
+	DedupSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dedup_skipped_total",
+		Help:      "Number of unchanged messages or entries skipped by deduplication",
+	}, []string{"topic", "scope"})
+	DedupStored = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dedup_stored_total",
+		Help:      "Number of content hashes stored for deduplication",
+	}, []string{"topic"})
+	ConceptMapMapped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "concept_map_mapped_total",
+		Help:      "Number of codings translated by concept maps",
+	}, []string{"topic"})
+	ConceptMapUnmapped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "concept_map_unmapped_total",
+		Help:      "Number of codings of mapped systems without a concept map entry",
+	}, []string{"topic"})
+)
+
+// Serve exposes the metrics via HTTP at /metrics, if enabled
+func Serve(config config.Metrics) {
+	if !config.Enabled {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		log.Info().Str("address", config.Address).Msg("Serving metrics")
+		err := http.ListenAndServe(config.Address, mux)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msg("Metrics server stopped")
+		}
+	}()
+}
@@ -0,0 +1,202 @@
+package source
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Stdin is the path to read NDJSON records from standard input
+const Stdin = "-"
+
+// Files returns the files of the paths. Directories are expanded to their
+// .json and .ndjson files, including subdirectories
+func Files(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		if path == Stdin {
+			files = append(files, path)
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.WalkDir(path, func(name string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() && (isJson(name) || isNdjson(name)) {
+				files = append(files, name)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// FileSource reads messages from files. NDJSON files and stdin contain a
+// message per line, which is optionally prefixed with its key and a colon
+// (e.g. produced with kafkacat -K:). Other files are a single message without
+// key, e.g. a bundle or resource. Messages are assigned to the topic and
+// numbered by their line. Results are recorded per file
+type FileSource struct {
+	files   []string
+	topic   string
+	results []*FileResult
+
+	file   io.Closer
+	reader *bufio.Reader
+	line   int
+}
+
+// FileResult is the number of processed and failed messages of a file and the
+// error reading it
+type FileResult struct {
+	File      string
+	Processed int
+	Failed    int
+	Err       error
+}
+
+func NewFileSource(files []string, topic string) *FileSource {
+	return &FileSource{files: files, topic: topic}
+}
+
+// Receive returns the next message of the files. Files which cannot be read
+// are skipped with their error recorded
+func (s *FileSource) Receive(time.Duration) (*Message, error) {
+	for {
+		if s.reader == nil {
+			if len(s.files) == 0 {
+				return nil, io.EOF
+			}
+			if err := s.next(); err != nil {
+				s.fail(err)
+				continue
+			}
+		}
+
+		result := s.results[len(s.results)-1]
+		if !isNdjson(result.File) && result.File != Stdin {
+			data, err := io.ReadAll(s.reader)
+			s.close()
+			if err != nil {
+				result.Err = err
+				continue
+			}
+			return s.message(result, 0, nil, data), nil
+		}
+
+		data, err := s.reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			s.fail(err)
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			s.close()
+		}
+		s.line++
+
+		value := bytes.TrimSpace(data)
+		if len(value) == 0 {
+			continue
+		}
+		key, value := keyPrefix(value)
+		return s.message(result, s.line, key, value), nil
+	}
+}
+
+// keyPrefix splits a key prefix ("[key]:") off the line. The key ends at the
+// first colon which is followed by a JSON object or an XML document, so keys
+// may contain colons and unprefixed lines are not split
+func keyPrefix(line []byte) ([]byte, []byte) {
+	if line[0] == '{' || line[0] == '<' {
+		return nil, line
+	}
+	for i := 0; ; i++ {
+		n := bytes.IndexByte(line[i:], ':')
+		if n < 0 {
+			return nil, line
+		}
+		i += n
+		value := bytes.TrimSpace(line[i+1:])
+		if len(value) > 0 && (value[0] == '{' || value[0] == '<') {
+			return bytes.TrimSpace(line[:i]), value
+		}
+	}
+}
+
+// Results returns the results of the files read so far
+func (s *FileSource) Results() []*FileResult {
+	return s.results
+}
+
+func (s *FileSource) Close() error {
+	s.close()
+	return nil
+}
+
+// next opens the next file
+func (s *FileSource) next() error {
+	name := s.files[0]
+	s.files = s.files[1:]
+	s.results = append(s.results, &FileResult{File: name})
+	s.line = 0
+
+	if name == Stdin {
+		s.reader = bufio.NewReader(os.Stdin)
+		return nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.reader = bufio.NewReader(f)
+	return nil
+}
+
+func (s *FileSource) message(result *FileResult, line int, key, value []byte) *Message {
+	return &Message{
+		Key:    key,
+		Value:  value,
+		Origin: Origin{Topic: s.topic, Offset: int64(line)},
+		OnAck:  func(*Message) { result.Processed++ },
+		OnNack: func(*Message, error) { result.Failed++ },
+	}
+}
+
+// fail records the error of the current file and skips it
+func (s *FileSource) fail(err error) {
+	s.results[len(s.results)-1].Err = err
+	s.close()
+}
+
+func (s *FileSource) close() {
+	if s.file != nil {
+		_ = s.file.Close()
+	}
+	s.file = nil
+	s.reader = nil
+}
+
+func isJson(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".json")
+}
+
+func isNdjson(name string) bool {
+	ext := filepath.Ext(name)
+	return strings.EqualFold(ext, ".ndjson") || strings.EqualFold(ext, ".jsonl")
+}
@@ -0,0 +1,122 @@
+package source
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.json"), "{}")
+	writeFile(t, filepath.Join(dir, "sub", "b.ndjson"), "{}")
+	writeFile(t, filepath.Join(dir, "readme.txt"), "")
+
+	files, err := Files([]string{dir, Stdin})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "a.json"), filepath.Join(dir, "sub", "b.ndjson"), Stdin}, files)
+}
+
+func TestFileSource(t *testing.T) {
+	dir := t.TempDir()
+
+	cases := []struct {
+		name     string
+		file     string
+		content  string
+		expected []Message
+	}{
+		{
+			name:     "json",
+			file:     "bundle.json",
+			content:  "{\"resourceType\":\"Bundle\"}\n",
+			expected: []Message{{Value: []byte("{\"resourceType\":\"Bundle\"}\n")}},
+		},
+		{
+			name:    "ndjsonWithKeys",
+			file:    "data.ndjson",
+			content: "1:{\"resourceType\":\"Patient\"}\n\n2:{\"id\":\"a:b\"}",
+			expected: []Message{
+				{Key: []byte("1"), Value: []byte("{\"resourceType\":\"Patient\"}"), Origin: Origin{Offset: 1}},
+				{Key: []byte("2"), Value: []byte("{\"id\":\"a:b\"}"), Origin: Origin{Offset: 3}},
+			},
+		},
+		{
+			name:    "ndjsonWithColonKeys",
+			file:    "data.ndjson",
+			content: "Encounter|https://fhir.diz.uni-marburg.de/sid/encounter-id|42:{\"id\":\"a:b\"}\n",
+			expected: []Message{
+				{Key: []byte("Encounter|https://fhir.diz.uni-marburg.de/sid/encounter-id|42"), Value: []byte("{\"id\":\"a:b\"}"), Origin: Origin{Offset: 1}},
+			},
+		},
+		{
+			name:    "ndjsonXml",
+			file:    "data.ndjson",
+			content: "<Bundle xmlns=\"http://hl7.org/fhir\"/>\n1:<Patient xmlns=\"http://hl7.org/fhir\"/>\n",
+			expected: []Message{
+				{Value: []byte("<Bundle xmlns=\"http://hl7.org/fhir\"/>"), Origin: Origin{Offset: 1}},
+				{Key: []byte("1"), Value: []byte("<Patient xmlns=\"http://hl7.org/fhir\"/>"), Origin: Origin{Offset: 2}},
+			},
+		},
+		{
+			name:     "ndjsonWithoutKeys",
+			file:     "data.ndjson",
+			content:  "{\"id\":\"a:b\"}\n",
+			expected: []Message{{Value: []byte("{\"id\":\"a:b\"}"), Origin: Origin{Offset: 1}}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			name := filepath.Join(dir, c.file)
+			writeFile(t, name, c.content)
+			s := NewFileSource([]string{name}, "load")
+
+			var messages []Message
+			for {
+				m, err := s.Receive(0)
+				if err == io.EOF {
+					break
+				}
+				assert.NoError(t, err)
+				m.Ack()
+				messages = append(messages, Message{Key: m.Key, Value: m.Value, Origin: m.Origin})
+			}
+
+			for i := range c.expected {
+				c.expected[i].Origin.Topic = "load"
+			}
+			assert.Equal(t, c.expected, messages)
+			assert.Equal(t, []*FileResult{{File: name, Processed: len(c.expected)}}, s.Results())
+		})
+	}
+}
+
+func TestFileSourceResults(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "data.ndjson")
+	writeFile(t, name, "{}\n{}\n")
+	missing := filepath.Join(dir, "missing.json")
+	s := NewFileSource([]string{missing, name}, "load")
+
+	m, _ := s.Receive(0)
+	m.Ack()
+	m, _ = s.Receive(0)
+	m.Nack(errors.New("failed"))
+	_, err := s.Receive(0)
+
+	assert.Equal(t, io.EOF, err)
+	results := s.Results()
+	assert.Len(t, results, 2)
+	assert.Error(t, results[0].Err)
+	assert.Equal(t, FileResult{File: name, Processed: 1, Failed: 1}, *results[1])
+}
+
+func writeFile(t *testing.T, name, content string) {
+	assert.NoError(t, os.MkdirAll(filepath.Dir(name), 0o755))
+	assert.NoError(t, os.WriteFile(name, []byte(content), 0o644))
+}
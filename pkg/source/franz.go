@@ -0,0 +1,288 @@
+package source
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fhir-to-server/pkg/config"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const franzTimeout = 10 * time.Second
+
+// FranzSource receives the messages of a consumer group with the pure Go
+// client franz-go. Acknowledged messages mark their offset, which is committed
+// automatically and on close, like stored offsets of librdkafka
+type FranzSource struct {
+	client   *kgo.Client
+	clientId string
+	records  []*kgo.Record
+	// lost is set, if the consumer lost its partitions due to a fatal group error
+	lost atomic.Bool
+}
+
+// NewFranzSource creates a consumer of the topic in the group, which starts at
+// the earliest offset without committed offsets
+func NewFranzSource(kafka config.Kafka, group, topic, clientId string) (*FranzSource, error) {
+	opts, err := FranzOptions(kafka)
+	if err != nil {
+		return nil, err
+	}
+	s := &FranzSource{clientId: clientId}
+	opts = append(opts,
+		kgo.ClientID(clientId),
+		kgo.ConsumerGroup(group),
+		kgo.ConsumeTopics(topic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+		kgo.AutoCommitMarks(),
+		// commit marked offsets before partitions are reassigned
+		kgo.OnPartitionsRevoked(func(ctx context.Context, cl *kgo.Client, _ map[string][]int32) {
+			if err := cl.CommitMarkedOffsets(ctx); err != nil {
+				log.Error().Err(err).Msg("Failed to commit offsets")
+			}
+		}),
+		// e.g. the session expired, offsets of processed messages can't be committed
+		kgo.OnPartitionsLost(func(context.Context, *kgo.Client, map[string][]int32) {
+			s.lost.Store(true)
+		}),
+	)
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.client = client
+	return s, nil
+}
+
+// Receive returns the next message of the polled records. Fetch errors are
+// returned, if no records were fetched, timeouts are not errors. ErrLeftGroup
+// is returned once the consumer lost its partitions
+func (s *FranzSource) Receive(timeout time.Duration) (*Message, error) {
+	if s.lost.Load() {
+		return nil, fmt.Errorf("%w: partitions lost", ErrLeftGroup)
+	}
+	if len(s.records) == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		fetches := s.client.PollFetches(ctx)
+		var fetchErr error
+		fetches.EachError(func(topic string, partition int32, err error) {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return
+			}
+			err = fmt.Errorf("%s[%d]: %w", topic, partition, err)
+			if fetchErr == nil {
+				fetchErr = err
+			}
+			log.Warn().Err(err).Str("client-id", s.clientId).Msg("Fetch error")
+		})
+		s.records = fetches.Records()
+		if len(s.records) == 0 {
+			return nil, fetchErr
+		}
+	}
+
+	r := s.records[0]
+	s.records = s.records[1:]
+	return s.message(r), nil
+}
+
+// Close commits the marked offsets and closes the client
+func (s *FranzSource) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), franzTimeout)
+	defer cancel()
+
+	marked := s.client.MarkedOffsets()
+	err := s.client.CommitMarkedOffsets(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to commit offsets")
+	} else {
+		for topic, partitions := range marked {
+			for partition, offset := range partitions {
+				log.Info().
+					Str("topic", topic).
+					Int32("partition", partition).
+					Int64("offset", offset.Offset).
+					Msg("Stored offsets committed")
+			}
+		}
+	}
+	s.client.Close()
+	return nil
+}
+
+func (s *FranzSource) message(r *kgo.Record) *Message {
+	m := &Message{
+		Key:    r.Key,
+		Value:  r.Value,
+		Origin: Origin{Topic: r.Topic, Partition: r.Partition, Offset: r.Offset},
+		OnAck:  s.mark,
+	}
+	for _, h := range r.Headers {
+		m.Headers = append(m.Headers, Header{Key: h.Key, Value: h.Value})
+	}
+	return m
+}
+
+// mark marks the offset of the message to be committed
+func (s *FranzSource) mark(m *Message) {
+	s.client.MarkCommitOffsets(map[string]map[int32]kgo.EpochOffset{
+		m.Origin.Topic: {m.Origin.Partition: {Epoch: -1, Offset: m.Origin.Offset + 1}},
+	})
+
+	log.Debug().
+		Str("client-id", s.clientId).
+		Str("key", string(m.Key)).
+		Str("topic", m.Origin.Topic).
+		Int64("offset", m.Origin.Offset).
+		Msg("Offset for message stored")
+}
+
+// FranzProducer produces messages with franz-go. Produce requests are
+// idempotent
+type FranzProducer struct {
+	client *kgo.Client
+}
+
+func NewFranzProducer(kafka config.Kafka) (*FranzProducer, error) {
+	opts, err := FranzOptions(kafka)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &FranzProducer{client: client}, nil
+}
+
+func (p *FranzProducer) Produce(msg *Message, topic string) error {
+	r := &kgo.Record{Topic: topic, Key: msg.Key, Value: msg.Value}
+	for _, h := range msg.Headers {
+		r.Headers = append(r.Headers, kgo.RecordHeader{Key: h.Key, Value: h.Value})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), franzTimeout)
+	defer cancel()
+	if err := p.client.ProduceSync(ctx, r).FirstErr(); err != nil {
+		return fmt.Errorf("failed to deliver message to %s: %w", topic, err)
+	}
+	return nil
+}
+
+func (p *FranzProducer) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = p.client.Flush(ctx)
+	p.client.Close()
+}
+
+// FranzOptions returns the connection options of the configuration: brokers,
+// TLS and SASL depending on the security protocol, connections via IPv4
+func FranzOptions(kafka config.Kafka) ([]kgo.Opt, error) {
+	var brokers []string
+	for _, b := range strings.Split(kafka.BootstrapServers, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			brokers = append(brokers, b)
+		}
+	}
+	opts := []kgo.Opt{kgo.SeedBrokers(brokers...)}
+
+	dialer := &net.Dialer{Timeout: franzTimeout}
+	var tlsConfig *tls.Config
+	switch protocol := strings.ToLower(kafka.SecurityProtocol); protocol {
+	case "", "plaintext", "sasl_plaintext":
+	case "ssl", "sasl_ssl":
+		var err error
+		if tlsConfig, err = newTlsConfig(kafka.Ssl); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported security protocol: %s", kafka.SecurityProtocol)
+	}
+	opts = append(opts, kgo.Dialer(func(ctx context.Context, _, host string) (net.Conn, error) {
+		if tlsConfig != nil {
+			cfg := tlsConfig.Clone()
+			if cfg.ServerName == "" {
+				cfg.ServerName, _, _ = net.SplitHostPort(host)
+			}
+			return (&tls.Dialer{NetDialer: dialer, Config: cfg}).DialContext(ctx, "tcp4", host)
+		}
+		return dialer.DialContext(ctx, "tcp4", host)
+	}))
+
+	if strings.HasPrefix(strings.ToLower(kafka.SecurityProtocol), "sasl_") {
+		mechanism, err := saslMechanism(kafka.Sasl)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, mechanism)
+	}
+	return opts, nil
+}
+
+func saslMechanism(sasl config.Sasl) (kgo.Opt, error) {
+	switch strings.ToUpper(sasl.Mechanism) {
+	case "PLAIN":
+		return kgo.SASL(plain.Auth{User: sasl.Username, Pass: sasl.Password}.AsMechanism()), nil
+	case "SCRAM-SHA-256":
+		return kgo.SASL(scram.Auth{User: sasl.Username, Pass: sasl.Password}.AsSha256Mechanism()), nil
+	case "SCRAM-SHA-512":
+		return kgo.SASL(scram.Auth{User: sasl.Username, Pass: sasl.Password}.AsSha512Mechanism()), nil
+	default:
+		return nil, fmt.Errorf("unsupported SASL mechanism: %s", sasl.Mechanism)
+	}
+}
+
+// newTlsConfig loads the CA and the client certificate. Encrypted keys are
+// not supported
+func newTlsConfig(ssl config.Ssl) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if ssl.CaLocation != "" {
+		ca, err := os.ReadFile(ssl.CaLocation)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", ssl.CaLocation)
+		}
+	}
+
+	if ssl.CertificateLocation != "" {
+		cert, err := os.ReadFile(ssl.CertificateLocation)
+		if err != nil {
+			return nil, err
+		}
+		key, err := os.ReadFile(ssl.KeyLocation)
+		if err != nil {
+			return nil, err
+		}
+		// legacy PEM encryption is insecure and PKCS#8 encryption isn't supported by the standard library
+		if block, _ := pem.Decode(key); block != nil &&
+			(block.Type == "ENCRYPTED PRIVATE KEY" || strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED")) {
+			return nil, fmt.Errorf("encrypted key %s is not supported by the franz client, decrypt it or use the confluent client",
+				ssl.KeyLocation)
+		}
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	return cfg, nil
+}
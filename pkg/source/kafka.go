@@ -0,0 +1,153 @@
+//go:build !franz
+
+package source
+
+import (
+	"errors"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// KafkaSource receives the messages of a subscribed or assigned consumer
+// (librdkafka). Acknowledged messages store their offset, which is committed
+// automatically and on close
+type KafkaSource struct {
+	consumer *kafka.Consumer
+	clientId string
+}
+
+func NewKafkaSource(consumer *kafka.Consumer, clientId string) *KafkaSource {
+	return &KafkaSource{consumer: consumer, clientId: clientId}
+}
+
+// Consumer returns the consumer, e.g. to commit offsets or pause partitions
+func (s *KafkaSource) Consumer() *kafka.Consumer {
+	return s.consumer
+}
+
+// Receive returns the next message. Consumer errors are returned as
+// kafka.Error, timeouts are not errors
+func (s *KafkaSource) Receive(timeout time.Duration) (*Message, error) {
+	msg, err := s.consumer.ReadMessage(timeout)
+	if err != nil {
+		var kafkaErr kafka.Error
+		if errors.As(err, &kafkaErr) && kafkaErr.IsTimeout() {
+			return nil, nil
+		}
+		// Exceeding 'max.poll.interval.ms' makes the client leave the consumer group
+		if errors.As(err, &kafkaErr) && kafkaErr.Code() == kafka.ErrMaxPollExceeded {
+			return nil, fmt.Errorf("%w: %w", ErrLeftGroup, err)
+		}
+		return nil, err
+	}
+	return s.message(msg), nil
+}
+
+// Close commits the stored offsets of a subscribed consumer and closes it
+func (s *KafkaSource) Close() error {
+	if err := s.consumer.Unsubscribe(); err != nil {
+		log.Error().Msg("Failed to unsubscribe consumer from the current subscription")
+	}
+	parts, err := s.consumer.Commit()
+	var kafkaErr kafka.Error
+	if err != nil && !(errors.As(err, &kafkaErr) && kafkaErr.Code() == kafka.ErrNoOffset) {
+		log.Error().Err(err).Msg("Failed to commit offsets")
+	}
+	for _, tp := range parts {
+		log.Info().
+			Str("topic", *tp.Topic).
+			Int32("partition", tp.Partition).
+			Str("offset", tp.Offset.String()).
+			Msg("Stored offsets committed")
+	}
+	return s.consumer.Close()
+}
+
+func (s *KafkaSource) message(msg *kafka.Message) *Message {
+	m := &Message{
+		Key:   msg.Key,
+		Value: msg.Value,
+		Origin: Origin{
+			Partition: msg.TopicPartition.Partition,
+			Offset:    int64(msg.TopicPartition.Offset),
+		},
+		OnAck: s.store,
+	}
+	if msg.TopicPartition.Topic != nil {
+		m.Origin.Topic = *msg.TopicPartition.Topic
+	}
+	for _, h := range msg.Headers {
+		m.Headers = append(m.Headers, Header{Key: h.Key, Value: h.Value})
+	}
+	return m
+}
+
+// store stores the offset of the message to be committed
+func (s *KafkaSource) store(m *Message) {
+	topic := m.Origin.Topic
+	_, err := s.consumer.StoreOffsets([]kafka.TopicPartition{{
+		Topic:     &topic,
+		Partition: m.Origin.Partition,
+		Offset:    kafka.Offset(m.Origin.Offset + 1),
+	}})
+
+	var logEvent *zerolog.Event
+	var logMsg string
+
+	if err != nil {
+		logEvent = log.Warn()
+		logMsg = "Failed to commit offset for message"
+	} else {
+		logEvent = log.Debug()
+		logMsg = "Offset for message stored"
+	}
+
+	logEvent.
+		Str("client-id", s.clientId).
+		Str("key", string(m.Key)).
+		Str("topic", topic).
+		Int64("offset", m.Origin.Offset).
+		Msg(logMsg)
+}
+
+// KafkaProducer produces messages with librdkafka
+type KafkaProducer struct {
+	producer *kafka.Producer
+}
+
+func NewKafkaProducer(producer *kafka.Producer) *KafkaProducer {
+	return &KafkaProducer{producer: producer}
+}
+
+func (p *KafkaProducer) Produce(msg *Message, topic string) error {
+	delivery := make(chan kafka.Event, 1)
+	if err := p.producer.Produce(kafkaMessage(msg, topic), delivery); err != nil {
+		return err
+	}
+
+	if m, ok := (<-delivery).(*kafka.Message); ok && m.TopicPartition.Error != nil {
+		return fmt.Errorf("failed to deliver message to %s: %w", topic, m.TopicPartition.Error)
+	}
+	return nil
+}
+
+func (p *KafkaProducer) Close() {
+	p.producer.Flush(5000)
+	p.producer.Close()
+}
+
+// kafkaMessage converts the message to a Kafka message of the topic
+func kafkaMessage(m *Message, topic string) *kafka.Message {
+	msg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            m.Key,
+		Value:          m.Value,
+	}
+	for _, h := range m.Headers {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: h.Key, Value: h.Value})
+	}
+	return msg
+}
@@ -0,0 +1,98 @@
+package source
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrLeftGroup is returned by sources whose consumer left its group, e.g. after
+// exceeding the maximum poll interval
+var ErrLeftGroup = errors.New("consumer left the group")
+
+// Message is a message of any source, e.g. a Kafka record, a line of a file or
+// an HTTP request
+type Message struct {
+	Key     []byte
+	Value   []byte
+	Headers []Header
+	Origin  Origin
+	// OnAck and OnNack are called when the message is acknowledged or rejected
+	OnAck  func(m *Message)
+	OnNack func(m *Message, err error)
+}
+
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Origin identifies the message within its source. Messages of other sources
+// than Kafka are assigned to a topic for topic specific configuration and
+// numbered by their offset
+type Origin struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+// Ack marks the message as processed, e.g. stores its offset
+func (m *Message) Ack() {
+	if m.OnAck != nil {
+		m.OnAck(m)
+	}
+}
+
+// Nack marks the message as failed
+func (m *Message) Nack(err error) {
+	if m.OnNack != nil {
+		m.OnNack(m, err)
+	}
+}
+
+// Source provides the messages to process
+type Source interface {
+	// Receive returns the next message or nil, if no message is available
+	// within the timeout. Finite sources return io.EOF after the last message
+	Receive(timeout time.Duration) (*Message, error)
+	Close() error
+}
+
+// Producer produces messages to Kafka topics
+type Producer interface {
+	// Produce sends the message to the topic and waits for its delivery
+	Produce(msg *Message, topic string) error
+	// Close waits for outstanding messages and closes the producer
+	Close()
+}
+
+// MemorySource provides a fixed list of messages and records their results,
+// e.g. for tests
+type MemorySource struct {
+	messages []*Message
+	Acked    []*Message
+	Nacked   []*Message
+}
+
+func NewMemorySource(messages ...*Message) *MemorySource {
+	s := &MemorySource{}
+	for _, m := range messages {
+		m.OnAck = func(m *Message) { s.Acked = append(s.Acked, m) }
+		m.OnNack = func(m *Message, _ error) { s.Nacked = append(s.Nacked, m) }
+		s.messages = append(s.messages, m)
+	}
+	return s
+}
+
+func (s *MemorySource) Receive(time.Duration) (*Message, error) {
+	if len(s.messages) == 0 {
+		return nil, io.EOF
+	}
+	m := s.messages[0]
+	s.messages = s.messages[1:]
+	return m, nil
+}
+
+func (s *MemorySource) Close() error {
+	return nil
+}
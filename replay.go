@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"flag"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bound is the start or end of a replay: the earliest or latest offset, an
+// offset or a timestamp
+type bound struct {
+	name   string
+	offset int64
+	time   *time.Time
+}
+
+// replayRange is the offset range [start, end) of a partition to replay
+type replayRange struct {
+	topic     string
+	partition int32
+	start     int64
+	end       int64
+	// next offset to process
+	next      int64
+	processed int
+}
+
+func (r *replayRange) done() bool {
+	return r.next >= r.end
+}
+
+type replayKey struct {
+	topic     string
+	partition int32
+}
+
+// replayer reads topic partitions from an offset to an end offset with a
+// consumer, which neither commits nor stores offsets
+type replayer interface {
+	// ranges resolves the bounds to the offset ranges of the topic's partitions
+	ranges(topic string, partitions []int32, start, end bound) ([]*replayRange, error)
+	// replay processes the messages of the ranges until all ranges are done
+	// and returns false, if a message failed
+	replay(ranges []*replayRange, process func(msg *source.Message) bool) bool
+	Close() error
+}
+
+// replayCommand sends the messages of topic partitions from a start to an end
+// bound to the FHIR server and exits with a summary: "replay [--topics <topics>]
+// [--partitions <partitions>] [--from <start>] [--to <end>]"
+func replayCommand(appConfig config.AppConfig, args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	topics := flags.String("topics", strings.Join(appConfig.Kafka.InputTopics, ","), "comma separated topics")
+	partitions := flags.String("partitions", "", "comma separated partitions (default: all)")
+	from := flags.String("from", "earliest", "start: earliest, an offset or a timestamp (inclusive)")
+	to := flags.String("to", "latest", "end: latest, an offset (inclusive) or a timestamp (exclusive)")
+	check(flags.Parse(args))
+
+	start, err := parseBound(*from)
+	check(err)
+	end, err := parseBound(*to)
+	check(err)
+	partitionFilter, err := parsePartitions(*partitions)
+	check(err)
+	if *topics == "" {
+		log.Fatal().Msg("Usage: fhir-to-server replay --topics <topics> [--partitions <partitions>] [--from <start>] [--to <end>]")
+	}
+
+	consumer := newReplayer(appConfig)
+	defer func() { check(consumer.Close()) }()
+
+	var ranges []*replayRange
+	for _, topic := range strings.Split(*topics, ",") {
+		topicRanges, err := consumer.ranges(strings.TrimSpace(topic), partitionFilter, start, end)
+		check(err)
+		ranges = append(ranges, topicRanges...)
+	}
+
+	// the messages are resent, even if their content was sent before. Parked
+	// messages would not be retried after the end bound is reached, so held
+	// messages are rejected
+	appConfig.Fhir.Dedup.Enabled = false
+	appConfig.Fhir = withoutParking(appConfig.Fhir)
+	processor, closeProcessor := newProcessor(appConfig)
+	defer closeProcessor()
+
+	success := consumer.replay(ranges, func(msg *source.Message) bool {
+		return processor.ProcessMessage(msg)
+	})
+
+	for _, r := range ranges {
+		log.Info().
+			Str("topic", r.topic).
+			Int32("partition", r.partition).
+			Int64("from", r.start).
+			Int64("to", r.end).
+			Int("processed", r.processed).
+			Bool("complete", r.done()).
+			Msg("Partition replayed")
+	}
+	if report := processor.Report(); report != nil {
+		report.Log()
+	}
+	if !success {
+		closeProcessor()
+		check(consumer.Close())
+		log.Error().Msg("Replay failed")
+		os.Exit(1)
+	}
+	log.Info().Int("partitions", len(ranges)).Msg("Replay finished")
+}
+
+// parseBound parses "earliest", "latest", an offset or a timestamp (RFC 3339
+// or date)
+func parseBound(value string) (bound, error) {
+	if value == "earliest" || value == "latest" {
+		return bound{name: value}, nil
+	}
+	if offset, err := strconv.ParseInt(value, 10, 64); err == nil && offset >= 0 {
+		return bound{offset: offset}, nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return bound{time: &t}, nil
+		}
+	}
+	return bound{}, fmt.Errorf("invalid replay bound: %s", value)
+}
+
+func parsePartitions(value string) ([]int32, error) {
+	var partitions []int32
+	if value == "" {
+		return partitions, nil
+	}
+	for _, p := range strings.Split(value, ",") {
+		partition, err := strconv.ParseInt(strings.TrimSpace(p), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid partition: %s", p)
+		}
+		partitions = append(partitions, int32(partition))
+	}
+	return partitions, nil
+}
+
+// resolve returns the offset of the bound within the partition's watermarks.
+// Timestamps are resolved by offsetForTime, which returns a negative offset
+// without message at or after the timestamp. End offsets are exclusive
+func resolve(b bound, low, high int64, isEnd bool, offsetForTime func(t time.Time) (int64, error)) (int64, error) {
+	var offset int64
+	switch {
+	case b.name == "earliest":
+		offset = low
+	case b.name == "latest":
+		offset = high
+	case b.time != nil:
+		var err error
+		if offset, err = offsetForTime(*b.time); err != nil {
+			return 0, err
+		}
+		// no message at or after the timestamp
+		if offset < 0 {
+			offset = high
+		}
+	case isEnd:
+		offset = b.offset + 1
+	default:
+		offset = b.offset
+	}
+	return min(max(offset, low), high), nil
+}
@@ -0,0 +1,173 @@
+//go:build !franz
+
+package main
+
+import (
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/rs/zerolog/log"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+)
+
+const replayTimeoutMs = 10000
+
+// confluentReplayer replays partitions with librdkafka
+type confluentReplayer struct {
+	consumer *kafka.Consumer
+}
+
+// newConfluentReplayer creates a consumer of an ephemeral group, which neither
+// commits nor stores offsets
+func newConfluentReplayer(appConfig config.AppConfig) replayer {
+	configMap := kafkaConfig(appConfig)
+	configMap["group.id"] = fmt.Sprintf("%s-replay-%d", appConfig.App.Name, time.Now().UnixMilli())
+	configMap["enable.auto.commit"] = false
+	configMap["enable.auto.offset.store"] = false
+
+	consumer, err := kafka.NewConsumer(&configMap)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to connect to Kafka")
+	}
+	return &confluentReplayer{consumer: consumer}
+}
+
+func (c *confluentReplayer) Close() error {
+	return c.consumer.Close()
+}
+
+// replay assigns the partitions with messages to replay and processes their
+// messages until all partitions reached their end. Partitions are paused once
+// done
+func (c *confluentReplayer) replay(ranges []*replayRange, process func(msg *source.Message) bool) bool {
+	pending := make(map[replayKey]*replayRange)
+	var assignments []kafka.TopicPartition
+	for _, r := range ranges {
+		if !r.done() {
+			pending[replayKey{r.topic, r.partition}] = r
+			assignments = append(assignments, kafka.TopicPartition{Topic: &r.topic, Partition: r.partition, Offset: kafka.Offset(r.start)})
+		}
+	}
+	if len(assignments) == 0 {
+		return true
+	}
+	if err := c.consumer.Assign(assignments); err != nil {
+		log.Error().Err(err).Msg("Unable to assign partitions")
+		return false
+	}
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigchan)
+
+	src := source.NewKafkaSource(c.consumer, "replay")
+	for len(pending) > 0 {
+		select {
+		case <-sigchan:
+			log.Warn().Msg("Replay interrupted")
+			return false
+		default:
+		}
+
+		msg, err := src.Receive(1 * time.Second)
+		if err != nil {
+			log.Error().Err(err).Msg("Consumer error")
+			continue
+		}
+		if msg == nil {
+			// the end of partitions may be a transaction marker
+			c.completePositions(pending)
+			continue
+		}
+
+		key := replayKey{msg.Origin.Topic, msg.Origin.Partition}
+		r, ok := pending[key]
+		if !ok || msg.Origin.Offset >= r.end {
+			continue
+		}
+		if !process(msg) {
+			return false
+		}
+		r.processed++
+		// offsets of compacted topics and transaction markers may be skipped
+		r.next = msg.Origin.Offset + 1
+
+		if r.done() {
+			delete(pending, key)
+			tp := kafka.TopicPartition{Topic: &r.topic, Partition: r.partition}
+			if err := c.consumer.Pause([]kafka.TopicPartition{tp}); err != nil {
+				log.Warn().Err(err).Str("topic", key.topic).Int32("partition", key.partition).Msg("Unable to pause partition")
+			}
+		}
+	}
+	return true
+}
+
+// completePositions removes the pending partitions whose consumer position
+// reached their end without a message
+func (c *confluentReplayer) completePositions(pending map[replayKey]*replayRange) {
+	var assigned []kafka.TopicPartition
+	for _, r := range pending {
+		assigned = append(assigned, kafka.TopicPartition{Topic: &r.topic, Partition: r.partition})
+	}
+	positions, err := c.consumer.Position(assigned)
+	if err != nil {
+		return
+	}
+	for _, p := range positions {
+		key := replayKey{*p.Topic, p.Partition}
+		if r := pending[key]; p.Offset >= 0 && int64(p.Offset) >= r.end {
+			r.next = int64(p.Offset)
+			delete(pending, key)
+		}
+	}
+}
+
+// ranges resolves the bounds to the offset ranges of the topic's partitions
+func (c *confluentReplayer) ranges(topic string, partitions []int32, start, end bound) ([]*replayRange, error) {
+	metadata, err := c.consumer.GetMetadata(&topic, false, replayTimeoutMs)
+	if err != nil {
+		return nil, err
+	}
+	topicMetadata, ok := metadata.Topics[topic]
+	if !ok || topicMetadata.Error.Code() != kafka.ErrNoError {
+		return nil, fmt.Errorf("unknown topic: %s", topic)
+	}
+
+	var ranges []*replayRange
+	for _, p := range topicMetadata.Partitions {
+		if len(partitions) > 0 && !slices.Contains(partitions, p.ID) {
+			continue
+		}
+		low, high, err := c.consumer.QueryWatermarkOffsets(topic, p.ID, replayTimeoutMs)
+		if err != nil {
+			return nil, err
+		}
+		offsetForTime := func(t time.Time) (int64, error) {
+			tp := kafka.TopicPartition{Topic: &topic, Partition: p.ID, Offset: kafka.Offset(t.UnixMilli())}
+			offsets, err := c.consumer.OffsetsForTimes([]kafka.TopicPartition{tp}, replayTimeoutMs)
+			if err != nil {
+				return 0, err
+			}
+			return int64(offsets[0].Offset), nil
+		}
+		from, err := resolve(start, low, high, false, offsetForTime)
+		if err != nil {
+			return nil, err
+		}
+		to, err := resolve(end, low, high, true, offsetForTime)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, &replayRange{topic: topic, partition: p.ID, start: from, end: max(from, to), next: from})
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no matching partitions of topic %s", topic)
+	}
+	return ranges, nil
+}
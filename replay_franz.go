@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fhir-to-server/pkg/config"
+	"fhir-to-server/pkg/source"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+)
+
+const franzReplayTimeout = 10 * time.Second
+
+// franzReplayer replays partitions with franz-go. Partitions are consumed
+// directly without consumer group
+type franzReplayer struct {
+	opts   []kgo.Opt
+	client *kgo.Client
+}
+
+func newFranzReplayer(appConfig config.AppConfig) replayer {
+	opts, err := source.FranzOptions(appConfig.Kafka)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to connect to Kafka")
+	}
+	opts = append(opts, kgo.ClientID(appConfig.App.Name+"-replay"))
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to connect to Kafka")
+	}
+	return &franzReplayer{opts: opts, client: client}
+}
+
+func (f *franzReplayer) Close() error {
+	f.client.Close()
+	return nil
+}
+
+// replay consumes the partitions with messages to replay and processes their
+// messages until all partitions reached their end. Partitions are paused once
+// done. Transaction markers are kept to detect the end of partitions
+func (f *franzReplayer) replay(ranges []*replayRange, process func(msg *source.Message) bool) bool {
+	pending := make(map[replayKey]*replayRange)
+	assignments := make(map[string]map[int32]kgo.Offset)
+	for _, r := range ranges {
+		if !r.done() {
+			pending[replayKey{r.topic, r.partition}] = r
+			if assignments[r.topic] == nil {
+				assignments[r.topic] = make(map[int32]kgo.Offset)
+			}
+			assignments[r.topic][r.partition] = kgo.NewOffset().At(r.start)
+		}
+	}
+	if len(pending) == 0 {
+		return true
+	}
+	consumer, err := kgo.NewClient(append(slices.Clone(f.opts),
+		kgo.ConsumePartitions(assignments),
+		kgo.FetchIsolationLevel(kgo.ReadCommitted()),
+		kgo.KeepControlRecords(),
+	)...)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to assign partitions")
+		return false
+	}
+	defer consumer.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	for len(pending) > 0 {
+		fetches := consumer.PollFetches(ctx)
+		if ctx.Err() != nil {
+			log.Warn().Msg("Replay interrupted")
+			return false
+		}
+		fetches.EachError(func(topic string, partition int32, err error) {
+			log.Error().Err(err).Str("topic", topic).Int32("partition", partition).Msg("Consumer error")
+		})
+
+		for _, record := range fetches.Records() {
+			key := replayKey{record.Topic, record.Partition}
+			r, ok := pending[key]
+			if !ok || record.Offset >= r.end {
+				continue
+			}
+			if !record.Attrs.IsControl() {
+				if !process(replayMessage(record)) {
+					return false
+				}
+				r.processed++
+			}
+			// offsets of compacted topics may be skipped
+			r.next = record.Offset + 1
+
+			if r.done() {
+				delete(pending, key)
+				consumer.PauseFetchPartitions(map[string][]int32{key.topic: {key.partition}})
+			}
+		}
+	}
+	return true
+}
+
+func replayMessage(r *kgo.Record) *source.Message {
+	m := &source.Message{
+		Key:    r.Key,
+		Value:  r.Value,
+		Origin: source.Origin{Topic: r.Topic, Partition: r.Partition, Offset: r.Offset},
+	}
+	for _, h := range r.Headers {
+		m.Headers = append(m.Headers, source.Header{Key: h.Key, Value: h.Value})
+	}
+	return m
+}
+
+// ranges resolves the bounds to the offset ranges of the topic's partitions
+func (f *franzReplayer) ranges(topic string, partitions []int32, start, end bound) ([]*replayRange, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), franzReplayTimeout)
+	defer cancel()
+
+	req := kmsg.NewPtrMetadataRequest()
+	reqTopic := kmsg.NewMetadataRequestTopic()
+	reqTopic.Topic = kmsg.StringPtr(topic)
+	req.Topics = append(req.Topics, reqTopic)
+	resp, err := req.RequestWith(ctx, f.client)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int32
+	for _, t := range resp.Topics {
+		if t.Topic == nil || *t.Topic != topic || kerr.ErrorForCode(t.ErrorCode) != nil {
+			return nil, fmt.Errorf("unknown topic: %s", topic)
+		}
+		for _, p := range t.Partitions {
+			if len(partitions) == 0 || slices.Contains(partitions, p.Partition) {
+				ids = append(ids, p.Partition)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no matching partitions of topic %s", topic)
+	}
+	slices.Sort(ids)
+
+	// earliest and latest offsets
+	low, err := f.listOffsets(ctx, topic, ids, -2)
+	if err != nil {
+		return nil, err
+	}
+	high, err := f.listOffsets(ctx, topic, ids, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	var ranges []*replayRange
+	for _, p := range ids {
+		offsetForTime := func(t time.Time) (int64, error) {
+			offsets, err := f.listOffsets(ctx, topic, []int32{p}, t.UnixMilli())
+			return offsets[p], err
+		}
+		from, err := resolve(start, low[p], high[p], false, offsetForTime)
+		if err != nil {
+			return nil, err
+		}
+		to, err := resolve(end, low[p], high[p], true, offsetForTime)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, &replayRange{topic: topic, partition: p, start: from, end: max(from, to), next: from})
+	}
+	return ranges, nil
+}
+
+// listOffsets returns the offsets of the partitions at the timestamp, -2 for
+// the earliest and -1 for the latest (committed) offsets. Offsets are -1
+// without message at or after the timestamp
+func (f *franzReplayer) listOffsets(ctx context.Context, topic string, partitions []int32, timestamp int64) (map[int32]int64, error) {
+	req := kmsg.NewPtrListOffsetsRequest()
+	// read committed, like the consumer
+	req.IsolationLevel = 1
+	reqTopic := kmsg.NewListOffsetsRequestTopic()
+	reqTopic.Topic = topic
+	for _, p := range partitions {
+		reqPartition := kmsg.NewListOffsetsRequestTopicPartition()
+		reqPartition.Partition = p
+		reqPartition.Timestamp = timestamp
+		reqTopic.Partitions = append(reqTopic.Partitions, reqPartition)
+	}
+	req.Topics = append(req.Topics, reqTopic)
+
+	resp, err := req.RequestWith(ctx, f.client)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[int32]int64)
+	for _, t := range resp.Topics {
+		for _, p := range t.Partitions {
+			if err := kerr.ErrorForCode(p.ErrorCode); err != nil {
+				return nil, fmt.Errorf("%s[%d]: %w", topic, p.Partition, err)
+			}
+			offsets[p.Partition] = p.Offset
+		}
+	}
+	return offsets, nil
+}